@@ -0,0 +1,328 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
+	"github.com/ryanrolds/plant-collector/bridge/internal/plants"
+	"github.com/ryanrolds/plant-collector/bridge/internal/store"
+	"github.com/sirupsen/logrus"
+)
+
+// latestLookback is how far back from a plant's newest sample its other
+// metrics are looked for
+const latestLookback = 24 * time.Hour
+
+// errNotFound is returned by handlers for unknown plants
+var errNotFound = errors.New("not found")
+
+// Plant is a plant in the plants listing
+type Plant struct {
+	ID       string     `json:"id"`
+	Name     string     `json:"name,omitempty"`
+	Species  string     `json:"species,omitempty"`
+	Room     string     `json:"room,omitempty"`
+	Zone     string     `json:"zone,omitempty"`
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+}
+
+// Reading is the latest value of a metric
+type Reading struct {
+	Value float64   `json:"value"`
+	Time  time.Time `json:"time"`
+}
+
+// Latest holds a plant's latest reading of every metric
+type Latest struct {
+	Plant   string             `json:"plant"`
+	Zone    string             `json:"zone,omitempty"`
+	Device  string             `json:"device"`
+	Time    time.Time          `json:"time"`
+	Metrics map[string]Reading `json:"metrics"`
+}
+
+// API serves the stored samples as JSON or CSV:
+//
+//	GET /api/plants
+//	GET /api/plants/{id}/latest
+//	GET /api/plants/{id}/series?metric=moist&from=&to=&step=
+//
+// Add format=csv, or send Accept: text/csv, for CSV.
+type API struct {
+	store  *store.Store
+	plants []plants.Plant
+	now    func() time.Time
+}
+
+func New(st *store.Store, registry *plants.Registry) *API {
+	return &API{
+		store:  st,
+		plants: registry.Plants(),
+		now:    time.Now,
+	}
+}
+
+// Handler serves the API under /api/
+func (a *API) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/plants", a.handlePlants)
+	mux.HandleFunc("/api/plants/", a.handlePlant)
+
+	return mux
+}
+
+func (a *API) handlePlants(w http.ResponseWriter, r *http.Request) {
+	if !allowed(w, r) {
+		return
+	}
+
+	list, err := a.listPlants()
+	if err != nil {
+		a.fail(w, r, err)
+		return
+	}
+
+	if wantsCSV(r) {
+		rows := [][]string{{"id", "name", "species", "room", "zone", "last_seen"}}
+		for _, p := range list {
+			lastSeen := ""
+			if p.LastSeen != nil {
+				lastSeen = p.LastSeen.Format(time.RFC3339Nano)
+			}
+			rows = append(rows, []string{p.ID, p.Name, p.Species, p.Room, p.Zone, lastSeen})
+		}
+
+		writeCSV(w, "plants.csv", rows)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+// handlePlant routes /api/plants/{id}/...
+func (a *API) handlePlant(w http.ResponseWriter, r *http.Request) {
+	if !allowed(w, r) {
+		return
+	}
+
+	rest := strings.TrimPrefix(r.URL.Path, "/api/plants/")
+	slash := strings.LastIndex(rest, "/")
+	if slash <= 0 {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	id, action := rest[:slash], rest[slash+1:]
+	switch action {
+	case "latest":
+		a.handleLatest(w, r, id)
+	case "series":
+		a.handleSeries(w, r, id)
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (a *API) handleLatest(w http.ResponseWriter, r *http.Request, id string) {
+	latest, err := a.latest(id)
+	if err != nil {
+		a.fail(w, r, err)
+		return
+	}
+
+	if wantsCSV(r) {
+		rows := [][]string{{"metric", "value", "time"}}
+		for _, metric := range ingester.Metrics {
+			reading, ok := latest.Metrics[metric]
+			if !ok {
+				continue
+			}
+
+			rows = append(rows, []string{metric, formatFloat(reading.Value), reading.Time.Format(time.RFC3339Nano)})
+		}
+
+		writeCSV(w, id+"-latest.csv", rows)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, latest)
+}
+
+func (a *API) handleSeries(w http.ResponseWriter, r *http.Request, id string) {
+	query, err := parseSeriesQuery(r.URL.Query(), a.now())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	series, err := a.series(id, query)
+	if err != nil {
+		a.fail(w, r, err)
+		return
+	}
+
+	if wantsCSV(r) {
+		rows := [][]string{{"time", "value", "min", "max", "count"}}
+		for _, p := range series.Points {
+			rows = append(rows, []string{
+				p.Time.Format(time.RFC3339Nano),
+				formatFloat(p.Value),
+				formatFloat(p.Min),
+				formatFloat(p.Max),
+				strconv.Itoa(p.Count),
+			})
+		}
+
+		writeCSV(w, id+"-"+series.Metric+".csv", rows)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, series)
+}
+
+// listPlants returns the registered plants and those with stored samples,
+// unregistered sensors are listed by MAC
+func (a *API) listPlants() ([]Plant, error) {
+	stored, err := a.store.Plants()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]Plant, 0, len(a.plants)+len(stored))
+	known := make(map[string]bool, len(a.plants))
+	for _, p := range a.plants {
+		list = append(list, Plant{
+			ID:      p.ID,
+			Name:    p.Name,
+			Species: p.Species,
+			Room:    p.Room,
+			Zone:    p.Zone,
+		})
+		known[p.ID] = true
+	}
+
+	for _, id := range stored {
+		if !known[id] {
+			list = append(list, Plant{ID: id})
+		}
+	}
+
+	for i := range list {
+		err := a.store.Reverse(list[i].ID, func(s ingester.Sample) bool {
+			lastSeen := s.Time
+			list[i].LastSeen = &lastSeen
+			return false
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return list, nil
+}
+
+// latest returns the newest reading of each metric within a day of the
+// plant's newest sample
+func (a *API) latest(id string) (*Latest, error) {
+	var latest *Latest
+
+	err := a.store.Reverse(id, func(s ingester.Sample) bool {
+		if latest == nil {
+			latest = &Latest{
+				Plant:   s.Plant,
+				Zone:    s.Zone,
+				Device:  s.Device,
+				Time:    s.Time,
+				Metrics: make(map[string]Reading),
+			}
+		}
+
+		if s.Time.Before(latest.Time.Add(-latestLookback)) {
+			return false
+		}
+
+		for metric, value := range s.Values() {
+			if _, flagged := s.Quality[metric]; flagged {
+				continue
+			}
+
+			if _, ok := latest.Metrics[metric]; !ok {
+				latest.Metrics[metric] = Reading{Value: value, Time: s.Time}
+			}
+		}
+
+		return len(latest.Metrics) < len(ingester.Metrics)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if latest == nil {
+		return nil, errNotFound
+	}
+
+	return latest, nil
+}
+
+func (a *API) fail(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errNotFound) {
+		writeError(w, http.StatusNotFound, "no samples for plant")
+		return
+	}
+
+	logrus.WithError(err).WithField("path", r.URL.Path).Error("failed to read samples")
+	writeError(w, http.StatusInternalServerError, "failed to read samples")
+}
+
+func allowed(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return true
+	}
+
+	w.Header().Set("Allow", "GET, HEAD")
+	writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	return false
+}
+
+func wantsCSV(r *http.Request) bool {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format == "csv"
+	}
+
+	return strings.Contains(r.Header.Get("Accept"), "text/csv")
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		logrus.WithError(err).Debug("failed to write response")
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+func writeCSV(w http.ResponseWriter, filename string, rows [][]string) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	// MACs make awkward filenames
+	w.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote(strings.ReplaceAll(filename, ":", "")))
+
+	err := csv.NewWriter(w).WriteAll(rows)
+	if err != nil {
+		logrus.WithError(err).Debug("failed to write response")
+	}
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
@@ -0,0 +1,263 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ryanrolds/plant-collector/bridge/internal/config"
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
+	"github.com/ryanrolds/plant-collector/bridge/internal/plants"
+	"github.com/ryanrolds/plant-collector/bridge/internal/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func float(v float32) *float32 {
+	return &v
+}
+
+func integer(v int) *int {
+	return &v
+}
+
+func testAPI(t *testing.T, start time.Time) *API {
+	st, err := store.Open(config.Store{Path: filepath.Join(t.TempDir(), "samples.db")})
+	assert.Nil(t, err)
+	t.Cleanup(func() {
+		assert.Nil(t, st.Close())
+	})
+
+	assert.Nil(t, st.Append(
+		ingester.Sample{Time: start, Plant: "monstera", Device: "C4:7C:8D:6A:3D:72", Moisture: float(40), Battery: integer(90)},
+		ingester.Sample{Time: start.Add(time.Minute), Plant: "monstera", Device: "C4:7C:8D:6A:3D:72", Moisture: float(42)},
+		ingester.Sample{Time: start.Add(6 * time.Minute), Plant: "monstera", Device: "C4:7C:8D:6A:3D:72", Moisture: float(50),
+			Quality: map[string]string{ingester.MetricMoisture: "outlier"}},
+		ingester.Sample{Time: start.Add(7 * time.Minute), Plant: "monstera", Device: "C4:7C:8D:6A:3D:72", Moisture: float(44)},
+		ingester.Sample{Time: start, Plant: "0A:0B:0C:0D:0E:0F", Device: "0A:0B:0C:0D:0E:0F", Temperature: float(20)},
+	))
+
+	registry, err := plants.NewRegistry([]config.Plant{
+		{ID: "monstera", Name: "Living room monstera", Zone: "north-window"},
+		{ID: "fern"},
+	})
+	assert.Nil(t, err)
+
+	a := New(st, registry)
+	a.now = func() time.Time {
+		return start.Add(time.Hour)
+	}
+
+	return a
+}
+
+func get(t *testing.T, a *API, target string, v interface{}) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	a.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+
+	if v != nil {
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), v))
+	}
+
+	return w
+}
+
+func TestPlants(t *testing.T) {
+	start := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+	a := testAPI(t, start)
+
+	var list []Plant
+	w := get(t, a, "/api/plants", &list)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, list, 3)
+
+	assert.Equal(t, "fern", list[0].ID)
+	assert.Nil(t, list[0].LastSeen)
+
+	assert.Equal(t, "Living room monstera", list[1].Name)
+	assert.Equal(t, start.Add(7*time.Minute), list[1].LastSeen.UTC())
+
+	assert.Equal(t, "0A:0B:0C:0D:0E:0F", list[2].ID)
+
+	w = get(t, a, "/api/plants?format=csv", nil)
+	assert.Equal(t, "text/csv; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), "id,name,species,room,zone,last_seen\nfern,,,,,\n")
+}
+
+func TestLatest(t *testing.T) {
+	start := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+	a := testAPI(t, start)
+
+	var latest Latest
+	w := get(t, a, "/api/plants/monstera/latest", &latest)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "C4:7C:8D:6A:3D:72", latest.Device)
+	assert.Equal(t, map[string]Reading{
+		ingester.MetricMoisture: {Value: 44, Time: start.Add(7 * time.Minute)},
+		ingester.MetricBattery:  {Value: 90, Time: start},
+	}, utc(latest.Metrics))
+
+	w = get(t, a, "/api/plants/0A:0B:0C:0D:0E:0F/latest", &latest)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 20.0, latest.Metrics[ingester.MetricTemperature].Value)
+
+	w = get(t, a, "/api/plants/fern/latest", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/api/plants/monstera/latest", nil)
+	r.Header.Set("Accept", "text/csv")
+	a.Handler().ServeHTTP(w, r)
+	assert.Equal(t, "metric,value,time\nmoist,44,2022-11-01T12:07:00Z\nbattery,90,2022-11-01T12:00:00Z\n", w.Body.String())
+}
+
+func TestSeries(t *testing.T) {
+	start := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+	a := testAPI(t, start)
+
+	var series Series
+	w := get(t, a, "/api/plants/monstera/series?metric=moisture", &series)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, ingester.MetricMoisture, series.Metric)
+	assert.Equal(t, start.Add(-23*time.Hour), series.From.UTC())
+	// the flagged reading is left out
+	assert.Len(t, series.Points, 3)
+	assert.Equal(t, Point{Time: start, Value: 40, Min: 40, Max: 40, Count: 1}, utcPoint(series.Points[0]))
+
+	query := url.Values{
+		"metric": {"moist"},
+		"from":   {start.Format(time.RFC3339)},
+		"to":     {start.Add(10 * time.Minute).Format(time.RFC3339)},
+		"step":   {"5m"},
+	}
+	w = get(t, a, "/api/plants/monstera/series?"+query.Encode(), &series)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "5m0s", series.Step)
+	assert.Len(t, series.Points, 2)
+	assert.Equal(t, Point{Time: start, Value: 41, Min: 40, Max: 42, Count: 2}, utcPoint(series.Points[0]))
+	assert.Equal(t, Point{Time: start.Add(5 * time.Minute), Value: 44, Min: 44, Max: 44, Count: 1}, utcPoint(series.Points[1]))
+
+	query.Set("format", "csv")
+	w = get(t, a, "/api/plants/monstera/series?"+query.Encode(), nil)
+	assert.Equal(t, `attachment; filename="monstera-moist.csv"`, w.Header().Get("Content-Disposition"))
+	assert.Equal(t, "time,value,min,max,count\n2022-11-01T12:00:00Z,41,40,42,2\n2022-11-01T12:05:00Z,44,44,44,1\n", w.Body.String())
+
+	// a range without samples is empty
+	w = get(t, a, "/api/plants/monstera/series?metric=moist&from=0&to=60", &series)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, series.Points, 0)
+
+	w = get(t, a, "/api/plants/fern/series?metric=moist", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestSeriesCompacted(t *testing.T) {
+	start := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+	a := testAPI(t, start)
+
+	assert.Nil(t, a.store.Append(ingester.Sample{
+		Time:     start.Add(-time.Hour),
+		Plant:    "monstera",
+		Moisture: float(30),
+		Window:   "1h0m0s",
+		Stats:    map[string]ingester.Stats{ingester.MetricMoisture: {Min: 20, Max: 38, Mean: 30, Last: 31, Count: 6}},
+	}))
+
+	var series Series
+	w := get(t, a, "/api/plants/monstera/series?metric=moist&step=2h", &series)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, series.Points, 1)
+	// weighted by the samples each point covers
+	assert.Equal(t, 9, series.Points[0].Count)
+	assert.InDelta(t, (30*6+40+42+44)/9.0, series.Points[0].Value, 0.0001)
+	assert.Equal(t, 20.0, series.Points[0].Min)
+	assert.Equal(t, 44.0, series.Points[0].Max)
+}
+
+func TestSeriesMaxPoints(t *testing.T) {
+	start := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+	a := testAPI(t, start)
+
+	defer func(points int) {
+		maxPoints = points
+	}(maxPoints)
+	maxPoints = 3
+
+	query := url.Values{
+		"metric": {"moist"},
+		"from":   {start.Format(time.RFC3339)},
+		"to":     {start.Add(10 * time.Minute).Format(time.RFC3339)},
+	}
+
+	// the flagged reading is left out, three samples fit
+	var series Series
+	w := get(t, a, "/api/plants/monstera/series?"+query.Encode(), &series)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "", series.Step)
+	assert.Len(t, series.Points, 3)
+
+	// four don't, they're averaged over a third of the range
+	assert.Nil(t, a.store.Append(ingester.Sample{Time: start.Add(8 * time.Minute), Plant: "monstera", Moisture: float(46)}))
+
+	w = get(t, a, "/api/plants/monstera/series?"+query.Encode(), &series)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "3m20s", series.Step)
+	assert.Len(t, series.Points, 2)
+	assert.Equal(t, Point{Time: start, Value: 41, Min: 40, Max: 42, Count: 2}, utcPoint(series.Points[0]))
+	assert.Equal(t, Point{Time: start.Add(400 * time.Second), Value: 45, Min: 44, Max: 46, Count: 2}, utcPoint(series.Points[1]))
+}
+
+func TestSeriesInvalid(t *testing.T) {
+	start := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+	a := testAPI(t, start)
+
+	tests := []struct {
+		name  string
+		query string
+	}{
+		{name: "missing metric", query: ""},
+		{name: "unknown metric", query: "metric=wetness"},
+		{name: "invalid from", query: "metric=moist&from=yesterday"},
+		{name: "from after to", query: "metric=moist&from=120&to=60"},
+		{name: "invalid step", query: "metric=moist&step=often"},
+		{name: "step too small", query: "metric=moist&step=1s&from=0"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var body map[string]string
+			w := get(t, a, "/api/plants/monstera/series?"+test.query, &body)
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+			assert.NotEmpty(t, body["error"])
+		})
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	start := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+	a := testAPI(t, start)
+
+	assert.Equal(t, http.StatusNotFound, get(t, a, "/api/plants/monstera", nil).Code)
+	assert.Equal(t, http.StatusNotFound, get(t, a, "/api/plants/monstera/history", nil).Code)
+
+	w := httptest.NewRecorder()
+	a.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/plants", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func utc(readings map[string]Reading) map[string]Reading {
+	for metric, reading := range readings {
+		reading.Time = reading.Time.UTC()
+		readings[metric] = reading
+	}
+
+	return readings
+}
+
+func utcPoint(p Point) Point {
+	p.Time = p.Time.UTC()
+	return p
+}
@@ -0,0 +1,245 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
+)
+
+const defaultRange = 24 * time.Hour
+
+// maxPoints keeps a series response to a sensible size
+var maxPoints = 11000
+
+// errTooManyPoints stops reading a series without a step that has more than
+// maxPoints samples
+var errTooManyPoints = errors.New("too many points")
+
+// aliases are the spelled out names of metrics
+var aliases = map[string]string{
+	"temperature":  ingester.MetricTemperature,
+	"moisture":     ingester.MetricMoisture,
+	"conductivity": ingester.MetricConductivity,
+	"humidity":     ingester.MetricHumidity,
+}
+
+// Point is a value of a series. Without a step it's a stored sample, with one
+// the mean of the samples in the step starting at Time. Min, Max and Count
+// cover the samples compacted into it.
+type Point struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+	Min   float64   `json:"min"`
+	Max   float64   `json:"max"`
+	Count int       `json:"count"`
+}
+
+// Series holds a plant's values of a metric in a time range
+type Series struct {
+	Plant  string    `json:"plant"`
+	Metric string    `json:"metric"`
+	From   time.Time `json:"from"`
+	To     time.Time `json:"to"`
+	Step   string    `json:"step,omitempty"`
+	Points []Point   `json:"points"`
+}
+
+type seriesQuery struct {
+	metric string
+	from   time.Time
+	to     time.Time
+	step   time.Duration
+}
+
+// parseSeriesQuery reads the metric, from, to and step parameters. Times are
+// RFC 3339 or unix seconds and default to the last day, steps are durations
+// or seconds.
+func parseSeriesQuery(values url.Values, now time.Time) (seriesQuery, error) {
+	q := seriesQuery{
+		metric: values.Get("metric"),
+		to:     now,
+	}
+
+	if alias, ok := aliases[q.metric]; ok {
+		q.metric = alias
+	}
+	if !ingester.IsMetric(q.metric) {
+		return seriesQuery{}, fmt.Errorf("unknown metric %q", values.Get("metric"))
+	}
+
+	var err error
+	if value := values.Get("to"); value != "" {
+		q.to, err = parseTime(value)
+		if err != nil {
+			return seriesQuery{}, fmt.Errorf("invalid to: %w", err)
+		}
+	}
+
+	q.from = q.to.Add(-defaultRange)
+	if value := values.Get("from"); value != "" {
+		q.from, err = parseTime(value)
+		if err != nil {
+			return seriesQuery{}, fmt.Errorf("invalid from: %w", err)
+		}
+	}
+
+	if !q.from.Before(q.to) {
+		return seriesQuery{}, errors.New("from must be before to")
+	}
+
+	if value := values.Get("step"); value != "" {
+		q.step, err = parseStep(value)
+		if err != nil {
+			return seriesQuery{}, fmt.Errorf("invalid step: %w", err)
+		}
+
+		if q.to.Sub(q.from)/q.step > time.Duration(maxPoints) {
+			return seriesQuery{}, fmt.Errorf("step is too small, a series can have up to %d points", maxPoints)
+		}
+	}
+
+	return q, nil
+}
+
+func parseTime(value string) (time.Time, error) {
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err == nil {
+		return time.Unix(0, int64(seconds*float64(time.Second))).UTC(), nil
+	}
+
+	return time.Parse(time.RFC3339Nano, value)
+}
+
+func parseStep(value string) (time.Duration, error) {
+	step, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, numErr := strconv.ParseFloat(value, 64)
+		if numErr != nil {
+			return 0, err
+		}
+
+		step = time.Duration(seconds * float64(time.Second))
+	}
+
+	if step < time.Second {
+		return 0, errors.New("must be at least a second")
+	}
+
+	return step, nil
+}
+
+// series reads the plant's values of the metric, averaged per step when the
+// query has one. Without a step, ranges with more than maxPoints samples are
+// averaged with the smallest whole second step that fits.
+func (a *API) series(id string, q seriesQuery) (*Series, error) {
+	series, err := a.read(id, q)
+	if errors.Is(err, errTooManyPoints) {
+		q.step = defaultStep(q.to.Sub(q.from))
+		return a.read(id, q)
+	}
+
+	return series, err
+}
+
+// defaultStep is the smallest whole second step that splits the range into at
+// most maxPoints steps
+func defaultStep(r time.Duration) time.Duration {
+	step := (r + time.Duration(maxPoints) - 1) / time.Duration(maxPoints)
+	return (step + time.Second - 1) / time.Second * time.Second
+}
+
+func (a *API) read(id string, q seriesQuery) (*Series, error) {
+	series := &Series{
+		Plant:  id,
+		Metric: q.metric,
+		From:   q.from,
+		To:     q.to,
+		Points: []Point{},
+	}
+	if q.step != 0 {
+		series.Step = q.step.String()
+	}
+
+	// sums of the current step, weighted by how many samples each point covers
+	var sum float64
+	var current *Point
+
+	found := false
+	err := a.store.Range(id, q.from, q.to, func(s ingester.Sample) error {
+		found = true
+
+		value, ok := s.Value(q.metric)
+		if !ok {
+			return nil
+		}
+		if _, flagged := s.Quality[q.metric]; flagged {
+			return nil
+		}
+
+		p := Point{Time: s.Time, Value: value, Min: value, Max: value, Count: 1}
+		if stats, ok := s.Stats[q.metric]; ok {
+			p.Min, p.Max, p.Count = stats.Min, stats.Max, stats.Count
+		}
+
+		if q.step == 0 {
+			if len(series.Points) == maxPoints {
+				return errTooManyPoints
+			}
+
+			series.Points = append(series.Points, p)
+			return nil
+		}
+
+		start := q.from.Add(s.Time.Sub(q.from) / q.step * q.step)
+		if current != nil && !current.Time.Equal(start) {
+			current.Value = sum / float64(current.Count)
+			series.Points = append(series.Points, *current)
+			current = nil
+		}
+
+		if current == nil {
+			current = &Point{Time: start, Min: p.Min, Max: p.Max}
+			sum = 0
+		}
+
+		sum += p.Value * float64(p.Count)
+		current.Count += p.Count
+		if p.Min < current.Min {
+			current.Min = p.Min
+		}
+		if p.Max > current.Max {
+			current.Max = p.Max
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if current != nil {
+		current.Value = sum / float64(current.Count)
+		series.Points = append(series.Points, *current)
+	}
+
+	// an empty range of a plant with samples elsewhere is an empty series
+	if !found && !a.hasSamples(id) {
+		return nil, errNotFound
+	}
+
+	return series, nil
+}
+
+func (a *API) hasSamples(id string) bool {
+	found := false
+	err := a.store.Reverse(id, func(s ingester.Sample) bool {
+		found = true
+		return false
+	})
+
+	return err == nil && found
+}
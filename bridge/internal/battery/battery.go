@@ -0,0 +1,122 @@
+package battery
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Point is a single point on a discharge curve
+type Point struct {
+	Voltage float32
+	Percent int
+}
+
+// Profile describes how a battery chemistry discharges. The curve must be
+// ordered from the highest to the lowest voltage.
+type Profile struct {
+	Name  string
+	Curve []Point
+}
+
+// CR2032 lithium coin cell, measured under the light load of a sensor
+var CR2032 = Profile{
+	Name: "cr2032",
+	Curve: []Point{
+		{Voltage: 3.00, Percent: 100},
+		{Voltage: 2.90, Percent: 80},
+		{Voltage: 2.80, Percent: 60},
+		{Voltage: 2.70, Percent: 40},
+		{Voltage: 2.60, Percent: 25},
+		{Voltage: 2.50, Percent: 15},
+		{Voltage: 2.40, Percent: 8},
+		{Voltage: 2.20, Percent: 2},
+		{Voltage: 2.00, Percent: 0},
+	},
+}
+
+// AlkalineAA2 is two alkaline AA cells in series
+var AlkalineAA2 = Profile{
+	Name: "2xaa",
+	Curve: []Point{
+		{Voltage: 3.20, Percent: 100},
+		{Voltage: 3.00, Percent: 90},
+		{Voltage: 2.80, Percent: 70},
+		{Voltage: 2.60, Percent: 45},
+		{Voltage: 2.40, Percent: 25},
+		{Voltage: 2.20, Percent: 10},
+		{Voltage: 2.00, Percent: 3},
+		{Voltage: 1.80, Percent: 0},
+	},
+}
+
+// LiIon is a single lithium-ion/LiPo cell
+var LiIon = Profile{
+	Name: "liion",
+	Curve: []Point{
+		{Voltage: 4.20, Percent: 100},
+		{Voltage: 4.10, Percent: 90},
+		{Voltage: 4.00, Percent: 78},
+		{Voltage: 3.90, Percent: 64},
+		{Voltage: 3.80, Percent: 50},
+		{Voltage: 3.75, Percent: 40},
+		{Voltage: 3.70, Percent: 30},
+		{Voltage: 3.60, Percent: 15},
+		{Voltage: 3.50, Percent: 8},
+		{Voltage: 3.30, Percent: 2},
+		{Voltage: 3.00, Percent: 0},
+	},
+}
+
+var profiles = map[string]Profile{
+	CR2032.Name:      CR2032,
+	AlkalineAA2.Name: AlkalineAA2,
+	LiIon.Name:       LiIon,
+}
+
+// Lookup returns the profile with the given name, names are case-insensitive
+func Lookup(name string) (Profile, error) {
+	profile, ok := profiles[strings.ToLower(name)]
+	if !ok {
+		return Profile{}, fmt.Errorf("unknown battery profile %q (known: %s)", name, strings.Join(Names(), ", "))
+	}
+
+	return profile, nil
+}
+
+// Names returns the names of the known profiles
+func Names() []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Percent maps a voltage to a remaining capacity percentage by linearly
+// interpolating between the points of the discharge curve
+func (p Profile) Percent(voltage float32) int {
+	if len(p.Curve) == 0 {
+		return 0
+	}
+
+	if voltage >= p.Curve[0].Voltage {
+		return p.Curve[0].Percent
+	}
+
+	for i := 1; i < len(p.Curve); i++ {
+		upper := p.Curve[i-1]
+		lower := p.Curve[i]
+		if voltage < lower.Voltage {
+			continue
+		}
+
+		ratio := (voltage - lower.Voltage) / (upper.Voltage - lower.Voltage)
+		percent := float32(lower.Percent) + ratio*float32(upper.Percent-lower.Percent)
+		return int(percent + 0.5)
+	}
+
+	return p.Curve[len(p.Curve)-1].Percent
+}
@@ -0,0 +1,40 @@
+package battery
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProfilePercent(t *testing.T) {
+	tests := []struct {
+		name     string
+		profile  Profile
+		voltage  float32
+		expected int
+	}{
+		{name: "cr2032 fresh", profile: CR2032, voltage: 3.1, expected: 100},
+		{name: "cr2032 on a point", profile: CR2032, voltage: 2.8, expected: 60},
+		{name: "cr2032 interpolated", profile: CR2032, voltage: 2.75, expected: 50},
+		{name: "cr2032 nearly dead", profile: CR2032, voltage: 2.45, expected: 12},
+		{name: "cr2032 dead", profile: CR2032, voltage: 1.9, expected: 0},
+		{name: "2xaa half", profile: AlkalineAA2, voltage: 2.6, expected: 45},
+		{name: "liion nominal", profile: LiIon, voltage: 3.8, expected: 50},
+		{name: "liion empty", profile: LiIon, voltage: 2.9, expected: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, tt.profile.Percent(tt.voltage))
+		})
+	}
+}
+
+func TestLookup(t *testing.T) {
+	profile, err := Lookup("CR2032")
+	assert.Nil(t, err)
+	assert.Equal(t, CR2032.Name, profile.Name)
+
+	_, err = Lookup("nimh")
+	assert.NotNil(t, err)
+}
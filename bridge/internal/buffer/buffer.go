@@ -0,0 +1,347 @@
+package buffer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ryanrolds/plant-collector/bridge/internal/config"
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
+	"github.com/ryanrolds/plant-collector/bridge/internal/queue"
+	"github.com/sirupsen/logrus"
+)
+
+// Overflow policies
+const (
+	OverflowDropOldest = "drop_oldest"
+	OverflowDropNewest = "drop_newest"
+	OverflowSpill      = "spill"
+)
+
+// Reasons samples are dropped
+const (
+	ReasonOldest      = "oldest"
+	ReasonNewest      = "newest"
+	ReasonSpillFailed = "spill_failed"
+	// ReasonSpillBehind is when the disk can't keep up with the overflow
+	ReasonSpillBehind = "spill_behind"
+	ReasonSealed      = "sealed"
+)
+
+const defaultSize = 1000
+
+// Buffer sits between the scanner and the pipeline so the scan callback never
+// waits on a slow consumer. Samples are held in memory, when it's full the
+// overflow policy drops the oldest or newest sample or spills to an on-disk
+// queue. Spilled samples are read back once the memory is empty, new samples
+// keep going to disk until the spill has been read so they stay in order.
+// Offer never touches the disk, overflow is held until Run writes it out.
+type Buffer struct {
+	size     int
+	overflow string
+	spill    *queue.Queue
+
+	droppedDesc *prometheus.Desc
+
+	mu      sync.Mutex
+	samples []ingester.Sample
+	// pending is overflow waiting for Run to write it to the spill
+	pending []ingester.Sample
+	// spilled counts pending and spilled samples that haven't been read back
+	spilled int
+	sealed  bool
+	full    bool
+	dropped map[string]uint64
+	// notify wakes up Run, it holds at most one pending wake up
+	notify chan struct{}
+}
+
+func NewBuffer(cfg config.Buffer) (*Buffer, error) {
+	b := &Buffer{
+		size:     cfg.Size,
+		overflow: cfg.Overflow,
+		dropped:  make(map[string]uint64),
+		notify:   make(chan struct{}, 1),
+		droppedDesc: prometheus.NewDesc("bridge_buffer_dropped_samples_total",
+			"Samples the buffer between the scanner and the pipeline dropped, by reason.", []string{"reason"}, nil),
+	}
+
+	if b.size == 0 {
+		b.size = defaultSize
+	}
+	if b.size < 0 {
+		return nil, fmt.Errorf("buffer size must be positive, got %d", b.size)
+	}
+
+	if b.overflow == "" {
+		b.overflow = OverflowDropOldest
+	}
+
+	switch b.overflow {
+	case OverflowDropOldest, OverflowDropNewest:
+	case OverflowSpill:
+		spill, err := queue.Open(cfg.Spill)
+		if err != nil {
+			return nil, fmt.Errorf("opening spill queue: %w", err)
+		}
+		b.spill = spill
+		b.spilled = spill.Len()
+	default:
+		return nil, fmt.Errorf("unknown overflow policy %q", b.overflow)
+	}
+
+	b.samples = make([]ingester.Sample, 0, b.size)
+
+	return b, nil
+}
+
+// Offer adds a sample without blocking
+func (b *Buffer) Offer(s ingester.Sample) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.sealed {
+		b.drop(ReasonSealed)
+		return
+	}
+
+	if b.spill != nil && (len(b.samples) >= b.size || b.spilled > 0) {
+		b.overflowing()
+		b.wake()
+
+		// the disk is slower than the scan, as much again as the memory waits
+		if len(b.pending) >= b.size {
+			b.drop(ReasonSpillBehind)
+			return
+		}
+
+		b.pending = append(b.pending, s)
+		b.spilled++
+		return
+	}
+
+	if len(b.samples) >= b.size {
+		b.overflowing()
+
+		if b.overflow == OverflowDropNewest {
+			b.drop(ReasonNewest)
+			return
+		}
+
+		copy(b.samples, b.samples[1:])
+		b.samples = b.samples[:len(b.samples)-1]
+		b.drop(ReasonOldest)
+	}
+
+	b.samples = append(b.samples, s)
+	b.wake()
+}
+
+// Seal marks the end of the input, Run returns once everything has been sent
+func (b *Buffer) Seal() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.sealed = true
+	b.wake()
+}
+
+// Run sends buffered samples to out until the buffer is sealed and empty or
+// the context is cancelled. Overflow is written to the spill while waiting.
+func (b *Buffer) Run(ctx context.Context, out chan<- ingester.Sample) error {
+	for {
+		b.flush()
+
+		s, spilled, ok, err := b.next(ctx)
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			b.mu.Lock()
+			done := b.sealed && b.spilled == 0
+			b.mu.Unlock()
+
+			if done {
+				return nil
+			}
+
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-b.notify:
+			}
+			continue
+		}
+
+		for sent := false; !sent; {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-b.notify:
+				b.flush()
+			case out <- s:
+				sent = true
+			}
+		}
+
+		if spilled {
+			err = b.ack()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// flush writes the pending overflow to the spill. Offer keeps adding to a new
+// slice meanwhile, the written samples stay counted as spilled.
+func (b *Buffer) flush() {
+	b.mu.Lock()
+	pending := b.pending
+	b.pending = nil
+	b.mu.Unlock()
+
+	for idx, s := range pending {
+		err := b.spill.Append(s)
+		if err != nil {
+			logrus.WithError(err).WithField("samples", len(pending)-idx).Error("failed to spill samples")
+
+			b.mu.Lock()
+			for range pending[idx:] {
+				b.drop(ReasonSpillFailed)
+			}
+			b.spilled -= len(pending) - idx
+			b.mu.Unlock()
+			return
+		}
+	}
+}
+
+// next takes the oldest sample, memory is older than the spill. Samples read
+// from the spill stay in it until ack.
+func (b *Buffer) next(ctx context.Context) (s ingester.Sample, spilled bool, ok bool, err error) {
+	b.mu.Lock()
+	if len(b.samples) > 0 {
+		s := b.samples[0]
+		b.samples[0] = ingester.Sample{}
+		b.samples = b.samples[1:]
+		b.recovered()
+		b.mu.Unlock()
+		return s, false, true, nil
+	}
+	b.mu.Unlock()
+
+	// only Run reads the spill, anything unacknowledged is unread
+	if b.spill == nil || b.spill.Len() == 0 {
+		return ingester.Sample{}, false, false, nil
+	}
+
+	s, err = b.spill.Next(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ingester.Sample{}, false, false, nil
+		}
+		return ingester.Sample{}, false, false, fmt.Errorf("reading spill: %w", err)
+	}
+
+	return s, true, true, nil
+}
+
+// ack removes the sample read from the spill once it has been sent, one that
+// wasn't is read again after a restart
+func (b *Buffer) ack() error {
+	err := b.spill.Ack()
+	if err != nil {
+		return fmt.Errorf("acknowledging spill: %w", err)
+	}
+
+	b.mu.Lock()
+	b.spilled--
+	b.recovered()
+	b.mu.Unlock()
+
+	return nil
+}
+
+// Len returns the number of buffered samples, including spilled ones
+func (b *Buffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.samples) + b.spilled
+}
+
+// Dropped returns the number of dropped samples keyed by reason
+func (b *Buffer) Dropped() map[string]uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	dropped := make(map[string]uint64, len(b.dropped))
+	for reason, count := range b.dropped {
+		dropped[reason] = count
+	}
+
+	return dropped
+}
+
+// Describe implements prometheus.Collector
+func (b *Buffer) Describe(ch chan<- *prometheus.Desc) {
+	ch <- b.droppedDesc
+}
+
+// Collect implements prometheus.Collector
+func (b *Buffer) Collect(ch chan<- prometheus.Metric) {
+	for reason, count := range b.Dropped() {
+		ch <- prometheus.MustNewConstMetric(b.droppedDesc, prometheus.CounterValue, float64(count), reason)
+	}
+}
+
+// Close writes out the pending overflow and releases the spill queue, spilled
+// samples that haven't been read are replayed on the next start
+func (b *Buffer) Close() error {
+	if b.spill == nil {
+		return nil
+	}
+
+	b.flush()
+	return b.spill.Close()
+}
+
+// wake signals Run without blocking, must be called with the lock held
+func (b *Buffer) wake() {
+	select {
+	case b.notify <- struct{}{}:
+	default:
+	}
+}
+
+// drop counts a dropped sample, must be called with the lock held
+func (b *Buffer) drop(reason string) {
+	b.dropped[reason]++
+}
+
+// overflowing logs when the buffer fills up, must be called with the lock held
+func (b *Buffer) overflowing() {
+	if b.full {
+		return
+	}
+
+	b.full = true
+	logrus.WithFields(logrus.Fields{
+		"size":     b.size,
+		"overflow": b.overflow,
+	}).Warn("sample buffer full")
+}
+
+// recovered logs when a full buffer has room again, must be called with the
+// lock held
+func (b *Buffer) recovered() {
+	if !b.full || len(b.samples) >= b.size || b.spilled > 0 {
+		return
+	}
+
+	b.full = false
+	logrus.WithField("dropped", b.dropped).Info("sample buffer recovered")
+}
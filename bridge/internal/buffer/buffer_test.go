@@ -0,0 +1,221 @@
+package buffer
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/ryanrolds/plant-collector/bridge/internal/config"
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
+	"github.com/stretchr/testify/assert"
+)
+
+func offerPlants(b *Buffer, plants ...string) {
+	for _, plant := range plants {
+		b.Offer(ingester.Sample{Plant: plant})
+	}
+}
+
+// drain seals the buffer and returns the plants of every sample it sends
+func drain(t *testing.T, b *Buffer) []string {
+	b.Seal()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	out := make(chan ingester.Sample, 100)
+	assert.Nil(t, b.Run(ctx, out))
+	close(out)
+
+	var plants []string
+	for s := range out {
+		plants = append(plants, s.Plant)
+	}
+
+	return plants
+}
+
+func TestNewBufferRejectsUnknownPolicy(t *testing.T) {
+	_, err := NewBuffer(config.Buffer{Overflow: "block"})
+	assert.NotNil(t, err)
+
+	_, err = NewBuffer(config.Buffer{Size: -1})
+	assert.NotNil(t, err)
+}
+
+func TestBufferOverflow(t *testing.T) {
+	tests := []struct {
+		name     string
+		overflow string
+		expected []string
+		dropped  map[string]uint64
+	}{
+		{
+			name:     "drop oldest",
+			overflow: OverflowDropOldest,
+			expected: []string{"c", "d"},
+			dropped:  map[string]uint64{ReasonOldest: 2},
+		},
+		{
+			name:     "drop newest",
+			overflow: OverflowDropNewest,
+			expected: []string{"a", "b"},
+			dropped:  map[string]uint64{ReasonNewest: 2},
+		},
+		{
+			name:     "spill",
+			overflow: OverflowSpill,
+			expected: []string{"a", "b", "c", "d"},
+			dropped:  map[string]uint64{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b, err := NewBuffer(config.Buffer{
+				Size:     2,
+				Overflow: test.overflow,
+				Spill:    config.Queue{Dir: t.TempDir()},
+			})
+			assert.Nil(t, err)
+			defer b.Close()
+
+			offerPlants(b, "a", "b", "c", "d")
+
+			assert.Equal(t, test.expected, drain(t, b))
+			assert.Equal(t, test.dropped, b.Dropped())
+		})
+	}
+}
+
+func TestBufferSpillKeepsOrder(t *testing.T) {
+	b, err := NewBuffer(config.Buffer{
+		Size:     1,
+		Overflow: OverflowSpill,
+		Spill:    config.Queue{Dir: t.TempDir()},
+	})
+	assert.Nil(t, err)
+	defer b.Close()
+
+	offerPlants(b, "a", "b")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	out := make(chan ingester.Sample)
+	go func() {
+		_ = b.Run(ctx, out)
+	}()
+
+	assert.Equal(t, "a", (<-out).Plant)
+
+	// memory has room again but the spill hasn't been read yet
+	offerPlants(b, "c")
+	assert.Equal(t, "b", (<-out).Plant)
+	assert.Equal(t, "c", (<-out).Plant)
+}
+
+func TestBufferSpillReplaysAfterRestart(t *testing.T) {
+	cfg := config.Buffer{
+		Size:     2,
+		Overflow: OverflowSpill,
+		Spill:    config.Queue{Dir: t.TempDir()},
+	}
+
+	// the overflow is only written out by Run or Close
+	b, err := NewBuffer(cfg)
+	assert.Nil(t, err)
+	offerPlants(b, "a", "b", "c", "d")
+	assert.Nil(t, b.Close())
+
+	b, err = NewBuffer(cfg)
+	assert.Nil(t, err)
+	defer b.Close()
+
+	assert.Equal(t, 2, b.Len())
+	assert.Equal(t, []string{"c", "d"}, drain(t, b))
+}
+
+func TestBufferSpillKeepsUnsentAfterCancel(t *testing.T) {
+	cfg := config.Buffer{
+		Size:     2,
+		Overflow: OverflowSpill,
+		Spill:    config.Queue{Dir: t.TempDir()},
+	}
+
+	b, err := NewBuffer(cfg)
+	assert.Nil(t, err)
+	offerPlants(b, "a", "b", "c", "d")
+	assert.Nil(t, b.Close())
+
+	b, err = NewBuffer(cfg)
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	out := make(chan ingester.Sample)
+	done := make(chan error)
+	go func() {
+		done <- b.Run(ctx, out)
+	}()
+
+	assert.Equal(t, "c", (<-out).Plant)
+
+	// shut down while d is read from the spill but not sent
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	assert.Nil(t, <-done)
+	assert.Nil(t, b.Close())
+
+	b, err = NewBuffer(cfg)
+	assert.Nil(t, err)
+	defer b.Close()
+
+	assert.Equal(t, []string{"d"}, drain(t, b))
+}
+
+func TestBufferSpillBehind(t *testing.T) {
+	b, err := NewBuffer(config.Buffer{
+		Size:     1,
+		Overflow: OverflowSpill,
+		Spill:    config.Queue{Dir: t.TempDir()},
+	})
+	assert.Nil(t, err)
+	defer b.Close()
+
+	// without Run writing the overflow out only as much again as the memory
+	// is held
+	offerPlants(b, "a", "b", "c")
+
+	assert.Equal(t, []string{"a", "b"}, drain(t, b))
+	assert.Equal(t, map[string]uint64{ReasonSpillBehind: 1}, b.Dropped())
+}
+
+func TestBufferCollect(t *testing.T) {
+	b, err := NewBuffer(config.Buffer{Size: 1, Overflow: OverflowDropNewest})
+	assert.Nil(t, err)
+
+	offerPlants(b, "a", "b", "c")
+
+	expected := `
+# HELP bridge_buffer_dropped_samples_total Samples the buffer between the scanner and the pipeline dropped, by reason.
+# TYPE bridge_buffer_dropped_samples_total counter
+bridge_buffer_dropped_samples_total{reason="newest"} 2
+`
+	assert.Nil(t, testutil.CollectAndCompare(b, strings.NewReader(expected)))
+}
+
+func TestBufferDropsAfterSeal(t *testing.T) {
+	b, err := NewBuffer(config.Buffer{})
+	assert.Nil(t, err)
+
+	offerPlants(b, "a")
+	b.Seal()
+	offerPlants(b, "b")
+
+	assert.Equal(t, []string{"a"}, drain(t, b))
+	assert.Equal(t, map[string]uint64{ReasonSealed: 1}, b.Dropped())
+}
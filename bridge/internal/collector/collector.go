@@ -0,0 +1,124 @@
+package collector
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/ryanrolds/plant-collector/bridge/internal/config"
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
+)
+
+// Identity sources, in the order they are tried
+const (
+	SourceConfig   = "config"
+	SourceUUID     = "uuid"
+	SourceName     = "name"
+	SourceHostname = "hostname"
+	SourceMAC      = "mac"
+)
+
+var sources = []string{SourceUUID, SourceName, SourceHostname, SourceMAC}
+
+// replaced in tests
+var (
+	lookupEnv = os.Getenv
+	hostname  = os.Hostname
+	hardware  = interfaceMAC
+)
+
+// Identity identifies the bridge that heard a sample
+type Identity struct {
+	ID       string
+	Site     string
+	Location string
+	// Source is where the ID came from
+	Source string
+}
+
+// Resolve works out the collector ID. An ID in the config wins, then the
+// configured source is used. Without either the balena device UUID, the balena
+// device name, the hostname and the MAC of the first network interface are tried.
+func Resolve(cfg config.Collector) (Identity, error) {
+	identity := Identity{
+		Site:     cfg.Site,
+		Location: cfg.Location,
+	}
+
+	if cfg.ID != "" {
+		identity.ID = cfg.ID
+		identity.Source = SourceConfig
+		return identity, nil
+	}
+
+	candidates := sources
+	if cfg.Source != "" {
+		candidates = []string{cfg.Source}
+	}
+
+	for _, source := range candidates {
+		id, err := lookup(source)
+		if err != nil {
+			return Identity{}, err
+		}
+
+		if id != "" {
+			identity.ID = id
+			identity.Source = source
+			return identity, nil
+		}
+	}
+
+	return Identity{}, fmt.Errorf("unable to determine collector id from %v", candidates)
+}
+
+func lookup(source string) (string, error) {
+	switch source {
+	case SourceUUID:
+		return lookupEnv("BALENA_DEVICE_UUID"), nil
+	case SourceName:
+		return lookupEnv("BALENA_DEVICE_NAME_AT_INIT"), nil
+	case SourceHostname:
+		// fall through to the next source when the hostname is unavailable
+		name, err := hostname()
+		if err != nil {
+			return "", nil
+		}
+		return name, nil
+	case SourceMAC:
+		return hardware(), nil
+	default:
+		return "", fmt.Errorf("unknown collector id source %q", source)
+	}
+}
+
+// Process stamps the collector identity on a sample
+func (i Identity) Process(s ingester.Sample) []ingester.Sample {
+	s.Collector = i.ID
+	s.Site = i.Site
+	s.Location = i.Location
+
+	return []ingester.Sample{s}
+}
+
+// interfaceMAC returns the MAC of the first up, non-loopback interface
+func interfaceMAC() string {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagLoopback != 0 || iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+
+		if len(iface.HardwareAddr) == 0 {
+			continue
+		}
+
+		return iface.HardwareAddr.String()
+	}
+
+	return ""
+}
@@ -0,0 +1,84 @@
+package collector
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ryanrolds/plant-collector/bridge/internal/config"
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
+	"github.com/stretchr/testify/assert"
+)
+
+func fakeHost(t *testing.T, env map[string]string, host string, mac string) {
+	lookupEnv = func(key string) string { return env[key] }
+	hostname = func() (string, error) {
+		if host == "" {
+			return "", errors.New("no hostname")
+		}
+		return host, nil
+	}
+	hardware = func() string { return mac }
+
+	t.Cleanup(func() {
+		lookupEnv, hostname, hardware = osLookupEnv, osHostname, interfaceMAC
+	})
+}
+
+var (
+	osLookupEnv = lookupEnv
+	osHostname  = hostname
+)
+
+func TestResolve(t *testing.T) {
+	balena := map[string]string{
+		"BALENA_DEVICE_UUID":         "f0e1d2c3b4a5",
+		"BALENA_DEVICE_NAME_AT_INIT": "greenhouse-1",
+	}
+
+	tests := []struct {
+		name     string
+		cfg      config.Collector
+		env      map[string]string
+		host     string
+		mac      string
+		expected string
+		source   string
+	}{
+		{name: "config", cfg: config.Collector{ID: "bridge-a"}, env: balena, expected: "bridge-a", source: SourceConfig},
+		{name: "balena uuid", env: balena, host: "host", expected: "f0e1d2c3b4a5", source: SourceUUID},
+		{name: "balena name", env: map[string]string{"BALENA_DEVICE_NAME_AT_INIT": "greenhouse-1"}, expected: "greenhouse-1", source: SourceName},
+		{name: "hostname", host: "pi", mac: "b8:27:eb:00:00:01", expected: "pi", source: SourceHostname},
+		{name: "mac", mac: "b8:27:eb:00:00:01", expected: "b8:27:eb:00:00:01", source: SourceMAC},
+		{name: "forced source", cfg: config.Collector{Source: SourceMAC}, env: balena, host: "pi", mac: "b8:27:eb:00:00:01", expected: "b8:27:eb:00:00:01", source: SourceMAC},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeHost(t, tt.env, tt.host, tt.mac)
+
+			identity, err := Resolve(tt.cfg)
+			assert.Nil(t, err)
+			assert.Equal(t, tt.expected, identity.ID)
+			assert.Equal(t, tt.source, identity.Source)
+		})
+	}
+}
+
+func TestResolveFailures(t *testing.T) {
+	fakeHost(t, nil, "", "")
+
+	_, err := Resolve(config.Collector{})
+	assert.NotNil(t, err)
+
+	_, err = Resolve(config.Collector{Source: "serial"})
+	assert.NotNil(t, err)
+}
+
+func TestProcess(t *testing.T) {
+	identity := Identity{ID: "bridge-a", Site: "farm", Location: "greenhouse"}
+
+	out := identity.Process(ingester.Sample{Device: "01:02:03:04:05:06"})
+	assert.Equal(t, "bridge-a", out[0].Collector)
+	assert.Equal(t, "farm", out[0].Site)
+	assert.Equal(t, "greenhouse", out[0].Location)
+}
@@ -0,0 +1,470 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ryanrolds/plant-collector/bridge/internal/battery"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the optional bridge configuration file. Everything in it has a
+// sensible default so the bridge runs without one.
+type Config struct {
+	// ShutdownGracePeriod is how long the bridge keeps sending after SIGTERM
+	ShutdownGracePeriod time.Duration `yaml:"shutdown_grace_period"`
+
+	Buffer Buffer `yaml:"buffer"`
+	// Ingester and Queue configure the default sink, used when no sinks are set
+	Ingester   Ingester          `yaml:"ingester"`
+	Queue      Queue             `yaml:"queue"`
+	Sinks      []Sink            `yaml:"sinks"`
+	Collector  Collector         `yaml:"collector"`
+	Devices    map[string]Device `yaml:"devices"`
+	Plants     []Plant           `yaml:"plants"`
+	Derive     Derive            `yaml:"derive"`
+	Validation Validation        `yaml:"validation"`
+	Report     Report            `yaml:"report"`
+	Downsample Downsample        `yaml:"downsample"`
+	Server     Server            `yaml:"server"`
+	Prometheus Prometheus        `yaml:"prometheus"`
+	Store      Store             `yaml:"store"`
+	Dashboard  Dashboard         `yaml:"dashboard"`
+	Stream     Stream            `yaml:"stream"`
+	Health     Health            `yaml:"health"`
+	Telemetry  Telemetry         `yaml:"telemetry"`
+}
+
+// Collector identifies this bridge, see the collector package
+type Collector struct {
+	// ID overrides the detected collector ID
+	ID string `yaml:"id"`
+	// Source forces the ID to come from uuid, name, hostname or mac
+	Source   string `yaml:"source"`
+	Site     string `yaml:"site"`
+	Location string `yaml:"location"`
+}
+
+// Device holds per-sensor settings keyed by MAC address
+type Device struct {
+	// Battery is the name of the battery profile used to turn reported
+	// voltages into percentages, see the battery package
+	Battery string `yaml:"battery"`
+}
+
+// Plant is an entry in the plant registry, see the plants package
+type Plant struct {
+	ID      string        `yaml:"id"`
+	Name    string        `yaml:"name"`
+	Species string        `yaml:"species"`
+	Room    string        `yaml:"room"`
+	Zone    string        `yaml:"zone"`
+	Sensors []PlantSensor `yaml:"sensors"`
+}
+
+// PlantSensor assigns a sensor to a plant from a point in time onwards
+type PlantSensor struct {
+	Device string    `yaml:"device"`
+	From   time.Time `yaml:"from"`
+}
+
+// Derive configures the derived metrics, see the derive package
+type Derive struct {
+	// LightSource picks the lux to PPFD factor: sunlight, led, fluorescent,
+	// metal_halide or hps
+	LightSource string `yaml:"light_source"`
+	// PPFDFactor overrides the light source's factor
+	PPFDFactor float64 `yaml:"ppfd_factor"`
+	// Timezone the DLI day starts and ends in, defaults to the local timezone
+	Timezone string `yaml:"timezone"`
+	// PairWindow is how recent another sensor's temperature or humidity in the
+	// same zone must be to be used for VPD and dew point
+	PairWindow time.Duration `yaml:"pair_window"`
+	// Zones overrides the light source per zone
+	Zones map[string]DeriveZone `yaml:"zones"`
+}
+
+type DeriveZone struct {
+	LightSource string  `yaml:"light_source"`
+	PPFDFactor  float64 `yaml:"ppfd_factor"`
+}
+
+// Validation configures the reading checks, see the quality package
+type Validation struct {
+	// ForwardRejected keeps rejected readings on samples with a quality flag
+	// instead of dropping them
+	ForwardRejected bool                        `yaml:"forward_rejected"`
+	Hampel          Hampel                      `yaml:"hampel"`
+	Metrics         map[string]ValidationMetric `yaml:"metrics"`
+}
+
+type Hampel struct {
+	Window    int     `yaml:"window"`
+	Threshold float64 `yaml:"threshold"`
+}
+
+// ValidationMetric overrides the default checks of a metric
+type ValidationMetric struct {
+	Min *float64 `yaml:"min"`
+	Max *float64 `yaml:"max"`
+	// MaxRate is the largest plausible change per minute, 0 disables the check
+	MaxRate      *float64 `yaml:"max_rate"`
+	Hampel       *bool    `yaml:"hampel"`
+	MinDeviation *float64 `yaml:"min_deviation"`
+}
+
+// Report configures report-on-change, see the deadband package
+type Report struct {
+	// SensorTypes is keyed by the sample's device type, e.g. b-parasite
+	SensorTypes map[string]ReportSensorType `yaml:"sensor_types"`
+}
+
+type ReportSensorType struct {
+	// Deadband is how far each metric must move before it is sent again
+	Deadband map[string]float64 `yaml:"deadband"`
+	// Heartbeat is the longest a metric goes unsent
+	Heartbeat time.Duration `yaml:"heartbeat"`
+}
+
+// Downsample configures windowed aggregation, see the downsample package
+type Downsample struct {
+	// Window is the aggregation window, e.g. 1m, 5m or 15m. Raw samples are
+	// sent when it isn't set.
+	Window time.Duration `yaml:"window"`
+}
+
+// Server configures the bridge's HTTP server, see the server package
+type Server struct {
+	// Listen is the address the server listens on, e.g. :8080
+	Listen string `yaml:"listen"`
+}
+
+// Prometheus configures the /metrics endpoint, see the metrics package
+type Prometheus struct {
+	Enabled bool `yaml:"enabled"`
+	// StaleAfter is how long a sensor's series are kept after its last sample
+	StaleAfter time.Duration `yaml:"stale_after"`
+}
+
+// Dashboard configures the web UI, see the dashboard package
+type Dashboard struct {
+	Enabled bool `yaml:"enabled"`
+}
+
+// Health configures the health endpoints, see the health package
+type Health struct {
+	Enabled bool `yaml:"enabled"`
+	// ScanTimeout is how long the scan can go without an advertisement
+	ScanTimeout time.Duration `yaml:"scan_timeout"`
+	// SinkTimeout is how long a sink can hold queued samples without
+	// delivering any
+	SinkTimeout time.Duration `yaml:"sink_timeout"`
+	// MaxQueued is the most samples a ready sink has queued
+	MaxQueued int `yaml:"max_queued"`
+}
+
+// Telemetry configures the bridge's own metrics and heartbeats, see the
+// telemetry package
+type Telemetry struct {
+	Enabled bool `yaml:"enabled"`
+	// HeartbeatInterval is how often a heartbeat is sent
+	HeartbeatInterval time.Duration `yaml:"heartbeat_interval"`
+	// HeartbeatURL is where heartbeats are posted, defaults to heartbeat next
+	// to the ingester's URL
+	HeartbeatURL string `yaml:"heartbeat_url"`
+}
+
+// Stream configures the live sample stream, see the stream package
+type Stream struct {
+	Enabled bool `yaml:"enabled"`
+}
+
+// Store configures the local sample store, see the store package. It keeps
+// every sample, from before report-on-change and downsampling.
+type Store struct {
+	Enabled bool `yaml:"enabled"`
+	// Path is the database file
+	Path string `yaml:"path"`
+	// Retention is how long samples are kept
+	Retention time.Duration `yaml:"retention"`
+	// CompactAfter is the age at which samples are replaced with one sample
+	// per plant and CompactWindow
+	CompactAfter  time.Duration `yaml:"compact_after"`
+	CompactWindow time.Duration `yaml:"compact_window"`
+	// Queue holds samples until they're written to the store
+	Queue Queue `yaml:"queue"`
+}
+
+// Buffer configures the buffer between the scanner and the pipeline, see the
+// buffer package
+type Buffer struct {
+	// Size is how many samples are held in memory
+	Size int `yaml:"size"`
+	// Overflow is what happens when the buffer is full: drop_oldest, drop_newest
+	// or spill to disk
+	Overflow string `yaml:"overflow"`
+	// Spill is the on-disk queue samples overflow into
+	Spill Queue `yaml:"spill"`
+}
+
+// Ingester configures delivery to the ingester
+type Ingester struct {
+	// URL defaults to INGESTER_URL
+	URL   string `yaml:"url"`
+	Retry Retry  `yaml:"retry"`
+	Batch Batch  `yaml:"batch"`
+	// Gzip compresses request bodies
+	Gzip bool `yaml:"gzip"`
+	// DeadLetterPath is where permanently rejected samples are kept
+	DeadLetterPath string `yaml:"dead_letter_path"`
+}
+
+// Batch groups samples into one request, it's off unless max_samples is set
+type Batch struct {
+	MaxSamples int           `yaml:"max_samples"`
+	MaxBytes   int           `yaml:"max_bytes"`
+	MaxLatency time.Duration `yaml:"max_latency"`
+	// Format is json for an array of samples or ndjson
+	Format string `yaml:"format"`
+}
+
+// Retry configures the backoff between attempts, transient failures are
+// retried until they succeed or the bridge shuts down
+type Retry struct {
+	InitialBackoff time.Duration `yaml:"initial_backoff"`
+	MaxBackoff     time.Duration `yaml:"max_backoff"`
+}
+
+// Queue configures the on-disk queue in front of the ingester, see the queue package
+type Queue struct {
+	Dir string `yaml:"dir"`
+	// SegmentSize is the size in bytes at which a new segment file is started
+	SegmentSize int64 `yaml:"segment_size"`
+	// MaxSize and MaxAge cap the queue, the oldest segments are dropped first
+	MaxSize int64         `yaml:"max_size"`
+	MaxAge  time.Duration `yaml:"max_age"`
+	// Fsync is always, interval or never
+	Fsync         string        `yaml:"fsync"`
+	FsyncInterval time.Duration `yaml:"fsync_interval"`
+}
+
+// Sink is a destination processed samples are fanned out to, see the sink package
+type Sink struct {
+	// Name identifies the sink in logs and names its default queue directory
+	Name string `yaml:"name"`
+	// Type is http, mqtt, influx, remote_write or otlp
+	Type string `yaml:"type"`
+	// HTTP configures http sinks
+	HTTP Ingester `yaml:"http"`
+	// MQTT configures mqtt sinks
+	MQTT MQTT `yaml:"mqtt"`
+	// Influx configures influx sinks
+	Influx Influx `yaml:"influx"`
+	// RemoteWrite configures remote_write sinks
+	RemoteWrite RemoteWrite `yaml:"remote_write"`
+	// OTLP configures otlp sinks
+	OTLP OTLP `yaml:"otlp"`
+	// Queue is the sink's own on-disk queue
+	Queue Queue `yaml:"queue"`
+	Route Route `yaml:"route"`
+}
+
+// Route picks the samples sent to a sink, empty lists match everything
+type Route struct {
+	Plants []string `yaml:"plants"`
+	Zones  []string `yaml:"zones"`
+	// Metrics are kept and the rest removed, samples left without any of them
+	// aren't sent
+	Metrics []string `yaml:"metrics"`
+}
+
+// MQTT configures publishing to an MQTT broker, see the mqtt package
+type MQTT struct {
+	// Broker is the broker's URL, mqtt://host:1883 or mqtts://host:8883 for TLS
+	Broker string `yaml:"broker"`
+	// Version is the protocol version, 3.1.1 or 5
+	Version  string `yaml:"version"`
+	ClientID string `yaml:"client_id"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// Topic is the template samples are published on, e.g. plants/{zone}/{plant}/state
+	Topic string `yaml:"topic"`
+	QoS   *int   `yaml:"qos"`
+	// Retain keeps the last sample of each topic on the broker for new subscribers
+	Retain *bool `yaml:"retain"`
+	// StatusTopic is online while the bridge is connected, the broker sets it
+	// to offline with the last will when the bridge goes away
+	StatusTopic string        `yaml:"status_topic"`
+	KeepAlive   time.Duration `yaml:"keep_alive"`
+	TLS         TLS           `yaml:"tls"`
+	Discovery   Discovery     `yaml:"discovery"`
+}
+
+// Discovery announces sensors to Home Assistant with MQTT discovery
+type Discovery struct {
+	Enabled bool `yaml:"enabled"`
+	// Prefix is Home Assistant's discovery prefix
+	Prefix string `yaml:"prefix"`
+}
+
+// Influx configures writing line protocol to InfluxDB, see the influx package
+type Influx struct {
+	// URL is the server's base URL, e.g. http://influxdb:8086
+	URL string `yaml:"url"`
+	// Version picks the write API, 1 for /write or 2 for /api/v2/write
+	Version string `yaml:"version"`
+	// Database and RetentionPolicy are where 1.x writes go
+	Database        string `yaml:"database"`
+	RetentionPolicy string `yaml:"retention_policy"`
+	// Org and Bucket are where 2.x writes go
+	Org    string `yaml:"org"`
+	Bucket string `yaml:"bucket"`
+	// Token is sent as a token, otherwise Username and Password are sent with
+	// basic auth
+	Token    string `yaml:"token"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// Measurement defaults to plant
+	Measurement string `yaml:"measurement"`
+	// Precision of the timestamps: ns, us, ms or s
+	Precision string `yaml:"precision"`
+	Batch     Batch  `yaml:"batch"`
+	Retry     Retry  `yaml:"retry"`
+	Gzip      bool   `yaml:"gzip"`
+	// DeadLetterPath is where rejected samples are kept
+	DeadLetterPath string `yaml:"dead_letter_path"`
+}
+
+// RemoteWrite configures pushing to a Prometheus remote write receiver, see
+// the remotewrite package
+type RemoteWrite struct {
+	// URL is the receiver's endpoint, e.g. http://mimir:9009/api/v1/push
+	URL string `yaml:"url"`
+	// BearerToken is sent as a bearer token, otherwise Username and Password
+	// are sent with basic auth
+	BearerToken string `yaml:"bearer_token"`
+	Username    string `yaml:"username"`
+	Password    string `yaml:"password"`
+	Batch       Batch  `yaml:"batch"`
+	Retry       Retry  `yaml:"retry"`
+	// DeadLetterPath is where rejected samples are kept
+	DeadLetterPath string `yaml:"dead_letter_path"`
+}
+
+// OTLP configures exporting to an OpenTelemetry collector, see the otlp package
+type OTLP struct {
+	// Protocol is grpc or http/protobuf
+	Protocol string `yaml:"protocol"`
+	// Endpoint is host:port for grpc and the URL of the metrics endpoint, e.g.
+	// http://collector:4318/v1/metrics, for http/protobuf
+	Endpoint string `yaml:"endpoint"`
+	// Insecure turns off TLS for grpc
+	Insecure bool              `yaml:"insecure"`
+	TLS      TLS               `yaml:"tls"`
+	Headers  map[string]string `yaml:"headers"`
+	// Resource holds the resource attributes, service.name defaults to
+	// plant-bridge and service.instance.id to the collector id
+	Resource map[string]string `yaml:"resource"`
+	Gzip     bool              `yaml:"gzip"`
+	Batch    Batch             `yaml:"batch"`
+	Retry    Retry             `yaml:"retry"`
+	// MetricsInterval is how often the bridge's own metrics are exported
+	MetricsInterval time.Duration `yaml:"metrics_interval"`
+	// DeadLetterPath is where rejected samples are kept
+	DeadLetterPath string `yaml:"dead_letter_path"`
+}
+
+// TLS configures client connections, the files are PEM encoded
+type TLS struct {
+	// CA verifies the server instead of the system roots
+	CA string `yaml:"ca"`
+	// Cert and Key are the client certificate
+	Cert               string `yaml:"cert"`
+	Key                string `yaml:"key"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+// Load reads the config file at path, a missing file results in an empty config
+func Load(path string) (*Config, error) {
+	cfg := &Config{}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		cfg.normalize()
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = yaml.Unmarshal(data, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("parsing config %s: %w", path, err)
+	}
+
+	cfg.normalize()
+
+	err = cfg.validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+
+	return cfg, nil
+}
+
+// Device returns the settings for the device with the given MAC address
+func (c *Config) Device(mac string) (Device, bool) {
+	device, ok := c.Devices[NormalizeMAC(mac)]
+	return device, ok
+}
+
+func (c *Config) normalize() {
+	devices := make(map[string]Device, len(c.Devices))
+	for mac, device := range c.Devices {
+		devices[NormalizeMAC(mac)] = device
+	}
+	c.Devices = devices
+
+	for i := range c.Plants {
+		for j := range c.Plants[i].Sensors {
+			c.Plants[i].Sensors[j].Device = NormalizeMAC(c.Plants[i].Sensors[j].Device)
+		}
+	}
+}
+
+func (c *Config) validate() error {
+	sinks := make(map[string]bool, len(c.Sinks))
+	for _, sink := range c.Sinks {
+		if sink.Name == "" {
+			return errors.New("sink without a name")
+		}
+
+		if sinks[sink.Name] {
+			return fmt.Errorf("duplicate sink %s", sink.Name)
+		}
+		sinks[sink.Name] = true
+	}
+
+	for mac, device := range c.Devices {
+		if device.Battery == "" {
+			continue
+		}
+
+		_, err := battery.Lookup(device.Battery)
+		if err != nil {
+			return fmt.Errorf("device %s: %w", mac, err)
+		}
+	}
+
+	return nil
+}
+
+// NormalizeMAC returns the MAC in the upper-case, colon separated form the
+// bluetooth package uses
+func NormalizeMAC(mac string) string {
+	return strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(mac), "-", ":"))
+}
@@ -0,0 +1,39 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoad(t *testing.T) {
+	cfg, err := Load("testdata/config.yaml")
+	assert.Nil(t, err)
+
+	device, ok := cfg.Device("C4:7C:8D:6A:3D:72")
+	assert.True(t, ok)
+	assert.Equal(t, "2xaa", device.Battery)
+
+	assert.Len(t, cfg.Plants, 1)
+	assert.Equal(t, "monstera", cfg.Plants[0].ID)
+	assert.Equal(t, "C4:7C:8D:6A:3D:72", cfg.Plants[0].Sensors[0].Device)
+	assert.Equal(t, time.Date(2022, 11, 1, 0, 0, 0, 0, time.UTC), cfg.Plants[0].Sensors[0].From)
+}
+
+func TestLoadMissing(t *testing.T) {
+	cfg, err := Load("testdata/missing.yaml")
+	assert.Nil(t, err)
+	assert.Empty(t, cfg.Devices)
+}
+
+func TestLoadDuplicateSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(path, []byte("sinks:\n  - name: ingester\n  - name: ingester\n"), 0o644)
+	assert.Nil(t, err)
+
+	_, err = Load(path)
+	assert.NotNil(t, err)
+}
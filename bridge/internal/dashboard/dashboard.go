@@ -0,0 +1,53 @@
+package dashboard
+
+import (
+	"embed"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+)
+
+//go:embed static
+var static embed.FS
+
+// Handler serves the dashboard under /dashboard/ and the tracked sensors and
+// nearby devices as JSON under /dashboard/api/. The root redirects to the
+// dashboard.
+func (t *Tracker) Handler() http.Handler {
+	assets, err := fs.Sub(static, "static")
+	if err != nil {
+		// the embedded directory is always there
+		panic(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/dashboard/", http.StripPrefix("/dashboard/", http.FileServer(http.FS(assets))))
+	mux.HandleFunc("/dashboard/api/sensors", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, t.Sensors())
+	})
+	mux.HandleFunc("/dashboard/api/nearby", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, t.Nearby())
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+
+		http.Redirect(w, r, "/dashboard/", http.StatusFound)
+	})
+
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		logrus.WithError(err).Debug("failed to write response")
+	}
+}
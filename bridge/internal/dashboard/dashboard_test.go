@@ -0,0 +1,54 @@
+package dashboard
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandler(t *testing.T) {
+	start := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+	tracker := testTracker(t, start)
+	tracker.Process(ingester.Sample{Time: start, Plant: "monstera", Device: "C4:7C:8D:6A:3D:72", Moisture: float(40)})
+
+	handler := tracker.Handler()
+
+	tests := []struct {
+		path        string
+		status      int
+		contentType string
+	}{
+		{path: "/", status: http.StatusFound},
+		{path: "/dashboard/", status: http.StatusOK, contentType: "text/html; charset=utf-8"},
+		{path: "/dashboard/nearby.html", status: http.StatusOK, contentType: "text/html; charset=utf-8"},
+		{path: "/dashboard/app.js", status: http.StatusOK},
+		{path: "/dashboard/api/sensors", status: http.StatusOK, contentType: "application/json"},
+		{path: "/dashboard/api/nearby", status: http.StatusOK, contentType: "application/json"},
+		{path: "/favicon.ico", status: http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, test.path, nil))
+
+			assert.Equal(t, test.status, w.Code)
+			if test.contentType != "" {
+				assert.Equal(t, test.contentType, w.Header().Get("Content-Type"))
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/dashboard/api/sensors", nil))
+
+	var sensors []Sensor
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &sensors))
+	assert.Len(t, sensors, 1)
+	assert.Equal(t, "Living room monstera", sensors[0].PlantName)
+}
@@ -0,0 +1,169 @@
+// Renders the dashboard pages from the bridge's JSON, refreshing periodically.
+var dashboard = (function () {
+  "use strict";
+
+  var refreshInterval = 10000;
+  // sensors not heard for longer are highlighted
+  var staleAfter = 15 * 60;
+
+  var columns = [
+    { metric: "moist", unit: "%", digits: 1 },
+    { metric: "temp", unit: "°C", digits: 1 },
+    { metric: "light", unit: " lx", digits: 0 },
+    { metric: "humid", unit: "%", digits: 1 },
+  ];
+
+  function el(tag, text, className) {
+    var node = document.createElement(tag);
+    if (text !== undefined && text !== null) {
+      node.textContent = text;
+    }
+    if (className) {
+      node.className = className;
+    }
+    return node;
+  }
+
+  function age(seconds) {
+    if (seconds < 60) {
+      return Math.round(seconds) + "s ago";
+    }
+    if (seconds < 3600) {
+      return Math.round(seconds / 60) + "m ago";
+    }
+    return Math.round(seconds / 3600) + "h ago";
+  }
+
+  function format(value, column) {
+    if (value === undefined) {
+      return "–";
+    }
+    return value.toFixed(column.digits) + column.unit;
+  }
+
+  function sparkline(points) {
+    var ns = "http://www.w3.org/2000/svg";
+    var width = 96;
+    var height = 24;
+
+    var svg = document.createElementNS(ns, "svg");
+    svg.setAttribute("class", "sparkline");
+    svg.setAttribute("width", width);
+    svg.setAttribute("height", height);
+
+    if (!points || points.length < 2) {
+      return svg;
+    }
+
+    var min = Infinity;
+    var max = -Infinity;
+    points.forEach(function (p) {
+      min = Math.min(min, p.v);
+      max = Math.max(max, p.v);
+    });
+    var range = max - min || 1;
+
+    var start = Date.parse(points[0].t);
+    var span = Date.parse(points[points.length - 1].t) - start || 1;
+
+    var coords = points.map(function (p) {
+      var x = ((Date.parse(p.t) - start) / span) * (width - 2) + 1;
+      var y = height - 1 - ((p.v - min) / range) * (height - 2);
+      return x.toFixed(1) + "," + y.toFixed(1);
+    });
+
+    var line = document.createElementNS(ns, "polyline");
+    line.setAttribute("points", coords.join(" "));
+    svg.appendChild(line);
+
+    return svg;
+  }
+
+  function render(table, rows, build) {
+    var tbody = table.querySelector("tbody");
+    tbody.textContent = "";
+    rows.forEach(function (row) {
+      tbody.appendChild(build(row));
+    });
+
+    table.hidden = rows.length === 0;
+    document.getElementById("empty").hidden = rows.length !== 0;
+  }
+
+  function sensorRow(sensor) {
+    var tr = el("tr");
+
+    var plant = el("td");
+    if (sensor.registered) {
+      plant.appendChild(el("span", sensor.plant_name || sensor.plant));
+      plant.appendChild(el("span", [sensor.plant, sensor.zone].filter(Boolean).join(" · "), "secondary"));
+    } else {
+      plant.appendChild(el("span", "Unregistered", "unregistered"));
+    }
+    tr.appendChild(plant);
+
+    var device = el("td");
+    device.appendChild(el("span", sensor.device));
+    device.appendChild(el("span", sensor.device_type, "secondary"));
+    tr.appendChild(device);
+
+    columns.forEach(function (column) {
+      var td = el("td");
+      td.appendChild(el("span", format(sensor.values[column.metric], column), "value"));
+      td.appendChild(sparkline(sensor.sparklines[column.metric]));
+      tr.appendChild(td);
+    });
+
+    var battery = sensor.values.battery;
+    tr.appendChild(el("td", battery === undefined ? "–" : battery + "%"));
+
+    var rssi = sensor.values.rssi;
+    tr.appendChild(el("td", rssi === undefined ? "–" : rssi + " dBm"));
+
+    tr.appendChild(el("td", age(sensor.age_seconds), sensor.age_seconds > staleAfter ? "stale" : ""));
+
+    return tr;
+  }
+
+  function nearbyRow(device) {
+    var tr = el("tr");
+    tr.appendChild(el("td", device.address));
+    tr.appendChild(el("td", device.name || "–"));
+    tr.appendChild(el("td", device.rssi + " dBm"));
+    tr.appendChild(el("td", (device.services || []).join(", ") || "–"));
+    tr.appendChild(el("td", device.count));
+    tr.appendChild(el("td", new Date(device.first_seen).toLocaleTimeString()));
+    tr.appendChild(el("td", age(device.age_seconds)));
+    return tr;
+  }
+
+  function poll(url, table, build) {
+    function refresh() {
+      fetch(url)
+        .then(function (resp) {
+          if (!resp.ok) {
+            throw new Error(resp.status + " " + resp.statusText);
+          }
+          return resp.json();
+        })
+        .then(function (rows) {
+          render(table, rows, build);
+        })
+        .catch(function (err) {
+          console.error("refreshing dashboard failed", err);
+        });
+    }
+
+    refresh();
+    setInterval(refresh, refreshInterval);
+  }
+
+  return {
+    sensors: function () {
+      poll("api/sensors", document.getElementById("sensors"), sensorRow);
+    },
+    nearby: function () {
+      poll("api/nearby", document.getElementById("nearby"), nearbyRow);
+    },
+  };
+})();
@@ -0,0 +1,278 @@
+package dashboard
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
+	"github.com/ryanrolds/plant-collector/bridge/internal/plants"
+	"github.com/ryanrolds/plant-collector/bridge/internal/scanner"
+)
+
+const (
+	// history is how far back sparklines go, in buckets of historyStep
+	history     = 24 * time.Hour
+	historyStep = 15 * time.Minute
+
+	// sensors are forgotten once they fall out of the sparklines
+	sensorExpiry = history
+	// nearbyExpiry drops devices that have moved out of range
+	nearbyExpiry = 10 * time.Minute
+	// maxNearby bounds the devices kept in busy places
+	maxNearby = 500
+)
+
+// Point is a sparkline value, the mean of a bucket
+type Point struct {
+	Time  time.Time `json:"t"`
+	Value float64   `json:"v"`
+}
+
+// Sensor is the state of a sensor the bridge has samples from
+type Sensor struct {
+	Device     string    `json:"device"`
+	DeviceType string    `json:"device_type,omitempty"`
+	Plant      string    `json:"plant"`
+	PlantName  string    `json:"plant_name,omitempty"`
+	Zone       string    `json:"zone,omitempty"`
+	Registered bool      `json:"registered"`
+	LastSeen   time.Time `json:"last_seen"`
+	// AgeSeconds is the time since LastSeen, by the bridge's clock
+	AgeSeconds float64            `json:"age_seconds"`
+	Values     map[string]float64 `json:"values"`
+	Sparklines map[string][]Point `json:"sparklines"`
+}
+
+// Nearby is a device advertising nearby that isn't a plant sensor
+type Nearby struct {
+	Address    string    `json:"address"`
+	Name       string    `json:"name,omitempty"`
+	RSSI       int       `json:"rssi"`
+	Services   []string  `json:"services,omitempty"`
+	FirstSeen  time.Time `json:"first_seen"`
+	LastSeen   time.Time `json:"last_seen"`
+	AgeSeconds float64   `json:"age_seconds"`
+	Count      int       `json:"count"`
+}
+
+type bucket struct {
+	start time.Time
+	sum   float64
+	count int
+}
+
+type sensor struct {
+	Sensor
+	buckets map[string][]bucket
+}
+
+// Tracker is a pipeline stage that keeps the latest readings and a day of
+// history of every sensor for the dashboard. It also observes the scanner to
+// list the devices nearby that aren't plant sensors.
+type Tracker struct {
+	plants map[string]plants.Plant
+	now    func() time.Time
+
+	mu      sync.Mutex
+	sensors map[string]*sensor
+	nearby  map[string]*Nearby
+}
+
+func NewTracker(registry *plants.Registry) *Tracker {
+	t := &Tracker{
+		plants:  make(map[string]plants.Plant),
+		now:     time.Now,
+		sensors: make(map[string]*sensor),
+		nearby:  make(map[string]*Nearby),
+	}
+
+	for _, p := range registry.Plants() {
+		t.plants[p.ID] = p
+	}
+
+	return t
+}
+
+// Process records the sample and passes it on, readings flagged by validation
+// aren't shown
+func (t *Tracker) Process(s ingester.Sample) []ingester.Sample {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	current, ok := t.sensors[s.Device]
+	if !ok {
+		current = &sensor{
+			Sensor:  Sensor{Device: s.Device},
+			buckets: make(map[string][]bucket),
+		}
+		t.sensors[s.Device] = current
+	}
+
+	if s.Time.After(current.LastSeen) {
+		current.LastSeen = s.Time
+		current.Plant = s.Plant
+		current.Zone = s.Zone
+		if s.DeviceType != "" {
+			current.DeviceType = s.DeviceType
+		}
+		if current.Values == nil {
+			current.Values = make(map[string]float64)
+		}
+	}
+
+	start := s.Time.Truncate(historyStep)
+	for metric, value := range s.Values() {
+		if _, flagged := s.Quality[metric]; flagged {
+			continue
+		}
+
+		if !s.Time.Before(current.LastSeen) {
+			current.Values[metric] = value
+		}
+
+		buckets := current.buckets[metric]
+		if n := len(buckets); n > 0 && buckets[n-1].start.Equal(start) {
+			buckets[n-1].sum += value
+			buckets[n-1].count++
+			continue
+		}
+
+		// late samples are left out of the history rather than reordering it
+		if n := len(buckets); n > 0 && start.Before(buckets[n-1].start) {
+			continue
+		}
+
+		current.buckets[metric] = append(buckets, bucket{start: start, sum: value, count: 1})
+	}
+
+	return []ingester.Sample{s}
+}
+
+// Observe records advertisements from devices that aren't plant sensors
+func (t *Tracker) Observe(a scanner.Advertisement) {
+	if a.Driver != "" {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	device, ok := t.nearby[a.Address]
+	if !ok {
+		if len(t.nearby) >= maxNearby {
+			t.pruneNearby(a.Time)
+		}
+		if len(t.nearby) >= maxNearby {
+			return
+		}
+
+		device = &Nearby{Address: a.Address, FirstSeen: a.Time}
+		t.nearby[a.Address] = device
+	}
+
+	if a.Name != "" {
+		device.Name = a.Name
+	}
+	device.RSSI = a.RSSI
+	device.LastSeen = a.Time
+	device.Count++
+
+	device.Services = device.Services[:0]
+	for _, data := range a.ServiceData {
+		device.Services = append(device.Services, data.UUID)
+	}
+}
+
+// Sensors returns the sensors seen in the last day, ordered by plant and
+// device
+func (t *Tracker) Sensors() []Sensor {
+	now := t.now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	sensors := make([]Sensor, 0, len(t.sensors))
+	for device, s := range t.sensors {
+		if now.Sub(s.LastSeen) > sensorExpiry {
+			delete(t.sensors, device)
+			continue
+		}
+
+		out := s.Sensor
+		out.AgeSeconds = now.Sub(s.LastSeen).Seconds()
+		out.Values = make(map[string]float64, len(s.Values))
+		for metric, value := range s.Values {
+			out.Values[metric] = value
+		}
+
+		if plant, ok := t.plants[s.Plant]; ok {
+			out.Registered = true
+			out.PlantName = plant.Name
+		}
+
+		out.Sparklines = make(map[string][]Point, len(s.buckets))
+		for metric, buckets := range s.buckets {
+			// drop buckets that have fallen out of the day
+			first := 0
+			for first < len(buckets) && now.Sub(buckets[first].start) > history {
+				first++
+			}
+			buckets = buckets[first:]
+			s.buckets[metric] = buckets
+
+			points := make([]Point, len(buckets))
+			for i, b := range buckets {
+				points[i] = Point{Time: b.start, Value: b.sum / float64(b.count)}
+			}
+			out.Sparklines[metric] = points
+		}
+
+		sensors = append(sensors, out)
+	}
+
+	sort.Slice(sensors, func(i, j int) bool {
+		if sensors[i].Plant != sensors[j].Plant {
+			return sensors[i].Plant < sensors[j].Plant
+		}
+		return sensors[i].Device < sensors[j].Device
+	})
+
+	return sensors
+}
+
+// Nearby returns the devices that aren't plant sensors heard in the last few
+// minutes, strongest signal first
+func (t *Tracker) Nearby() []Nearby {
+	now := t.now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.pruneNearby(now)
+
+	nearby := make([]Nearby, 0, len(t.nearby))
+	for _, device := range t.nearby {
+		out := *device
+		out.Services = append([]string(nil), device.Services...)
+		out.AgeSeconds = now.Sub(device.LastSeen).Seconds()
+		nearby = append(nearby, out)
+	}
+
+	sort.Slice(nearby, func(i, j int) bool {
+		if nearby[i].RSSI != nearby[j].RSSI {
+			return nearby[i].RSSI > nearby[j].RSSI
+		}
+		return nearby[i].Address < nearby[j].Address
+	})
+
+	return nearby
+}
+
+func (t *Tracker) pruneNearby(now time.Time) {
+	for address, device := range t.nearby {
+		if now.Sub(device.LastSeen) > nearbyExpiry {
+			delete(t.nearby, address)
+		}
+	}
+}
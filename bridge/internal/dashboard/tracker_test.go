@@ -0,0 +1,122 @@
+package dashboard
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ryanrolds/plant-collector/bridge/internal/config"
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
+	"github.com/ryanrolds/plant-collector/bridge/internal/plants"
+	"github.com/ryanrolds/plant-collector/bridge/internal/scanner"
+	"github.com/stretchr/testify/assert"
+)
+
+func float(v float32) *float32 {
+	return &v
+}
+
+func integer(v int) *int {
+	return &v
+}
+
+func testTracker(t *testing.T, now time.Time) *Tracker {
+	registry, err := plants.NewRegistry([]config.Plant{
+		{ID: "monstera", Name: "Living room monstera"},
+	})
+	assert.Nil(t, err)
+
+	tracker := NewTracker(registry)
+	tracker.now = func() time.Time {
+		return now
+	}
+
+	return tracker
+}
+
+func TestTrackerSensors(t *testing.T) {
+	start := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+	tracker := testTracker(t, start.Add(30*time.Minute))
+
+	samples := []ingester.Sample{
+		{Time: start, Plant: "monstera", Device: "C4:7C:8D:6A:3D:72", DeviceType: "b-parasite", Moisture: float(40), Rssi: integer(-70)},
+		{Time: start.Add(5 * time.Minute), Plant: "monstera", Device: "C4:7C:8D:6A:3D:72", Moisture: float(44)},
+		{Time: start.Add(20 * time.Minute), Plant: "monstera", Device: "C4:7C:8D:6A:3D:72", Moisture: float(50),
+			Quality: map[string]string{ingester.MetricMoisture: "outlier"}},
+		{Time: start.Add(25 * time.Minute), Plant: "monstera", Device: "C4:7C:8D:6A:3D:72", Moisture: float(48)},
+		{Time: start, Plant: "0A:0B:0C:0D:0E:0F", Device: "0A:0B:0C:0D:0E:0F", Temperature: float(20)},
+		// more than a day old
+		{Time: start.Add(-25 * time.Hour), Plant: "fern", Device: "01:02:03:04:05:06", Temperature: float(20)},
+	}
+	for _, s := range samples {
+		assert.Equal(t, []ingester.Sample{s}, tracker.Process(s))
+	}
+
+	sensors := tracker.Sensors()
+	assert.Len(t, sensors, 2)
+
+	assert.Equal(t, "0A:0B:0C:0D:0E:0F", sensors[0].Plant)
+	assert.False(t, sensors[0].Registered)
+
+	monstera := sensors[1]
+	assert.True(t, monstera.Registered)
+	assert.Equal(t, "Living room monstera", monstera.PlantName)
+	assert.Equal(t, "b-parasite", monstera.DeviceType)
+	assert.Equal(t, start.Add(25*time.Minute), monstera.LastSeen)
+	assert.Equal(t, 300.0, monstera.AgeSeconds)
+	assert.Equal(t, map[string]float64{ingester.MetricMoisture: 48, ingester.MetricRssi: -70}, monstera.Values)
+	assert.Equal(t, []Point{
+		{Time: start, Value: 42},
+		{Time: start.Add(15 * time.Minute), Value: 48},
+	}, monstera.Sparklines[ingester.MetricMoisture])
+}
+
+func TestTrackerSparklineExpiry(t *testing.T) {
+	start := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+	now := start
+	tracker := testTracker(t, start)
+	tracker.now = func() time.Time {
+		return now
+	}
+
+	tracker.Process(ingester.Sample{Time: start, Device: "C4:7C:8D:6A:3D:72", Moisture: float(40)})
+	tracker.Process(ingester.Sample{Time: start.Add(20 * time.Hour), Device: "C4:7C:8D:6A:3D:72", Moisture: float(44)})
+
+	now = start.Add(25 * time.Hour)
+	sensors := tracker.Sensors()
+	assert.Len(t, sensors, 1)
+	assert.Len(t, sensors[0].Sparklines[ingester.MetricMoisture], 1)
+}
+
+func TestTrackerNearby(t *testing.T) {
+	start := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+	tracker := testTracker(t, start.Add(time.Minute))
+
+	tracker.Observe(scanner.Advertisement{Time: start, Address: "C4:7C:8D:6A:3D:72", Name: "prst", Driver: "b-parasite"})
+	tracker.Observe(scanner.Advertisement{Time: start, Address: "11:22:33:44:55:66", Name: "Band", RSSI: -80})
+	tracker.Observe(scanner.Advertisement{Time: start.Add(30 * time.Second), Address: "11:22:33:44:55:66", RSSI: -60,
+		ServiceData: []scanner.ServiceData{{UUID: "0000fe95-0000-1000-8000-00805f9b34fb"}}})
+	tracker.Observe(scanner.Advertisement{Time: start, Address: "AA:BB:CC:DD:EE:FF", RSSI: -90})
+	// out of range for a while
+	tracker.Observe(scanner.Advertisement{Time: start.Add(-time.Hour), Address: "01:02:03:04:05:06", RSSI: -50})
+
+	assert.Equal(t, []Nearby{
+		{
+			Address:    "11:22:33:44:55:66",
+			Name:       "Band",
+			RSSI:       -60,
+			Services:   []string{"0000fe95-0000-1000-8000-00805f9b34fb"},
+			FirstSeen:  start,
+			LastSeen:   start.Add(30 * time.Second),
+			AgeSeconds: 30,
+			Count:      2,
+		},
+		{
+			Address:    "AA:BB:CC:DD:EE:FF",
+			RSSI:       -90,
+			FirstSeen:  start,
+			LastSeen:   start,
+			AgeSeconds: 60,
+			Count:      1,
+		},
+	}, tracker.Nearby())
+}
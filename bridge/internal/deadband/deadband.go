@@ -0,0 +1,196 @@
+package deadband
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/ryanrolds/plant-collector/bridge/internal/config"
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
+)
+
+// defaultHeartbeat is the longest a metric with a deadband stays silent when
+// the sensor type doesn't set a heartbeat
+const defaultHeartbeat = 15 * time.Minute
+
+type sensorType struct {
+	deadbands map[string]float64
+	heartbeat time.Duration
+}
+
+type reading struct {
+	value float64
+	time  time.Time
+}
+
+type device struct {
+	sent       map[string]reading
+	pending    ingester.Sample
+	hasPending bool
+}
+
+// Filter only reports metrics that moved further than their deadband since
+// they were last sent, or that have been silent for longer than the sensor
+// type's heartbeat. A sample is sent when any of its deadbanded metrics are due
+// and the metrics without a deadband ride along with it. Samples from sensor
+// types without deadbands pass through untouched.
+type Filter struct {
+	types   map[string]sensorType
+	devices map[string]*device
+}
+
+func NewFilter(cfg config.Report) (*Filter, error) {
+	types := make(map[string]sensorType, len(cfg.SensorTypes))
+	for name, typeCfg := range cfg.SensorTypes {
+		for metric, band := range typeCfg.Deadband {
+			if !ingester.IsMetric(metric) {
+				return nil, fmt.Errorf("sensor type %s: unknown metric %q", name, metric)
+			}
+
+			if band < 0 {
+				return nil, fmt.Errorf("sensor type %s: negative deadband for %s", name, metric)
+			}
+		}
+
+		heartbeat := typeCfg.Heartbeat
+		if heartbeat == 0 {
+			heartbeat = defaultHeartbeat
+		}
+
+		types[name] = sensorType{
+			deadbands: typeCfg.Deadband,
+			heartbeat: heartbeat,
+		}
+	}
+
+	return &Filter{
+		types:   types,
+		devices: make(map[string]*device),
+	}, nil
+}
+
+func (f *Filter) Process(s ingester.Sample) []ingester.Sample {
+	st, ok := f.types[s.DeviceType]
+	if !ok || len(st.deadbands) == 0 {
+		return []ingester.Sample{s}
+	}
+
+	d, ok := f.devices[s.Device]
+	if !ok {
+		d = &device{sent: make(map[string]reading)}
+		f.devices[s.Device] = d
+	}
+
+	deadbanded := false
+	due := false
+	for metric, band := range st.deadbands {
+		value, ok := s.Value(metric)
+		if !ok {
+			continue
+		}
+
+		deadbanded = true
+
+		last, ok := d.sent[metric]
+		if !ok || math.Abs(value-last.value) > band || s.Time.Sub(last.time) >= st.heartbeat {
+			due = true
+		}
+	}
+
+	if !deadbanded {
+		return []ingester.Sample{s}
+	}
+
+	if !due {
+		d.hold(s)
+		return nil
+	}
+
+	d.record(s)
+	return []ingester.Sample{s}
+}
+
+// Flush sends the latest held values of metrics that have been silent for
+// longer than the heartbeat
+func (f *Filter) Flush(now time.Time) []ingester.Sample {
+	macs := make([]string, 0, len(f.devices))
+	for mac := range f.devices {
+		macs = append(macs, mac)
+	}
+	sort.Strings(macs)
+
+	var samples []ingester.Sample
+	for _, mac := range macs {
+		d := f.devices[mac]
+		if !d.hasPending {
+			continue
+		}
+
+		st := f.types[d.pending.DeviceType]
+		for metric := range d.pending.Values() {
+			last, ok := d.sent[metric]
+			if !ok || now.Sub(last.time) >= st.heartbeat {
+				pending := d.pending
+				d.record(pending)
+				samples = append(samples, pending)
+				break
+			}
+		}
+	}
+
+	return samples
+}
+
+// Drain sends every held value
+func (f *Filter) Drain() []ingester.Sample {
+	macs := make([]string, 0, len(f.devices))
+	for mac := range f.devices {
+		macs = append(macs, mac)
+	}
+	sort.Strings(macs)
+
+	var samples []ingester.Sample
+	for _, mac := range macs {
+		d := f.devices[mac]
+		if !d.hasPending {
+			continue
+		}
+
+		pending := d.pending
+		d.record(pending)
+		samples = append(samples, pending)
+	}
+
+	return samples
+}
+
+// hold keeps the latest value of each metric until it is sent
+func (d *device) hold(s ingester.Sample) {
+	if d.hasPending {
+		for metric, value := range d.pending.Values() {
+			if _, ok := s.Value(metric); !ok {
+				s.SetValue(metric, value)
+			}
+		}
+	}
+
+	d.pending = s
+	d.hasPending = true
+}
+
+// record marks the sample's metrics as sent, held values it supersedes are dropped
+func (d *device) record(s ingester.Sample) {
+	for metric, value := range s.Values() {
+		d.sent[metric] = reading{value: value, time: s.Time}
+
+		if d.hasPending {
+			d.pending.ClearValue(metric)
+		}
+	}
+
+	if d.hasPending && len(d.pending.Values()) == 0 {
+		d.pending = ingester.Sample{}
+		d.hasPending = false
+	}
+}
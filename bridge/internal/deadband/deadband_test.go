@@ -0,0 +1,103 @@
+package deadband
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ryanrolds/plant-collector/bridge/internal/config"
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
+	"github.com/stretchr/testify/assert"
+)
+
+var start = time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+
+func float(v float32) *float32 {
+	return &v
+}
+
+func sample(minute int, deviceType string, moisture float32) ingester.Sample {
+	rssi := -70
+	return ingester.Sample{
+		Time:       start.Add(time.Duration(minute) * time.Minute),
+		Device:     "01:02:03:04:05:06",
+		DeviceType: deviceType,
+		Moisture:   float(moisture),
+		Rssi:       &rssi,
+	}
+}
+
+func testFilter(t *testing.T) *Filter {
+	filter, err := NewFilter(config.Report{
+		SensorTypes: map[string]config.ReportSensorType{
+			"b-parasite": {
+				Deadband:  map[string]float64{ingester.MetricMoisture: 0.5},
+				Heartbeat: 10 * time.Minute,
+			},
+		},
+	})
+	assert.Nil(t, err)
+
+	return filter
+}
+
+func TestDeadband(t *testing.T) {
+	filter := testFilter(t)
+
+	// first reading is always sent
+	assert.Len(t, filter.Process(sample(0, "b-parasite", 40)), 1)
+	// within the deadband
+	assert.Len(t, filter.Process(sample(1, "b-parasite", 40.3)), 0)
+	assert.Len(t, filter.Process(sample(2, "b-parasite", 39.6)), 0)
+	// moved more than the deadband
+	out := filter.Process(sample(3, "b-parasite", 39.4))
+	assert.Len(t, out, 1)
+	assert.Equal(t, float32(39.4), *out[0].Moisture)
+	assert.Equal(t, -70, *out[0].Rssi)
+	// heartbeat, compared to the last sent value
+	assert.Len(t, filter.Process(sample(13, "b-parasite", 39.4)), 1)
+}
+
+func TestDeadbandUnconfiguredType(t *testing.T) {
+	filter := testFilter(t)
+
+	assert.Len(t, filter.Process(sample(0, "flower_care", 40)), 1)
+	assert.Len(t, filter.Process(sample(1, "flower_care", 40)), 1)
+}
+
+func TestHeartbeatFlush(t *testing.T) {
+	filter := testFilter(t)
+
+	assert.Len(t, filter.Process(sample(0, "b-parasite", 40)), 1)
+	assert.Len(t, filter.Process(sample(1, "b-parasite", 40.2)), 0)
+
+	assert.Len(t, filter.Flush(start.Add(5*time.Minute)), 0)
+
+	out := filter.Flush(start.Add(10 * time.Minute))
+	assert.Len(t, out, 1)
+	assert.Equal(t, float32(40.2), *out[0].Moisture)
+	assert.Equal(t, start.Add(time.Minute), out[0].Time)
+
+	// nothing held any more
+	assert.Len(t, filter.Flush(start.Add(30*time.Minute)), 0)
+}
+
+func TestInvalidConfig(t *testing.T) {
+	_, err := NewFilter(config.Report{
+		SensorTypes: map[string]config.ReportSensorType{
+			"b-parasite": {Deadband: map[string]float64{"pressure": 1}},
+		},
+	})
+	assert.NotNil(t, err)
+}
+
+func TestDrain(t *testing.T) {
+	filter := testFilter(t)
+
+	assert.Len(t, filter.Process(sample(0, "b-parasite", 40)), 1)
+	assert.Len(t, filter.Process(sample(1, "b-parasite", 40.2)), 0)
+
+	out := filter.Drain()
+	assert.Len(t, out, 1)
+	assert.Equal(t, float32(40.2), *out[0].Moisture)
+	assert.Len(t, filter.Drain(), 0)
+}
@@ -0,0 +1,233 @@
+package derive
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/ryanrolds/plant-collector/bridge/internal/config"
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
+)
+
+// lightSources are lux to PPFD (µmol/m²/s) conversion factors
+var lightSources = map[string]float64{
+	"sunlight":     0.0185,
+	"led":          0.0150,
+	"fluorescent":  0.0135,
+	"metal_halide": 0.0141,
+	"hps":          0.0122,
+}
+
+const (
+	defaultLightSource = "sunlight"
+	// how old a zone's temperature or humidity can be and still be paired with
+	// a reading from another sensor in the zone
+	defaultPairWindow = 15 * time.Minute
+	// light readings further apart than this aren't integrated into the DLI
+	defaultMaxLightGap = time.Hour
+)
+
+type reading struct {
+	value float64
+	time  time.Time
+}
+
+type zoneClimate struct {
+	temperature *reading
+	humidity    *reading
+}
+
+type lightIntegral struct {
+	day  string
+	last *reading
+	dli  float64
+}
+
+// Deriver computes horticultural metrics from the raw readings. VPD and dew
+// point need temperature and humidity, when a sample has only one of them the
+// other is taken from a recent reading in the same zone. Lux is converted to an
+// estimated PPFD and integrated into a DLI per plant per local day.
+type Deriver struct {
+	factor      float64
+	zoneFactors map[string]float64
+	location    *time.Location
+	pairWindow  time.Duration
+	maxLightGap time.Duration
+
+	zones map[string]*zoneClimate
+	light map[string]*lightIntegral
+}
+
+func NewDeriver(cfg config.Derive) (*Deriver, error) {
+	factor, err := ppfdFactor(cfg.LightSource, cfg.PPFDFactor)
+	if err != nil {
+		return nil, err
+	}
+
+	zoneFactors := make(map[string]float64, len(cfg.Zones))
+	for zone, zoneCfg := range cfg.Zones {
+		zoneFactor, err := ppfdFactor(zoneCfg.LightSource, zoneCfg.PPFDFactor)
+		if err != nil {
+			return nil, fmt.Errorf("zone %s: %w", zone, err)
+		}
+		zoneFactors[zone] = zoneFactor
+	}
+
+	location := time.Local
+	if cfg.Timezone != "" {
+		location, err = time.LoadLocation(cfg.Timezone)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	pairWindow := cfg.PairWindow
+	if pairWindow == 0 {
+		pairWindow = defaultPairWindow
+	}
+
+	return &Deriver{
+		factor:      factor,
+		zoneFactors: zoneFactors,
+		location:    location,
+		pairWindow:  pairWindow,
+		maxLightGap: defaultMaxLightGap,
+		zones:       make(map[string]*zoneClimate),
+		light:       make(map[string]*lightIntegral),
+	}, nil
+}
+
+func ppfdFactor(lightSource string, factor float64) (float64, error) {
+	if factor > 0 {
+		return factor, nil
+	}
+
+	if lightSource == "" {
+		lightSource = defaultLightSource
+	}
+
+	factor, ok := lightSources[strings.ToLower(lightSource)]
+	if !ok {
+		return 0, fmt.Errorf("unknown light source %q", lightSource)
+	}
+
+	return factor, nil
+}
+
+func (d *Deriver) Process(s ingester.Sample) []ingester.Sample {
+	d.deriveClimate(&s)
+	d.deriveLight(&s)
+
+	return []ingester.Sample{s}
+}
+
+func (d *Deriver) deriveClimate(s *ingester.Sample) {
+	var temperature, humidity *reading
+	if s.Temperature != nil && !flagged(s, ingester.MetricTemperature) {
+		temperature = &reading{value: float64(*s.Temperature), time: s.Time}
+	}
+	if s.Humidity != nil && !flagged(s, ingester.MetricHumidity) {
+		humidity = &reading{value: float64(*s.Humidity), time: s.Time}
+	}
+
+	if s.Zone != "" {
+		climate, ok := d.zones[s.Zone]
+		if !ok {
+			climate = &zoneClimate{}
+			d.zones[s.Zone] = climate
+		}
+
+		if temperature != nil {
+			climate.temperature = temperature
+		} else if d.fresh(climate.temperature, s.Time) {
+			temperature = climate.temperature
+		}
+
+		if humidity != nil {
+			climate.humidity = humidity
+		} else if d.fresh(climate.humidity, s.Time) {
+			humidity = climate.humidity
+		}
+	}
+
+	if temperature == nil || humidity == nil {
+		return
+	}
+
+	vpd := float32(VPD(temperature.value, humidity.value))
+	dewPoint := float32(DewPoint(temperature.value, humidity.value))
+	s.VPD = &vpd
+	s.DewPoint = &dewPoint
+}
+
+// flagged reports whether validation rejected the sample's metric, rejected
+// readings forwarded with a quality flag aren't derived from
+func flagged(s *ingester.Sample, metric string) bool {
+	_, ok := s.Quality[metric]
+	return ok
+}
+
+func (d *Deriver) fresh(r *reading, now time.Time) bool {
+	if r == nil {
+		return false
+	}
+
+	age := now.Sub(r.time)
+	return age >= 0 && age <= d.pairWindow
+}
+
+func (d *Deriver) deriveLight(s *ingester.Sample) {
+	if s.Light == nil || flagged(s, ingester.MetricLight) {
+		return
+	}
+
+	factor, ok := d.zoneFactors[s.Zone]
+	if !ok {
+		factor = d.factor
+	}
+
+	ppfd := float64(*s.Light) * factor
+	ppfd32 := float32(ppfd)
+	s.PPFD = &ppfd32
+
+	day := s.Time.In(d.location).Format("2006-01-02")
+	integral, ok := d.light[s.Plant]
+	if !ok || integral.day != day {
+		integral = &lightIntegral{day: day}
+		d.light[s.Plant] = integral
+	}
+
+	current := &reading{value: ppfd, time: s.Time}
+	if integral.last != nil {
+		gap := s.Time.Sub(integral.last.time)
+		if gap > 0 && gap <= d.maxLightGap {
+			// trapezoidal integration, µmol to mol
+			integral.dli += (integral.last.value + ppfd) / 2 * gap.Seconds() / 1e6
+		}
+	}
+	integral.last = current
+
+	dli := float32(integral.dli)
+	s.DLI = &dli
+}
+
+// saturationVapourPressure in kPa for a temperature in °C (Tetens)
+func saturationVapourPressure(temperature float64) float64 {
+	return 0.6108 * math.Exp(17.27*temperature/(temperature+237.3))
+}
+
+// VPD returns the vapour pressure deficit in kPa
+func VPD(temperature float64, humidity float64) float64 {
+	return saturationVapourPressure(temperature) * (1 - humidity/100)
+}
+
+// DewPoint returns the dew point in °C (Magnus)
+func DewPoint(temperature float64, humidity float64) float64 {
+	if humidity <= 0 {
+		humidity = 0.01
+	}
+
+	gamma := math.Log(humidity/100) + 17.27*temperature/(temperature+237.3)
+	return 237.3 * gamma / (17.27 - gamma)
+}
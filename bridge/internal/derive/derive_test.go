@@ -0,0 +1,108 @@
+package derive
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ryanrolds/plant-collector/bridge/internal/config"
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
+	"github.com/stretchr/testify/assert"
+)
+
+func float(v float32) *float32 {
+	return &v
+}
+
+func TestClimate(t *testing.T) {
+	assert.InDelta(t, 1.584, VPD(25, 50), 0.001)
+	assert.InDelta(t, 13.86, DewPoint(25, 50), 0.01)
+	assert.InDelta(t, 0, VPD(20, 100), 0.0001)
+	assert.InDelta(t, 20, DewPoint(20, 100), 0.0001)
+}
+
+func TestDeriverClimate(t *testing.T) {
+	deriver, err := NewDeriver(config.Derive{})
+	assert.Nil(t, err)
+
+	now := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+
+	// temperature and humidity on the same sample
+	out := deriver.Process(ingester.Sample{Time: now, Zone: "tent", Temperature: float(25), Humidity: float(50)})
+	assert.InDelta(t, 1.584, *out[0].VPD, 0.001)
+	assert.InDelta(t, 13.86, *out[0].DewPoint, 0.01)
+
+	// temperature only, humidity from the zone
+	out = deriver.Process(ingester.Sample{Time: now.Add(time.Minute), Zone: "tent", Temperature: float(25)})
+	assert.NotNil(t, out[0].VPD)
+
+	// zone humidity is stale
+	out = deriver.Process(ingester.Sample{Time: now.Add(time.Hour), Zone: "tent", Temperature: float(25)})
+	assert.Nil(t, out[0].VPD)
+
+	// no zone to pair with
+	out = deriver.Process(ingester.Sample{Time: now, Temperature: float(25)})
+	assert.Nil(t, out[0].VPD)
+	assert.Nil(t, out[0].DewPoint)
+}
+
+func TestDeriverLight(t *testing.T) {
+	deriver, err := NewDeriver(config.Derive{
+		Timezone: "UTC",
+		Zones: map[string]config.DeriveZone{
+			"tent": {PPFDFactor: 0.02},
+		},
+	})
+	assert.Nil(t, err)
+
+	start := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+
+	out := deriver.Process(ingester.Sample{Time: start, Plant: "fern", Light: float(10000)})
+	assert.InDelta(t, 185, *out[0].PPFD, 0.001)
+	assert.InDelta(t, 0, *out[0].DLI, 0.0001)
+
+	// an hour at 185 µmol/m²/s is 0.666 mol/m²
+	out = deriver.Process(ingester.Sample{Time: start.Add(30 * time.Minute), Plant: "fern", Light: float(10000)})
+	out = deriver.Process(ingester.Sample{Time: start.Add(time.Hour), Plant: "fern", Light: float(10000)})
+	assert.InDelta(t, 0.666, *out[0].DLI, 0.0001)
+
+	// zone factor
+	out = deriver.Process(ingester.Sample{Time: start, Plant: "basil", Zone: "tent", Light: float(10000)})
+	assert.InDelta(t, 200, *out[0].PPFD, 0.001)
+
+	// new day starts from zero
+	out = deriver.Process(ingester.Sample{Time: start.Add(12 * time.Hour), Plant: "fern", Light: float(0)})
+	assert.InDelta(t, 0, *out[0].DLI, 0.0001)
+}
+
+func TestDeriverSkipsRejected(t *testing.T) {
+	deriver, err := NewDeriver(config.Derive{Timezone: "UTC"})
+	assert.Nil(t, err)
+
+	start := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+	rejected := map[string]string{
+		ingester.MetricTemperature: "out_of_range",
+		ingester.MetricLight:       "outlier",
+	}
+
+	deriver.Process(ingester.Sample{Time: start, Plant: "fern", Zone: "tent", Humidity: float(50), Light: float(10000)})
+
+	// a forwarded rejected reading isn't derived from
+	out := deriver.Process(ingester.Sample{Time: start.Add(30 * time.Minute), Plant: "fern", Zone: "tent",
+		Temperature: float(655.35), Light: float(0), Quality: rejected})
+	assert.Nil(t, out[0].VPD)
+	assert.Nil(t, out[0].DewPoint)
+	assert.Nil(t, out[0].PPFD)
+	assert.Nil(t, out[0].DLI)
+
+	// nor kept for the zone or the plant's DLI
+	out = deriver.Process(ingester.Sample{Time: start.Add(31 * time.Minute), Plant: "basil", Zone: "tent", Humidity: float(50)})
+	assert.Nil(t, out[0].VPD)
+
+	out = deriver.Process(ingester.Sample{Time: start.Add(time.Hour), Plant: "fern", Light: float(10000)})
+	assert.InDelta(t, 0.666, *out[0].DLI, 0.0001)
+}
+
+func TestUnknownLightSource(t *testing.T) {
+	_, err := NewDeriver(config.Derive{LightSource: "candle"})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,188 @@
+package downsample
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/ryanrolds/plant-collector/bridge/internal/config"
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
+)
+
+type stats struct {
+	min   float64
+	max   float64
+	sum   float64
+	last  float64
+	count int
+}
+
+type window struct {
+	start   time.Time
+	latest  ingester.Sample
+	metrics map[string]*stats
+}
+
+type plant struct {
+	current *window
+	// closedUntil is the end of the last emitted window, late samples are
+	// counted in the next open window
+	closedUntil time.Time
+}
+
+// Aggregator replaces the raw samples of each plant with one sample per fixed
+// window. The sample's metrics hold the window's mean and its stats the min,
+// max, mean, last value and count of each metric.
+type Aggregator struct {
+	window time.Duration
+	plants map[string]*plant
+}
+
+func NewAggregator(cfg config.Downsample) (*Aggregator, error) {
+	if cfg.Window < time.Second {
+		return nil, fmt.Errorf("downsample window must be at least a second, got %s", cfg.Window)
+	}
+
+	return &Aggregator{
+		window: cfg.Window,
+		plants: make(map[string]*plant),
+	}, nil
+}
+
+func (a *Aggregator) Process(s ingester.Sample) []ingester.Sample {
+	p, ok := a.plants[s.Plant]
+	if !ok {
+		p = &plant{}
+		a.plants[s.Plant] = p
+	}
+
+	start := s.Time.Truncate(a.window)
+	if start.Before(p.closedUntil) {
+		start = p.closedUntil
+	}
+
+	var samples []ingester.Sample
+	if p.current != nil && !p.current.start.Equal(start) {
+		samples = append(samples, a.close(p)...)
+	}
+
+	if p.current == nil {
+		p.current = &window{
+			start:   start,
+			metrics: make(map[string]*stats),
+		}
+	}
+
+	p.current.add(s)
+
+	return samples
+}
+
+// Flush emits the windows that have ended
+func (a *Aggregator) Flush(now time.Time) []ingester.Sample {
+	ids := make([]string, 0, len(a.plants))
+	for id := range a.plants {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var samples []ingester.Sample
+	for _, id := range ids {
+		p := a.plants[id]
+		if p.current == nil || now.Before(p.current.start.Add(a.window)) {
+			continue
+		}
+
+		samples = append(samples, a.close(p)...)
+	}
+
+	return samples
+}
+
+// Drain emits every open window, including ones that haven't ended
+func (a *Aggregator) Drain() []ingester.Sample {
+	ids := make([]string, 0, len(a.plants))
+	for id := range a.plants {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var samples []ingester.Sample
+	for _, id := range ids {
+		p := a.plants[id]
+		if p.current == nil {
+			continue
+		}
+
+		samples = append(samples, a.close(p)...)
+	}
+
+	return samples
+}
+
+// close ends the plant's current window, windows without any usable readings
+// aren't emitted
+func (a *Aggregator) close(p *plant) []ingester.Sample {
+	w := p.current
+	p.current = nil
+	p.closedUntil = w.start.Add(a.window)
+
+	if len(w.metrics) == 0 {
+		return nil
+	}
+
+	s := w.latest
+	s.Time = w.start
+	s.Window = a.window.String()
+	s.FrameCounter = nil
+	s.Quality = nil
+	s.Stats = make(map[string]ingester.Stats, len(w.metrics))
+
+	for _, metric := range ingester.Metrics {
+		s.ClearValue(metric)
+
+		st, ok := w.metrics[metric]
+		if !ok {
+			continue
+		}
+
+		mean := st.sum / float64(st.count)
+		s.SetValue(metric, mean)
+		s.Stats[metric] = ingester.Stats{
+			Min:   st.min,
+			Max:   st.max,
+			Mean:  mean,
+			Last:  st.last,
+			Count: st.count,
+		}
+	}
+
+	return []ingester.Sample{s}
+}
+
+func (w *window) add(s ingester.Sample) {
+	w.latest = s
+
+	for metric, value := range s.Values() {
+		// readings forwarded with a quality flag don't count
+		if _, flagged := s.Quality[metric]; flagged {
+			continue
+		}
+
+		st, ok := w.metrics[metric]
+		if !ok {
+			w.metrics[metric] = &stats{min: value, max: value, sum: value, last: value, count: 1}
+			continue
+		}
+
+		if value < st.min {
+			st.min = value
+		}
+		if value > st.max {
+			st.max = value
+		}
+		st.sum += value
+		st.last = value
+		st.count++
+	}
+}
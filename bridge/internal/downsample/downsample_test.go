@@ -0,0 +1,77 @@
+package downsample
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ryanrolds/plant-collector/bridge/internal/config"
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
+	"github.com/stretchr/testify/assert"
+)
+
+var start = time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+
+func sample(offset time.Duration, temperature float32) ingester.Sample {
+	return ingester.Sample{
+		Time:        start.Add(offset),
+		Plant:       "fern",
+		Temperature: &temperature,
+	}
+}
+
+func TestAggregator(t *testing.T) {
+	aggregator, err := NewAggregator(config.Downsample{Window: 5 * time.Minute})
+	assert.Nil(t, err)
+
+	assert.Len(t, aggregator.Process(sample(0, 20)), 0)
+	assert.Len(t, aggregator.Process(sample(time.Minute, 30)), 0)
+	assert.Len(t, aggregator.Process(sample(2*time.Minute, 22)), 0)
+
+	// the next window closes the previous one
+	out := aggregator.Process(sample(6*time.Minute, 25))
+	assert.Len(t, out, 1)
+	assert.Equal(t, start, out[0].Time)
+	assert.Equal(t, "5m0s", out[0].Window)
+	assert.InDelta(t, 24, *out[0].Temperature, 0.0001)
+	assert.Equal(t, ingester.Stats{Min: 20, Max: 30, Mean: 24, Last: 22, Count: 3}, out[0].Stats[ingester.MetricTemperature])
+
+	// flushed once the window has ended
+	assert.Len(t, aggregator.Flush(start.Add(9*time.Minute)), 0)
+	out = aggregator.Flush(start.Add(10 * time.Minute))
+	assert.Len(t, out, 1)
+	assert.Equal(t, start.Add(5*time.Minute), out[0].Time)
+	assert.Equal(t, 1, out[0].Stats[ingester.MetricTemperature].Count)
+
+	// late samples land in the next open window
+	assert.Len(t, aggregator.Process(sample(7*time.Minute, 25)), 0)
+	out = aggregator.Flush(start.Add(15 * time.Minute))
+	assert.Equal(t, start.Add(10*time.Minute), out[0].Time)
+}
+
+func TestAggregatorSkipsFlagged(t *testing.T) {
+	aggregator, err := NewAggregator(config.Downsample{Window: time.Minute})
+	assert.Nil(t, err)
+
+	s := sample(0, 655.35)
+	s.Quality = map[string]string{ingester.MetricTemperature: "out_of_range"}
+	aggregator.Process(s)
+
+	assert.Len(t, aggregator.Flush(start.Add(time.Minute)), 0)
+}
+
+func TestInvalidWindow(t *testing.T) {
+	_, err := NewAggregator(config.Downsample{})
+	assert.NotNil(t, err)
+}
+
+func TestAggregatorDrain(t *testing.T) {
+	aggregator, err := NewAggregator(config.Downsample{Window: 5 * time.Minute})
+	assert.Nil(t, err)
+
+	aggregator.Process(sample(0, 20))
+
+	out := aggregator.Drain()
+	assert.Len(t, out, 1)
+	assert.Equal(t, 1, out[0].Stats[ingester.MetricTemperature].Count)
+	assert.Len(t, aggregator.Drain(), 0)
+}
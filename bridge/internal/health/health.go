@@ -0,0 +1,332 @@
+package health
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ryanrolds/plant-collector/bridge/internal/config"
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
+	"github.com/ryanrolds/plant-collector/bridge/internal/scanner"
+	"github.com/ryanrolds/plant-collector/bridge/internal/sink"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultScanTimeout allows for quiet spells between advertisements
+	defaultScanTimeout = 2 * time.Minute
+	defaultSinkTimeout = 5 * time.Minute
+	defaultMaxQueued   = 10000
+)
+
+// Adapter reports the state of the Bluetooth adapter, see scanner.BTLEScanner
+type Adapter interface {
+	AdapterState() string
+}
+
+// Sinks reports the state of the sinks, see sink.FanOut
+type Sinks interface {
+	Status() []sink.Status
+}
+
+// Poll is the state of a device's polls
+type Poll struct {
+	LastPoll  time.Time `json:"last_poll"`
+	LastError string    `json:"last_error,omitempty"`
+	Successes int       `json:"successes"`
+	Failures  int       `json:"failures"`
+}
+
+// Device is the state of a plant sensor
+type Device struct {
+	Address        string    `json:"address"`
+	DeviceType     string    `json:"device_type"`
+	Plant          string    `json:"plant,omitempty"`
+	FirstSeen      time.Time `json:"first_seen"`
+	LastSeen       time.Time `json:"last_seen"`
+	Advertisements int       `json:"advertisements"`
+	Samples        int       `json:"samples"`
+	LastError      string    `json:"last_error,omitempty"`
+	LastErrorTime  time.Time `json:"last_error_time"`
+	Poll           *Poll     `json:"poll,omitempty"`
+}
+
+// Check is the outcome of one health check
+type Check struct {
+	Name    string `json:"name"`
+	OK      bool   `json:"ok"`
+	Message string `json:"message,omitempty"`
+}
+
+// Report is the response of the health endpoints
+type Report struct {
+	Status string  `json:"status"`
+	Checks []Check `json:"checks"`
+}
+
+// Status is the response of /status
+type Status struct {
+	Started           time.Time     `json:"started"`
+	UptimeSeconds     float64       `json:"uptime_seconds"`
+	Adapter           string        `json:"adapter"`
+	LastAdvertisement time.Time     `json:"last_advertisement"`
+	Sinks             []sink.Status `json:"sinks"`
+	Devices           []Device      `json:"devices"`
+}
+
+// Monitor tracks the scanner, sinks and plant sensors to report the bridge's
+// health. It observes the scanner for advertisements and polls, and is a
+// pipeline stage counting the samples of each sensor.
+type Monitor struct {
+	adapter     Adapter
+	sinks       Sinks
+	scanTimeout time.Duration
+	sinkTimeout time.Duration
+	maxQueued   int
+	started     time.Time
+	now         func() time.Time
+
+	mu                sync.Mutex
+	lastAdvertisement time.Time
+	devices           map[string]*Device
+}
+
+func NewMonitor(cfg config.Health, adapter Adapter, sinks Sinks) *Monitor {
+	m := &Monitor{
+		adapter:     adapter,
+		sinks:       sinks,
+		scanTimeout: cfg.ScanTimeout,
+		sinkTimeout: cfg.SinkTimeout,
+		maxQueued:   cfg.MaxQueued,
+		started:     time.Now(),
+		now:         time.Now,
+		devices:     make(map[string]*Device),
+	}
+
+	if m.scanTimeout == 0 {
+		m.scanTimeout = defaultScanTimeout
+	}
+	if m.sinkTimeout == 0 {
+		m.sinkTimeout = defaultSinkTimeout
+	}
+	if m.maxQueued == 0 {
+		m.maxQueued = defaultMaxQueued
+	}
+
+	return m
+}
+
+// Observe records the advertisement, and the device's if it's a plant sensor
+func (m *Monitor) Observe(a scanner.Advertisement) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if a.Time.After(m.lastAdvertisement) {
+		m.lastAdvertisement = a.Time
+	}
+
+	if a.Driver == "" {
+		return
+	}
+
+	d := m.device(a.Address, a.Driver, a.Time)
+	d.LastSeen = a.Time
+	d.Advertisements++
+	if a.Err != nil {
+		d.LastError = a.Err.Error()
+		d.LastErrorTime = a.Time
+	}
+}
+
+// ObservePoll records the outcome of polling a sensor
+func (m *Monitor) ObservePoll(p scanner.Poll) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	d := m.device(p.Address, p.Driver, p.Time)
+	if d.Poll == nil {
+		d.Poll = &Poll{}
+	}
+
+	d.Poll.LastPoll = p.Time
+	if p.Err == nil {
+		d.Poll.LastError = ""
+		d.Poll.Successes++
+		return
+	}
+
+	d.Poll.LastError = p.Err.Error()
+	d.Poll.Failures++
+	d.LastError = p.Err.Error()
+	d.LastErrorTime = p.Time
+}
+
+// Process counts the sample against its sensor and passes it on
+func (m *Monitor) Process(s ingester.Sample) []ingester.Sample {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	d := m.device(s.Device, s.DeviceType, s.Time)
+	d.Plant = s.Plant
+	d.Samples++
+
+	return []ingester.Sample{s}
+}
+
+func (m *Monitor) device(address string, deviceType string, seen time.Time) *Device {
+	d, ok := m.devices[address]
+	if !ok {
+		d = &Device{Address: address, FirstSeen: seen, LastSeen: seen}
+		m.devices[address] = d
+	}
+
+	if deviceType != "" {
+		d.DeviceType = deviceType
+	}
+
+	return d
+}
+
+// Live checks the adapter is up and the scan is hearing advertisements
+func (m *Monitor) Live() Report {
+	now := m.now()
+
+	m.mu.Lock()
+	lastAdvertisement := m.lastAdvertisement
+	m.mu.Unlock()
+
+	state := m.adapter.AdapterState()
+	adapter := Check{Name: "adapter", OK: state == scanner.AdapterScanning, Message: state}
+	if state == scanner.AdapterStarting && now.Sub(m.started) < m.scanTimeout {
+		adapter.OK = true
+	}
+
+	scan := Check{Name: "scan", OK: true}
+	// the bridge gets a scan timeout to hear its first advertisement
+	since := lastAdvertisement
+	if since.IsZero() {
+		since = m.started
+		scan.Message = "no advertisements yet"
+	} else {
+		scan.Message = fmt.Sprintf("last advertisement %s ago", now.Sub(since).Round(time.Second))
+	}
+	if now.Sub(since) > m.scanTimeout {
+		scan.OK = false
+	}
+
+	return report(adapter, scan)
+}
+
+// Ready checks the bridge is live and every sink is delivering without a
+// backlog
+func (m *Monitor) Ready() Report {
+	now := m.now()
+	checks := m.Live().Checks
+
+	for _, status := range m.sinks.Status() {
+		check := Check{Name: "sink " + status.Name, OK: true}
+
+		last := status.LastDelivered
+		if last.IsZero() || last.Before(m.started) {
+			last = m.started
+		}
+
+		switch {
+		case status.Queued > m.maxQueued:
+			check.OK = false
+			check.Message = fmt.Sprintf("%d samples queued, more than %d", status.Queued, m.maxQueued)
+		case status.Queued > 0 && now.Sub(last) > m.sinkTimeout:
+			check.OK = false
+			check.Message = fmt.Sprintf("%d samples queued, nothing delivered for %s", status.Queued, now.Sub(last).Round(time.Second))
+		default:
+			check.Message = fmt.Sprintf("%d samples queued", status.Queued)
+		}
+
+		checks = append(checks, check)
+	}
+
+	return report(checks...)
+}
+
+func report(checks ...Check) Report {
+	r := Report{Status: "ok", Checks: checks}
+	for _, check := range checks {
+		if !check.OK {
+			r.Status = "failing"
+		}
+	}
+
+	return r
+}
+
+// Status returns the state of the adapter, sinks and every plant sensor heard
+func (m *Monitor) Status() Status {
+	now := m.now()
+
+	status := Status{
+		Started:       m.started,
+		UptimeSeconds: now.Sub(m.started).Seconds(),
+		Adapter:       m.adapter.AdapterState(),
+		Sinks:         m.sinks.Status(),
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	status.LastAdvertisement = m.lastAdvertisement
+	status.Devices = make([]Device, 0, len(m.devices))
+	for _, d := range m.devices {
+		device := *d
+		if d.Poll != nil {
+			poll := *d.Poll
+			device.Poll = &poll
+		}
+		status.Devices = append(status.Devices, device)
+	}
+
+	sort.Slice(status.Devices, func(i, j int) bool {
+		return status.Devices[i].Address < status.Devices[j].Address
+	})
+
+	return status
+}
+
+// Handler serves /healthz, /readyz and /status. The health endpoints respond
+// with 503 when a check fails.
+func (m *Monitor) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeReport(w, m.Live())
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeReport(w, m.Ready())
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, m.Status())
+	})
+
+	return mux
+}
+
+func writeReport(w http.ResponseWriter, r Report) {
+	status := http.StatusOK
+	if r.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+
+	writeJSON(w, status, r)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		logrus.WithError(err).Debug("failed to write response")
+	}
+}
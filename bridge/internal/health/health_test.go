@@ -0,0 +1,174 @@
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ryanrolds/plant-collector/bridge/internal/config"
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
+	"github.com/ryanrolds/plant-collector/bridge/internal/scanner"
+	"github.com/ryanrolds/plant-collector/bridge/internal/sink"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeAdapter string
+
+func (a fakeAdapter) AdapterState() string {
+	return string(a)
+}
+
+type fakeSinks []sink.Status
+
+func (s fakeSinks) Status() []sink.Status {
+	return s
+}
+
+func testMonitor(start time.Time, adapter string, sinks ...sink.Status) *Monitor {
+	m := NewMonitor(config.Health{}, fakeAdapter(adapter), fakeSinks(sinks))
+	m.started = start
+	m.now = func() time.Time {
+		return start
+	}
+
+	return m
+}
+
+func TestLive(t *testing.T) {
+	start := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name              string
+		adapter           string
+		lastAdvertisement time.Time
+		now               time.Time
+		ok                bool
+	}{
+		{name: "scanning", adapter: scanner.AdapterScanning, lastAdvertisement: start, now: start.Add(time.Minute), ok: true},
+		{name: "starting", adapter: scanner.AdapterStarting, now: start.Add(time.Minute), ok: true},
+		{name: "slow to start", adapter: scanner.AdapterStarting, now: start.Add(3 * time.Minute)},
+		{name: "adapter failed", adapter: scanner.AdapterFailed, lastAdvertisement: start, now: start.Add(time.Minute)},
+		{name: "no advertisements yet", adapter: scanner.AdapterScanning, now: start.Add(time.Minute), ok: true},
+		{name: "never heard an advertisement", adapter: scanner.AdapterScanning, now: start.Add(3 * time.Minute)},
+		{name: "scan stalled", adapter: scanner.AdapterScanning, lastAdvertisement: start, now: start.Add(3 * time.Minute)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := testMonitor(start, test.adapter)
+			m.now = func() time.Time {
+				return test.now
+			}
+			if !test.lastAdvertisement.IsZero() {
+				m.Observe(scanner.Advertisement{Time: test.lastAdvertisement, Address: "11:22:33:44:55:66"})
+			}
+
+			report := m.Live()
+			assert.Equal(t, test.ok, report.Status == "ok", report)
+			assert.Len(t, report.Checks, 2)
+		})
+	}
+}
+
+func TestReady(t *testing.T) {
+	start := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+	now := start.Add(10 * time.Minute)
+
+	tests := []struct {
+		name   string
+		status sink.Status
+		ok     bool
+	}{
+		{name: "empty queue", status: sink.Status{Name: "ingester"}, ok: true},
+		{name: "delivering", status: sink.Status{Name: "ingester", Queued: 20, LastDelivered: now.Add(-time.Minute)}, ok: true},
+		{name: "stalled", status: sink.Status{Name: "ingester", Queued: 20, LastDelivered: now.Add(-6 * time.Minute)}},
+		{name: "never delivered", status: sink.Status{Name: "ingester", Queued: 20}},
+		{name: "backlog", status: sink.Status{Name: "ingester", Queued: 20000, LastDelivered: now}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := testMonitor(start, scanner.AdapterScanning, test.status)
+			m.now = func() time.Time {
+				return now
+			}
+			m.Observe(scanner.Advertisement{Time: now, Address: "11:22:33:44:55:66"})
+
+			report := m.Ready()
+			assert.Equal(t, test.ok, report.Status == "ok", report)
+			assert.Equal(t, "sink ingester", report.Checks[2].Name)
+		})
+	}
+}
+
+func TestStatus(t *testing.T) {
+	start := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+	m := testMonitor(start, scanner.AdapterScanning, sink.Status{Name: "ingester", Queued: 3})
+	m.now = func() time.Time {
+		return start.Add(time.Hour)
+	}
+
+	m.Observe(scanner.Advertisement{Time: start, Address: "11:22:33:44:55:66"})
+	m.Observe(scanner.Advertisement{Time: start, Address: "C4:7C:8D:6A:3D:72", Driver: "b-parasite"})
+	m.Process(ingester.Sample{Time: start, Plant: "monstera", Device: "C4:7C:8D:6A:3D:72", DeviceType: "b-parasite"})
+	m.Observe(scanner.Advertisement{Time: start.Add(time.Minute), Address: "C4:7C:8D:6A:3D:72", Driver: "b-parasite",
+		Err: errors.New("advertisement has no sensor data")})
+
+	m.ObservePoll(scanner.Poll{Time: start, Address: "0A:0B:0C:0D:0E:0F", Driver: "flower_care", Err: errors.New("connection timed out")})
+	m.ObservePoll(scanner.Poll{Time: start.Add(5 * time.Minute), Address: "0A:0B:0C:0D:0E:0F", Driver: "flower_care"})
+
+	status := m.Status()
+	assert.Equal(t, 3600.0, status.UptimeSeconds)
+	assert.Equal(t, scanner.AdapterScanning, status.Adapter)
+	assert.Equal(t, start.Add(time.Minute), status.LastAdvertisement)
+	assert.Equal(t, []sink.Status{{Name: "ingester", Queued: 3}}, status.Sinks)
+
+	assert.Equal(t, []Device{
+		{
+			Address:       "0A:0B:0C:0D:0E:0F",
+			DeviceType:    "flower_care",
+			FirstSeen:     start,
+			LastSeen:      start,
+			LastError:     "connection timed out",
+			LastErrorTime: start,
+			Poll: &Poll{
+				LastPoll:  start.Add(5 * time.Minute),
+				Successes: 1,
+				Failures:  1,
+			},
+		},
+		{
+			Address:        "C4:7C:8D:6A:3D:72",
+			DeviceType:     "b-parasite",
+			Plant:          "monstera",
+			FirstSeen:      start,
+			LastSeen:       start.Add(time.Minute),
+			Advertisements: 2,
+			Samples:        1,
+			LastError:      "advertisement has no sensor data",
+			LastErrorTime:  start.Add(time.Minute),
+		},
+	}, status.Devices)
+}
+
+func TestHandler(t *testing.T) {
+	start := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+	handler := testMonitor(start, scanner.AdapterFailed).Handler()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	var report Report
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.Equal(t, "failing", report.Status)
+	assert.Equal(t, Check{Name: "adapter", Message: scanner.AdapterFailed}, report.Checks[0])
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/status", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+}
@@ -0,0 +1,275 @@
+package influx
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/ryanrolds/plant-collector/bridge/internal/config"
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
+	"github.com/sirupsen/logrus"
+)
+
+// Write API versions
+const (
+	Version1 = "1"
+	Version2 = "2"
+)
+
+const (
+	defaultMeasurement = "plant"
+	defaultPrecision   = "ms"
+	timeout            = 10 * time.Second
+)
+
+// precision is a timestamp precision and its name in each write API
+type precision struct {
+	unit time.Duration
+	v1   string
+	v2   string
+}
+
+var precisions = map[string]precision{
+	"ns": {unit: time.Nanosecond, v1: "n", v2: "ns"},
+	"us": {unit: time.Microsecond, v1: "u", v2: "us"},
+	"ms": {unit: time.Millisecond, v1: "ms", v2: "ms"},
+	"s":  {unit: time.Second, v1: "s", v2: "s"},
+}
+
+// Writer sends samples to InfluxDB as line protocol, one point per sample
+// tagged with its plant, zone, collector and device. Batches the server
+// rejects are written again one sample at a time so only the bad points end
+// up in the dead letter store.
+type Writer struct {
+	url         string
+	client      *http.Client
+	token       string
+	username    string
+	password    string
+	measurement string
+	precision   precision
+	retry       ingester.RetryPolicy
+	batch       ingester.BatchPolicy
+	gzip        bool
+	deadLetter  ingester.DeadLetter
+}
+
+func NewWriter(cfg config.Influx) (*Writer, error) {
+	if cfg.URL == "" {
+		return nil, errors.New("url must be set")
+	}
+
+	base, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing url: %w", err)
+	}
+
+	if cfg.Precision == "" {
+		cfg.Precision = defaultPrecision
+	}
+	p, ok := precisions[cfg.Precision]
+	if !ok {
+		return nil, fmt.Errorf("unknown precision %q, use ns, us, ms or s", cfg.Precision)
+	}
+
+	query := url.Values{}
+	switch cfg.Version {
+	case Version1:
+		if cfg.Database == "" {
+			return nil, errors.New("database must be set")
+		}
+
+		base = base.JoinPath("write")
+		query.Set("db", cfg.Database)
+		if cfg.RetentionPolicy != "" {
+			query.Set("rp", cfg.RetentionPolicy)
+		}
+		query.Set("precision", p.v1)
+	case Version2, "":
+		if cfg.Bucket == "" {
+			return nil, errors.New("bucket must be set")
+		}
+
+		base = base.JoinPath("api", "v2", "write")
+		if cfg.Org != "" {
+			query.Set("org", cfg.Org)
+		}
+		query.Set("bucket", cfg.Bucket)
+		query.Set("precision", p.v2)
+	default:
+		return nil, fmt.Errorf("unknown version %q, use 1 or 2", cfg.Version)
+	}
+	base.RawQuery = query.Encode()
+
+	batch, err := ingester.NewBatchPolicy(cfg.Batch)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Writer{
+		url: base.String(),
+		client: &http.Client{
+			Timeout: timeout,
+		},
+		token:       cfg.Token,
+		username:    cfg.Username,
+		password:    cfg.Password,
+		measurement: cfg.Measurement,
+		precision:   p,
+		retry:       ingester.NewRetryPolicy(cfg.Retry),
+		batch:       batch,
+		gzip:        cfg.Gzip,
+	}
+
+	if w.measurement == "" {
+		w.measurement = defaultMeasurement
+	}
+
+	if cfg.DeadLetterPath != "" {
+		w.deadLetter = ingester.NewFileDeadLetter(cfg.DeadLetterPath)
+	}
+
+	return w, nil
+}
+
+// SendAll writes samples from the source until it returns io.EOF or the
+// context is cancelled
+func (w *Writer) SendAll(ctx context.Context, source ingester.Source) error {
+	for {
+		b, err := w.batch.Collect(ctx, source, w.line)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if errors.Is(err, io.EOF) {
+			logrus.Debug("all samples written")
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if !w.deliver(ctx, b.Samples, b.Encoded) {
+			return nil
+		}
+
+		err = source.Ack()
+		if err != nil {
+			logrus.WithError(err).Error("failed to acknowledge samples")
+		}
+	}
+}
+
+// deliver writes the points, retrying transient failures. Returns false when
+// interrupted by shutdown, the samples are left to be sent again.
+func (w *Writer) deliver(ctx context.Context, samples []ingester.Sample, lines [][]byte) bool {
+	body := bytes.Join(lines, nil)
+	if len(body) == 0 {
+		return true
+	}
+
+	err := w.retry.Do(ctx, func() error {
+		return w.send(ctx, body)
+	})
+	if err == nil {
+		return true
+	}
+
+	if ctx.Err() != nil {
+		logrus.WithError(err).Warn("samples not written before shutdown")
+		return false
+	}
+
+	// writes are idempotent so the good points of a partial write can be
+	// written again, the bad ones are found by writing them on their own
+	if len(samples) > 1 && rejected(err) {
+		logrus.WithError(err).Warn("influxdb rejected batch, writing samples one at a time")
+
+		for i := range samples {
+			if !w.deliver(ctx, samples[i:i+1], lines[i:i+1]) {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	logrus.WithError(err).WithField("samples", len(samples)).Error("failed to write samples")
+	for _, s := range samples {
+		w.store(s, err)
+	}
+
+	return true
+}
+
+func (w *Writer) store(s ingester.Sample, reason error) {
+	if w.deadLetter == nil {
+		return
+	}
+
+	err := w.deadLetter.Store(s, reason)
+	if err != nil {
+		logrus.WithError(err).Error("failed to store dead letter")
+	}
+}
+
+func (w *Writer) send(ctx context.Context, body []byte) error {
+	logrus.WithField("data", string(body)).Debug("writing samples")
+
+	headers := http.Header{}
+	headers.Set("Content-Type", "text/plain; charset=utf-8")
+	if w.gzip {
+		headers.Set("Content-Encoding", "gzip")
+	}
+
+	if w.token != "" {
+		headers.Set("Authorization", "Token "+w.token)
+	} else if w.username != "" {
+		headers.Set("Authorization", ingester.BasicAuth(w.username, w.password))
+	}
+
+	data, err := ingester.PostBody(ctx, w.client, w.url, body, headers)
+	var statusErr *ingester.StatusError
+	if errors.As(err, &statusErr) {
+		statusErr.Message = message(data)
+	}
+
+	return err
+}
+
+// message picks the reason out of an error response, 1.x calls it error and
+// 2.x message
+func message(data []byte) string {
+	var body struct {
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	}
+
+	err := json.Unmarshal(data, &body)
+	if err != nil {
+		return string(bytes.TrimSpace(data))
+	}
+
+	if body.Message != "" {
+		return body.Message
+	}
+
+	return body.Error
+}
+
+// rejected reports whether the server refused some of the points or the size
+// of the batch
+func rejected(err error) bool {
+	var statusErr *ingester.StatusError
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+
+	return statusErr.StatusCode == http.StatusBadRequest ||
+		statusErr.StatusCode == http.StatusRequestEntityTooLarge
+}
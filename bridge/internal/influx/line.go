@@ -0,0 +1,109 @@
+package influx
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
+)
+
+// integers are the metrics written as integer fields, a field's type can't
+// change once InfluxDB has seen it
+var integers = map[string]bool{
+	ingester.MetricBattery: true,
+	ingester.MetricRssi:    true,
+}
+
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`)
+	keyEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+)
+
+// line encodes the sample as a line protocol point with a field per metric.
+// Samples without any metrics encode to nothing, a point needs a field.
+func (w *Writer) line(s ingester.Sample) ([]byte, error) {
+	fields := fields(s)
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	var b strings.Builder
+
+	b.WriteString(measurementEscaper.Replace(w.measurement))
+
+	// tags are sorted by key as InfluxDB prefers, empty values aren't allowed
+	for _, tag := range [][2]string{
+		{"collector", s.Collector},
+		{"device", s.Device},
+		{"plant", s.Plant},
+		{"zone", s.Zone},
+	} {
+		if tag[1] == "" {
+			continue
+		}
+
+		b.WriteByte(',')
+		b.WriteString(tag[0])
+		b.WriteByte('=')
+		b.WriteString(keyEscaper.Replace(tag[1]))
+	}
+
+	for i, field := range fields {
+		if i == 0 {
+			b.WriteByte(' ')
+		} else {
+			b.WriteByte(',')
+		}
+
+		b.WriteString(keyEscaper.Replace(field[0]))
+		b.WriteByte('=')
+		b.WriteString(field[1])
+	}
+
+	if !s.Time.IsZero() {
+		b.WriteByte(' ')
+		b.WriteString(strconv.FormatInt(s.Time.UnixNano()/int64(w.precision.unit), 10))
+	}
+
+	b.WriteByte('\n')
+
+	return []byte(b.String()), nil
+}
+
+// fields returns the sample's metrics as field keys and values, readings
+// flagged by validation are left out. Downsampled samples also get the min,
+// max and count of each metric's window.
+func fields(s ingester.Sample) [][2]string {
+	var fields [][2]string
+
+	for _, metric := range ingester.Metrics {
+		value, ok := s.Value(metric)
+		if !ok {
+			continue
+		}
+		if _, flagged := s.Quality[metric]; flagged {
+			continue
+		}
+
+		if integers[metric] {
+			// downsampled means are rounded rather than truncated
+			fields = append(fields, [2]string{metric, strconv.FormatInt(int64(math.Round(value)), 10) + "i"})
+		} else {
+			fields = append(fields, [2]string{metric, strconv.FormatFloat(value, 'f', -1, 32)})
+		}
+
+		stats, ok := s.Stats[metric]
+		if !ok {
+			continue
+		}
+
+		fields = append(fields,
+			[2]string{metric + "_min", strconv.FormatFloat(stats.Min, 'f', -1, 64)},
+			[2]string{metric + "_max", strconv.FormatFloat(stats.Max, 'f', -1, 64)},
+			[2]string{metric + "_count", strconv.Itoa(stats.Count) + "i"},
+		)
+	}
+
+	return fields
+}
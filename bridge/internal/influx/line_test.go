@@ -0,0 +1,104 @@
+package influx
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ryanrolds/plant-collector/bridge/internal/config"
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
+	"github.com/stretchr/testify/assert"
+)
+
+func float(v float32) *float32 {
+	return &v
+}
+
+func integer(v int) *int {
+	return &v
+}
+
+func TestLine(t *testing.T) {
+	start := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		precision string
+		sample    ingester.Sample
+		expected  string
+	}{
+		{
+			sample: ingester.Sample{
+				Time:        start,
+				Collector:   "bridge-1",
+				Plant:       "monstera",
+				Zone:        "tent",
+				Device:      "C4:7C:8D:6A:3D:72",
+				Temperature: float(21.3),
+				Moisture:    float(40),
+				Battery:     integer(87),
+				Rssi:        integer(-71),
+			},
+			expected: "plant,collector=bridge-1,device=C4:7C:8D:6A:3D:72,plant=monstera,zone=tent temp=21.3,moist=40,battery=87i,rssi=-71i 1667304000000\n",
+		},
+		{
+			precision: "s",
+			sample: ingester.Sample{
+				Time:      start,
+				Collector: "bridge 1",
+				Plant:     "fern,small=yes",
+				Moisture:  float(55),
+			},
+			expected: "plant,collector=bridge\\ 1,plant=fern\\,small\\=yes moist=55 1667304000\n",
+		},
+		{
+			precision: "ns",
+			sample: ingester.Sample{
+				Time:        start.Add(time.Millisecond),
+				Plant:       "fern",
+				Temperature: float(22),
+				Window:      "5m0s",
+				Stats: map[string]ingester.Stats{
+					ingester.MetricTemperature: {Min: 20, Max: 24.5, Mean: 22, Last: 23, Count: 5},
+				},
+			},
+			expected: "plant,plant=fern temp=22,temp_min=20,temp_max=24.5,temp_count=5i 1667304000001000000\n",
+		},
+		{
+			sample: ingester.Sample{
+				Time:    start,
+				Plant:   "fern",
+				Battery: integer(87),
+				Window:  "5m0s",
+				Stats: map[string]ingester.Stats{
+					ingester.MetricBattery: {Min: 86, Max: 88, Mean: 86.6, Last: 86, Count: 5},
+				},
+			},
+			expected: "plant,plant=fern battery=87i,battery_min=86,battery_max=88,battery_count=5i 1667304000000\n",
+		},
+		{
+			sample:   ingester.Sample{Plant: "fern", Moisture: float(55)},
+			expected: "plant,plant=fern moist=55\n",
+		},
+		{
+			sample: ingester.Sample{
+				Plant:       "fern",
+				Temperature: float(655.35),
+				Moisture:    float(55),
+				Quality:     map[string]string{ingester.MetricTemperature: "out_of_range"},
+			},
+			expected: "plant,plant=fern moist=55\n",
+		},
+		{
+			sample:   ingester.Sample{Time: start, Plant: "fern"},
+			expected: "",
+		},
+	}
+
+	for _, test := range tests {
+		w, err := NewWriter(config.Influx{URL: "http://localhost:8086", Bucket: "plants", Precision: test.precision})
+		assert.Nil(t, err)
+
+		line, err := w.line(test.sample)
+		assert.Nil(t, err)
+		assert.Equal(t, test.expected, string(line))
+	}
+}
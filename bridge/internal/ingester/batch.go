@@ -0,0 +1,202 @@
+package ingester
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/ryanrolds/plant-collector/bridge/internal/config"
+)
+
+// Batch body formats
+const (
+	FormatJSON   = "json"
+	FormatNDJSON = "ndjson"
+)
+
+const (
+	defaultBatchBytes   = 256 << 10
+	defaultBatchLatency = 5 * time.Second
+)
+
+// BatchPolicy controls how samples are grouped into a single request
+type BatchPolicy struct {
+	// MaxSamples of 0 or 1 sends every sample on its own
+	MaxSamples int
+	MaxBytes   int
+	MaxLatency time.Duration
+	Format     string
+}
+
+func NewBatchPolicy(cfg config.Batch) (BatchPolicy, error) {
+	policy := BatchPolicy{
+		MaxSamples: cfg.MaxSamples,
+		MaxBytes:   cfg.MaxBytes,
+		MaxLatency: cfg.MaxLatency,
+		Format:     cfg.Format,
+	}
+
+	if policy.MaxBytes == 0 {
+		policy.MaxBytes = defaultBatchBytes
+	}
+	if policy.MaxLatency == 0 {
+		policy.MaxLatency = defaultBatchLatency
+	}
+	if policy.Format == "" {
+		policy.Format = FormatJSON
+	}
+
+	if policy.Format != FormatJSON && policy.Format != FormatNDJSON {
+		return BatchPolicy{}, fmt.Errorf("unknown batch format %q", policy.Format)
+	}
+
+	return policy, nil
+}
+
+// Enabled reports whether samples are batched
+func (p BatchPolicy) Enabled() bool {
+	return p.MaxSamples > 1
+}
+
+// Encoder turns a sample into the bytes a sink sends, batches are sized by
+// the encoded samples
+type Encoder func(s Sample) ([]byte, error)
+
+// EncodeJSON is the ingester's encoding
+func EncodeJSON(s Sample) ([]byte, error) {
+	return json.Marshal(s)
+}
+
+// Batch holds samples collected for one request along with their encoding
+type Batch struct {
+	Samples []Sample
+	Encoded [][]byte
+	Size    int
+}
+
+func (b *Batch) add(s Sample, encode Encoder) error {
+	encoded, err := encode(s)
+	if err != nil {
+		return err
+	}
+
+	b.Samples = append(b.Samples, s)
+	b.Encoded = append(b.Encoded, encoded)
+	b.Size += len(encoded)
+
+	return nil
+}
+
+// Collect waits for a sample and then gathers more until the batch is full or
+// the oldest sample has waited for the maximum latency
+func (p BatchPolicy) Collect(ctx context.Context, source Source, encode Encoder) (*Batch, error) {
+	b := &Batch{}
+
+	s, err := source.Next(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = b.add(s, encode)
+	if err != nil {
+		return nil, err
+	}
+
+	if !p.Enabled() {
+		return b, nil
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, p.MaxLatency)
+	defer cancel()
+
+	for len(b.Samples) < p.MaxSamples && b.Size < p.MaxBytes {
+		s, err := source.Next(waitCtx)
+		if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) || errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return b, err
+		}
+
+		err = b.add(s, encode)
+		if err != nil {
+			return b, err
+		}
+	}
+
+	return b, nil
+}
+
+// body encodes the batch as a JSON array or newline delimited JSON
+func (p BatchPolicy) body(b *Batch) ([]byte, string) {
+	var buf bytes.Buffer
+
+	if p.Format == FormatNDJSON {
+		for _, encoded := range b.Encoded {
+			buf.Write(encoded)
+			buf.WriteByte('\n')
+		}
+
+		return buf.Bytes(), "application/x-ndjson"
+	}
+
+	buf.WriteByte('[')
+	for i, encoded := range b.Encoded {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.Write(encoded)
+	}
+	buf.WriteByte(']')
+
+	return buf.Bytes(), "application/json; charset=UTF-8"
+}
+
+// split halves the batch
+func (b *Batch) split() (*Batch, *Batch) {
+	half := len(b.Samples) / 2
+	first := &Batch{Samples: b.Samples[:half], Encoded: b.Encoded[:half]}
+	second := &Batch{Samples: b.Samples[half:], Encoded: b.Encoded[half:]}
+
+	for _, encoded := range first.Encoded {
+		first.Size += len(encoded)
+	}
+	second.Size = b.Size - first.Size
+
+	return first, second
+}
+
+// batchUnsupported reports whether the endpoint doesn't accept batches at all
+func batchUnsupported(err error) bool {
+	return hasStatus(err, http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusUnsupportedMediaType)
+}
+
+// batchTooLarge reports whether the batch should be sent as smaller batches
+func batchTooLarge(err error) bool {
+	return hasStatus(err, http.StatusRequestEntityTooLarge)
+}
+
+// batchInvalid reports whether the ingester rejected a sample in the batch
+func batchInvalid(err error) bool {
+	return hasStatus(err, http.StatusBadRequest, http.StatusUnprocessableEntity)
+}
+
+func hasStatus(err error, codes ...int) bool {
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+
+	for _, code := range codes {
+		if statusErr.StatusCode == code {
+			return true
+		}
+	}
+
+	return false
+}
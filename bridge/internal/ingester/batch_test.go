@@ -0,0 +1,191 @@
+package ingester
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ryanrolds/plant-collector/bridge/internal/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// sliceSource hands out samples from a slice and then waits for cancellation
+type sliceSource struct {
+	samples []Sample
+	next    int
+	acked   int
+}
+
+func (s *sliceSource) Next(ctx context.Context) (Sample, error) {
+	if s.next < len(s.samples) {
+		s.next++
+		return s.samples[s.next-1], nil
+	}
+
+	<-ctx.Done()
+	return Sample{}, ctx.Err()
+}
+
+func (s *sliceSource) Ack() error {
+	s.acked = s.next
+	return nil
+}
+
+// recordingServer keeps the samples of every request it accepts. Batches are
+// rejected with batchStatus when it's set, or with 413 when larger than
+// maxBatch.
+type recordingServer struct {
+	mu          sync.Mutex
+	requests    [][]Sample
+	batchStatus int
+	maxBatch    int
+}
+
+func (r *recordingServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var body io.Reader = req.Body
+	if req.Header.Get("Content-Encoding") == "gzip" {
+		reader, err := gzip.NewReader(req.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body = reader
+	}
+
+	var samples []Sample
+	switch req.Header.Get("Content-Type") {
+	case "application/x-ndjson":
+		scanner := bufio.NewScanner(body)
+		for scanner.Scan() {
+			var s Sample
+			_ = json.Unmarshal(scanner.Bytes(), &s)
+			samples = append(samples, s)
+		}
+	default:
+		data, _ := io.ReadAll(body)
+		if data[0] == '[' {
+			if r.batchStatus != 0 {
+				w.WriteHeader(r.batchStatus)
+				return
+			}
+			_ = json.Unmarshal(data, &samples)
+			if r.maxBatch != 0 && len(samples) > r.maxBatch {
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				return
+			}
+		} else {
+			var s Sample
+			_ = json.Unmarshal(data, &s)
+			samples = append(samples, s)
+		}
+	}
+
+	r.mu.Lock()
+	r.requests = append(r.requests, samples)
+	r.mu.Unlock()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func sendAll(t *testing.T, recorder *recordingServer, batch BatchPolicy, gzip bool, plants ...string) (*Ingester, *sliceSource) {
+	server := httptest.NewServer(recorder)
+	t.Cleanup(server.Close)
+
+	source := &sliceSource{}
+	for _, plant := range plants {
+		source.samples = append(source.samples, Sample{Plant: plant})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	i := NewIngester(server.URL, Options{Retry: testRetry, Batch: batch, Gzip: gzip})
+	assert.Nil(t, i.SendAll(ctx, source))
+
+	return i, source
+}
+
+func TestSendAllBatches(t *testing.T) {
+	recorder := &recordingServer{}
+	batch := BatchPolicy{MaxSamples: 2, MaxBytes: 1 << 10, MaxLatency: 10 * time.Millisecond, Format: FormatJSON}
+
+	_, source := sendAll(t, recorder, batch, true, "a", "b", "c")
+
+	assert.Equal(t, 3, source.acked)
+	assert.Len(t, recorder.requests, 2)
+	assert.Equal(t, "a", recorder.requests[0][0].Plant)
+	assert.Equal(t, "b", recorder.requests[0][1].Plant)
+	assert.Equal(t, "c", recorder.requests[1][0].Plant)
+}
+
+func TestSendAllNDJSON(t *testing.T) {
+	recorder := &recordingServer{}
+	batch := BatchPolicy{MaxSamples: 10, MaxBytes: 1 << 10, MaxLatency: 10 * time.Millisecond, Format: FormatNDJSON}
+
+	sendAll(t, recorder, batch, false, "a", "b")
+
+	assert.Len(t, recorder.requests, 1)
+	assert.Len(t, recorder.requests[0], 2)
+}
+
+func TestSendAllRejectedBatches(t *testing.T) {
+	tests := []struct {
+		name     string
+		recorder *recordingServer
+		requests [][]string
+		singles  bool
+	}{
+		{
+			name:     "batches unsupported",
+			recorder: &recordingServer{batchStatus: http.StatusNotFound},
+			requests: [][]string{{"a"}, {"b"}, {"c"}, {"d"}},
+			singles:  true,
+		},
+		{
+			name:     "invalid sample",
+			recorder: &recordingServer{batchStatus: http.StatusUnprocessableEntity},
+			requests: [][]string{{"a"}, {"b"}, {"c"}, {"d"}},
+		},
+		{
+			name:     "too large",
+			recorder: &recordingServer{maxBatch: 2},
+			requests: [][]string{{"a", "b"}, {"c", "d"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			batch := BatchPolicy{MaxSamples: 10, MaxBytes: 1 << 10, MaxLatency: 10 * time.Millisecond, Format: FormatJSON}
+
+			i, source := sendAll(t, test.recorder, batch, false, "a", "b", "c", "d")
+
+			assert.Equal(t, 4, source.acked)
+			assert.Equal(t, test.singles, i.singles)
+
+			requests := make([][]string, len(test.recorder.requests))
+			for idx, samples := range test.recorder.requests {
+				for _, s := range samples {
+					requests[idx] = append(requests[idx], s.Plant)
+				}
+			}
+			assert.Equal(t, test.requests, requests)
+		})
+	}
+}
+
+func TestNewBatchPolicy(t *testing.T) {
+	policy, err := NewBatchPolicy(config.Batch{})
+	assert.Nil(t, err)
+	assert.False(t, policy.Enabled())
+	assert.Equal(t, FormatJSON, policy.Format)
+
+	_, err = NewBatchPolicy(config.Batch{MaxSamples: 10, Format: "xml"})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,68 @@
+package ingester
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// DeadLetter keeps samples the ingester permanently rejected so they can be
+// inspected and replayed by hand
+type DeadLetter interface {
+	Store(s Sample, reason error) error
+}
+
+type deadLetterEntry struct {
+	Time   time.Time `json:"time"`
+	Reason string    `json:"reason"`
+	Status int       `json:"status,omitempty"`
+	Sample Sample    `json:"sample"`
+}
+
+// FileDeadLetter appends dead letters to a newline delimited JSON file
+type FileDeadLetter struct {
+	path string
+	mu   sync.Mutex
+}
+
+func NewFileDeadLetter(path string) *FileDeadLetter {
+	return &FileDeadLetter{
+		path: path,
+	}
+}
+
+func (d *FileDeadLetter) Store(s Sample, reason error) error {
+	entry := deadLetterEntry{
+		Time:   time.Now(),
+		Reason: reason.Error(),
+		Sample: s,
+	}
+
+	var statusErr *StatusError
+	if errors.As(reason, &statusErr) {
+		entry.Status = statusErr.StatusCode
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	file, err := os.OpenFile(d.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(append(line, '\n'))
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
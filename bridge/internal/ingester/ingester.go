@@ -1,9 +1,9 @@
 package ingester
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
 	"time"
 
@@ -11,74 +11,207 @@ import (
 )
 
 type Sample struct {
-	Time         time.Time `json:"time"`
-	Collector    string    `json:"collector"`
-	Plant        string    `json:"plant"`
-	Temperature  *float32  `json:"temp"`
-	Light        *float32  `json:"light"`
-	Moisture     *float32  `json:"moist"`
-	Conductivity *float32  `json:"cond"`
-	Humidity     *float32  `json:"humid"`
-	Battery      *int      `json:"battery"`
-	Rssi         *int      `json:"rssi"`
-	FrameCounter *int      `json:"frame_counter"`
+	Time           time.Time `json:"time"`
+	Collector      string    `json:"collector"`
+	Site           string    `json:"site,omitempty"`
+	Location       string    `json:"location,omitempty"`
+	Plant          string    `json:"plant"`
+	PlantName      string    `json:"plant_name,omitempty"`
+	Zone           string    `json:"zone,omitempty"`
+	Device         string    `json:"device"`
+	DeviceType     string    `json:"device_type,omitempty"`
+	Temperature    *float32  `json:"temp"`
+	Light          *float32  `json:"light"`
+	Moisture       *float32  `json:"moist"`
+	Conductivity   *float32  `json:"cond"`
+	Humidity       *float32  `json:"humid"`
+	Battery        *int      `json:"battery"`
+	BatteryVoltage *float32  `json:"battery_voltage,omitempty"` // volts
+	VPD            *float32  `json:"vpd,omitempty"`             // kPa
+	DewPoint       *float32  `json:"dew_point,omitempty"`       // °C
+	PPFD           *float32  `json:"ppfd,omitempty"`            // µmol/m²/s
+	DLI            *float32  `json:"dli,omitempty"`             // mol/m²/day
+	Rssi           *int      `json:"rssi"`
+	FrameCounter   *int      `json:"frame_counter"`
+	// Firmware is the sensor's firmware version, when it reports it
+	Firmware string `json:"firmware,omitempty"`
+	// Window and Stats are set on downsampled samples, Stats is keyed by metric
+	Window string           `json:"window,omitempty"`
+	Stats  map[string]Stats `json:"stats,omitempty"`
+	// Quality flags readings that failed validation, keyed by metric
+	Quality map[string]string `json:"quality,omitempty"`
 }
 
 const timeout = 10 * time.Second
 
 type Ingester struct {
-	url    string
-	client *http.Client
+	url        string
+	client     *http.Client
+	retry      RetryPolicy
+	batch      BatchPolicy
+	gzip       bool
+	deadLetter DeadLetter
+	// singles is set once the ingester has shown it doesn't accept batches
+	singles bool
 }
 
-func NewIngester(url string) *Ingester {
+type Options struct {
+	Retry RetryPolicy
+	Batch BatchPolicy
+	// Gzip compresses request bodies
+	Gzip       bool
+	DeadLetter DeadLetter
+}
+
+func NewIngester(url string, opts Options) *Ingester {
 	return &Ingester{
 		url: url,
 		client: &http.Client{
 			Timeout: timeout,
 		},
+		retry:      opts.Retry,
+		batch:      opts.Batch,
+		gzip:       opts.Gzip,
+		deadLetter: opts.DeadLetter,
 	}
 }
 
-func (i *Ingester) SendAll(ctx context.Context, c <-chan Sample) error {
+// Source supplies the samples to send, Next returns io.EOF when there won't
+// be any more. Ack acknowledges the samples returned by Next once they have
+// been delivered or dead-lettered.
+type Source interface {
+	Next(ctx context.Context) (Sample, error)
+	Ack() error
+}
+
+// SendAll sends samples from the source until it returns io.EOF or the
+// context is cancelled
+func (i *Ingester) SendAll(ctx context.Context, source Source) error {
 	logrus.Debug("starting to sending samples")
 
 	for {
-		select {
-		case <-ctx.Done():
+		b, err := i.batch.Collect(ctx, source, EncodeJSON)
+		if ctx.Err() != nil {
 			logrus.Debug("ingester context cancelled")
 			return nil
-		case m := <-c:
-			err := i.send(m)
-			if err != nil {
-				logrus.Error(err)
-			}
+		}
+		if errors.Is(err, io.EOF) {
+			logrus.Debug("all samples sent")
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if !i.deliverBatch(ctx, b) {
+			logrus.Debug("ingester context cancelled")
+			return nil
+		}
+
+		err = source.Ack()
+		if err != nil {
+			logrus.WithError(err).Error("failed to acknowledge samples")
 		}
 	}
 }
 
-func (i *Ingester) send(m Sample) error {
-	logrus.Debugf("sending sample %v", m)
+// deliverBatch sends a batch in one request. A batch that's too large is split
+// in half, one with invalid samples is sent again one sample at a time so only
+// the bad ones are dead-lettered. Batching is turned off when the endpoint
+// doesn't accept batches. Returns false when interrupted by shutdown.
+func (i *Ingester) deliverBatch(ctx context.Context, b *Batch) bool {
+	if len(b.Samples) == 1 || i.singles {
+		return i.deliverSingles(ctx, b)
+	}
 
-	jsonData, err := json.Marshal(m)
-	if err != nil {
-		return err
+	body, contentType := i.batch.body(b)
+	err := i.retry.Do(ctx, func() error {
+		return i.send(ctx, body, contentType)
+	})
+	if err == nil {
+		return true
 	}
 
-	logrus.WithField("data", string(jsonData)).Debug("sending sample")
+	if ctx.Err() != nil {
+		logrus.WithError(err).Warn("batch not sent before shutdown")
+		return false
+	}
 
-	request, err := http.NewRequest("POST", i.url, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return err
+	switch {
+	case batchUnsupported(err):
+		logrus.WithError(err).Warn("ingester doesn't accept batches, falling back to single samples")
+		i.singles = true
+		return i.deliverSingles(ctx, b)
+	case batchTooLarge(err):
+		logrus.WithError(err).WithField("samples", len(b.Samples)).Warn("ingester rejected batch as too large, splitting it")
+		first, second := b.split()
+		return i.deliverBatch(ctx, first) && i.deliverBatch(ctx, second)
+	case batchInvalid(err):
+		logrus.WithError(err).Warn("ingester rejected batch, sending its samples one at a time")
+		return i.deliverSingles(ctx, b)
+	}
+
+	logrus.WithError(err).WithField("samples", len(b.Samples)).Error("failed to send batch")
+	for _, m := range b.Samples {
+		i.store(m, err)
 	}
 
-	request.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	return true
+}
+
+// deliverSingles sends the batch's samples one per request
+func (i *Ingester) deliverSingles(ctx context.Context, b *Batch) bool {
+	for idx, m := range b.Samples {
+		if !i.deliver(ctx, m, b.Encoded[idx]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// deliver sends a sample, retrying transient failures. Samples rejected
+// permanently are sent to the dead letter store. Returns false when interrupted
+// by shutdown, the sample is left to be sent again.
+func (i *Ingester) deliver(ctx context.Context, m Sample, encoded []byte) bool {
+	err := i.retry.Do(ctx, func() error {
+		return i.send(ctx, encoded, "application/json; charset=UTF-8")
+	})
+	if err == nil {
+		return true
+	}
+
+	if ctx.Err() != nil {
+		logrus.WithError(err).Warn("sample not sent before shutdown")
+		return false
+	}
 
-	resp, err := i.client.Do(request)
+	logrus.WithError(err).WithField("plant", m.Plant).Error("failed to send sample")
+	i.store(m, err)
+
+	return true
+}
+
+func (i *Ingester) store(m Sample, reason error) {
+	if i.deadLetter == nil {
+		return
+	}
+
+	err := i.deadLetter.Store(m, reason)
 	if err != nil {
-		return err
+		logrus.WithError(err).Error("failed to store dead letter")
+	}
+}
+
+func (i *Ingester) send(ctx context.Context, body []byte, contentType string) error {
+	logrus.WithField("data", string(body)).Debug("sending samples")
+
+	headers := http.Header{}
+	headers.Set("Content-Type", contentType)
+	if i.gzip {
+		headers.Set("Content-Encoding", "gzip")
 	}
-	resp.Body.Close()
 
-	return nil
+	_, err := PostBody(ctx, i.client, i.url, body, headers)
+	return err
 }
@@ -0,0 +1,184 @@
+package ingester
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type memoryDeadLetter struct {
+	mu      sync.Mutex
+	samples []Sample
+	reasons []error
+}
+
+func (d *memoryDeadLetter) Store(s Sample, reason error) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.samples = append(d.samples, s)
+	d.reasons = append(d.reasons, reason)
+	return nil
+}
+
+var testRetry = RetryPolicy{
+	InitialBackoff: time.Millisecond,
+	MaxBackoff:     5 * time.Millisecond,
+}
+
+func testServer(t *testing.T, statuses ...int) (*httptest.Server, *int) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := statuses[len(statuses)-1]
+		if requests < len(statuses) {
+			status = statuses[requests]
+		}
+		requests++
+
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &requests
+}
+
+func TestDeliverRetriesTransient(t *testing.T) {
+	server, requests := testServer(t, http.StatusInternalServerError, http.StatusTooManyRequests, http.StatusNoContent)
+	deadLetter := &memoryDeadLetter{}
+
+	i := NewIngester(server.URL, Options{Retry: testRetry, DeadLetter: deadLetter})
+	i.deliver(context.Background(), Sample{Plant: "fern"}, []byte(`{"plant":"fern"}`))
+
+	assert.Equal(t, 3, *requests)
+	assert.Len(t, deadLetter.samples, 0)
+}
+
+func TestDeliverObservesAttempts(t *testing.T) {
+	server, _ := testServer(t, http.StatusInternalServerError, http.StatusNoContent)
+
+	var failures, successes int
+	ctx := WithAttemptObserver(context.Background(), func(took time.Duration, err error) {
+		if err != nil {
+			failures++
+			return
+		}
+		successes++
+	})
+
+	i := NewIngester(server.URL, Options{Retry: testRetry})
+	i.deliver(ctx, Sample{Plant: "fern"}, []byte(`{"plant":"fern"}`))
+
+	assert.Equal(t, 1, failures)
+	assert.Equal(t, 1, successes)
+}
+
+func TestDeliverPermanentFailure(t *testing.T) {
+	server, requests := testServer(t, http.StatusBadRequest)
+	deadLetter := &memoryDeadLetter{}
+
+	i := NewIngester(server.URL, Options{Retry: testRetry, DeadLetter: deadLetter})
+	i.deliver(context.Background(), Sample{Plant: "fern"}, []byte(`{"plant":"fern"}`))
+
+	assert.Equal(t, 1, *requests)
+	assert.Len(t, deadLetter.samples, 1)
+
+	var statusErr *StatusError
+	assert.True(t, errors.As(deadLetter.reasons[0], &statusErr))
+	assert.Equal(t, http.StatusBadRequest, statusErr.StatusCode)
+}
+
+func TestSendAllOutage(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the ingester is down for longer than the old limit of 10 attempts, the
+	// bridge shuts down before it recovers
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 25 {
+			cancel()
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	deadLetter := &memoryDeadLetter{}
+	source := &sliceSource{samples: []Sample{{Plant: "fern"}}}
+
+	i := NewIngester(server.URL, Options{Retry: testRetry, DeadLetter: deadLetter})
+	assert.Nil(t, i.SendAll(ctx, source))
+
+	assert.GreaterOrEqual(t, requests, 25)
+	assert.Equal(t, 0, source.acked)
+	assert.Len(t, deadLetter.samples, 0)
+}
+
+func TestDeliverConnectionRefused(t *testing.T) {
+	server, _ := testServer(t, http.StatusNoContent)
+	url := server.URL
+	server.Close()
+
+	err := NewIngester(url, Options{}).send(context.Background(), []byte("{}"), "application/json")
+	assert.NotNil(t, err)
+	assert.True(t, IsTransient(err))
+}
+
+func TestDeliverPermanentTransportErrors(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name string
+		url  string
+	}{
+		{name: "untrusted certificate", url: server.URL},
+		{name: "unsupported scheme", url: "ftp://ingester.example.com/samples"},
+		{name: "malformed url", url: "http://[::1/samples"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			deadLetter := &memoryDeadLetter{}
+
+			i := NewIngester(test.url, Options{Retry: testRetry, DeadLetter: deadLetter})
+			err := i.send(context.Background(), []byte("{}"), "application/json")
+			assert.NotNil(t, err)
+			assert.False(t, IsTransient(err))
+
+			// dead lettered rather than retried
+			i.deliver(context.Background(), Sample{Plant: "fern"}, []byte(`{"plant":"fern"}`))
+			assert.Len(t, deadLetter.samples, 1)
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+
+	assert.Equal(t, 30*time.Second, ParseRetryAfter("30", now))
+	assert.Equal(t, time.Minute, ParseRetryAfter("Tue, 01 Nov 2022 12:01:00 GMT", now))
+	assert.Equal(t, time.Duration(0), ParseRetryAfter("soon", now))
+	assert.Equal(t, time.Duration(0), ParseRetryAfter("", now))
+}
+
+func TestBackoff(t *testing.T) {
+	policy := RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 10 * time.Second}
+
+	for attempt, ceiling := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second} {
+		delay := policy.backoff(attempt+1, errors.New("timeout"))
+		assert.GreaterOrEqual(t, delay, ceiling/2)
+		assert.LessOrEqual(t, delay, ceiling)
+	}
+
+	delay := policy.backoff(1, &StatusError{StatusCode: http.StatusTooManyRequests, RetryAfter: time.Minute})
+	assert.Equal(t, time.Minute, delay)
+}
@@ -0,0 +1,32 @@
+// Package ingestertest has helpers for testing sinks
+package ingestertest
+
+import (
+	"context"
+	"io"
+
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
+)
+
+// SliceSource is an ingester.Source handing out samples from a slice, Next
+// returns io.EOF once they've all been read
+type SliceSource struct {
+	Samples []ingester.Sample
+	// Acked is how many samples have been acknowledged
+	Acked int
+	next  int
+}
+
+func (s *SliceSource) Next(ctx context.Context) (ingester.Sample, error) {
+	if s.next == len(s.Samples) {
+		return ingester.Sample{}, io.EOF
+	}
+
+	s.next++
+	return s.Samples[s.next-1], nil
+}
+
+func (s *SliceSource) Ack() error {
+	s.Acked = s.next
+	return nil
+}
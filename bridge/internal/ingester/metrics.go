@@ -0,0 +1,145 @@
+package ingester
+
+// Metric names, they match the sample's JSON fields
+const (
+	MetricTemperature    = "temp"
+	MetricLight          = "light"
+	MetricMoisture       = "moist"
+	MetricConductivity   = "cond"
+	MetricHumidity       = "humid"
+	MetricBattery        = "battery"
+	MetricBatteryVoltage = "battery_voltage"
+	MetricVPD            = "vpd"
+	MetricDewPoint       = "dew_point"
+	MetricPPFD           = "ppfd"
+	MetricDLI            = "dli"
+	MetricRssi           = "rssi"
+)
+
+// Metrics lists every measurement a sample can carry
+var Metrics = []string{
+	MetricTemperature,
+	MetricLight,
+	MetricMoisture,
+	MetricConductivity,
+	MetricHumidity,
+	MetricBattery,
+	MetricBatteryVoltage,
+	MetricVPD,
+	MetricDewPoint,
+	MetricPPFD,
+	MetricDLI,
+	MetricRssi,
+}
+
+// Stats summarise a metric over a downsampling window
+type Stats struct {
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Mean  float64 `json:"mean"`
+	Last  float64 `json:"last"`
+	Count int     `json:"count"`
+}
+
+// IsMetric reports whether the name is a known metric
+func IsMetric(name string) bool {
+	for _, metric := range Metrics {
+		if name == metric {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *Sample) floatField(metric string) **float32 {
+	switch metric {
+	case MetricTemperature:
+		return &s.Temperature
+	case MetricLight:
+		return &s.Light
+	case MetricMoisture:
+		return &s.Moisture
+	case MetricConductivity:
+		return &s.Conductivity
+	case MetricHumidity:
+		return &s.Humidity
+	case MetricBatteryVoltage:
+		return &s.BatteryVoltage
+	case MetricVPD:
+		return &s.VPD
+	case MetricDewPoint:
+		return &s.DewPoint
+	case MetricPPFD:
+		return &s.PPFD
+	case MetricDLI:
+		return &s.DLI
+	}
+
+	return nil
+}
+
+func (s *Sample) intField(metric string) **int {
+	switch metric {
+	case MetricBattery:
+		return &s.Battery
+	case MetricRssi:
+		return &s.Rssi
+	}
+
+	return nil
+}
+
+// Value returns the value of a metric, false if the sample doesn't have it
+func (s *Sample) Value(metric string) (float64, bool) {
+	if field := s.floatField(metric); field != nil && *field != nil {
+		return float64(**field), true
+	}
+
+	if field := s.intField(metric); field != nil && *field != nil {
+		return float64(**field), true
+	}
+
+	return 0, false
+}
+
+// SetValue sets a metric, integer metrics are rounded
+func (s *Sample) SetValue(metric string, value float64) {
+	if field := s.floatField(metric); field != nil {
+		v := float32(value)
+		*field = &v
+		return
+	}
+
+	if field := s.intField(metric); field != nil {
+		v := int(value + 0.5)
+		if value < 0 {
+			v = int(value - 0.5)
+		}
+		*field = &v
+	}
+}
+
+// ClearValue removes a metric from the sample
+func (s *Sample) ClearValue(metric string) {
+	if field := s.floatField(metric); field != nil {
+		*field = nil
+		return
+	}
+
+	if field := s.intField(metric); field != nil {
+		*field = nil
+	}
+}
+
+// Values returns the metrics the sample has
+func (s *Sample) Values() map[string]float64 {
+	values := make(map[string]float64)
+	for _, metric := range Metrics {
+		if value, ok := s.Value(metric); ok {
+			values[metric] = value
+		}
+	}
+
+	return values
+}
@@ -0,0 +1,77 @@
+package ingester
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// maxResponse limits how much of a successful response is read
+	maxResponse = 64 << 10
+	// maxMessage limits how much of an error response is read
+	maxMessage = 1 << 10
+)
+
+// PostBody POSTs the body with the headers and returns the response body. The
+// body is gzipped when the Content-Encoding header is gzip. Responses outside
+// 2xx are returned as a *StatusError with the response body as its message,
+// the body is returned too so callers can pick a better message out of it.
+func PostBody(ctx context.Context, client *http.Client, url string, body []byte, headers http.Header) ([]byte, error) {
+	if headers.Get("Content-Encoding") == "gzip" {
+		var buf bytes.Buffer
+		writer := gzip.NewWriter(&buf)
+		_, err := writer.Write(body)
+		if err != nil {
+			return nil, err
+		}
+
+		err = writer.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		body = buf.Bytes()
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	for key, values := range headers {
+		request.Header[key] = values
+	}
+
+	resp, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		data, err := io.ReadAll(io.LimitReader(resp.Body, maxResponse))
+		// drain the body so the connection can be reused
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return data, err
+	}
+
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, maxMessage))
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	return data, &StatusError{
+		StatusCode: resp.StatusCode,
+		RetryAfter: ParseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+		Message:    strings.TrimSpace(string(data)),
+	}
+}
+
+// BasicAuth returns the Authorization header value for basic auth
+func BasicAuth(username, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+}
@@ -0,0 +1,55 @@
+package ingester
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPostBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		assert.Equal(t, "gzip", r.Header.Get("Content-Encoding"))
+
+		reader, err := gzip.NewReader(r.Body)
+		assert.Nil(t, err)
+		body, err := io.ReadAll(reader)
+		assert.Nil(t, err)
+		assert.Equal(t, `{"plant":"fern"}`, string(body))
+
+		_, _ = w.Write([]byte("accepted"))
+	}))
+	defer server.Close()
+
+	headers := http.Header{}
+	headers.Set("Authorization", "Bearer secret")
+	headers.Set("Content-Encoding", "gzip")
+
+	data, err := PostBody(context.Background(), server.Client(), server.URL, []byte(`{"plant":"fern"}`), headers)
+	assert.Nil(t, err)
+	assert.Equal(t, "accepted", string(data))
+}
+
+func TestPostBodyRejected(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte("overloaded\n"))
+	}))
+	defer server.Close()
+
+	data, err := PostBody(context.Background(), server.Client(), server.URL, []byte("{}"), http.Header{})
+	assert.Equal(t, "overloaded\n", string(data))
+
+	var statusErr *StatusError
+	assert.True(t, errors.As(err, &statusErr))
+	assert.Equal(t, &StatusError{StatusCode: http.StatusServiceUnavailable, RetryAfter: 30 * time.Second, Message: "overloaded"}, statusErr)
+}
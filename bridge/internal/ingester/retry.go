@@ -0,0 +1,215 @@
+package ingester
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ryanrolds/plant-collector/bridge/internal/config"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultInitialBackoff = time.Second
+	defaultMaxBackoff     = 5 * time.Minute
+)
+
+// jitter is seeded per process so bridges don't retry in lockstep
+var (
+	jitterMu sync.Mutex
+	jitter   = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// StatusError is returned when the ingester, or another HTTP sink, responds
+// with a non-2xx status
+type StatusError struct {
+	StatusCode int
+	RetryAfter time.Duration
+	// Message is the reason given in the response, if any
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("server responded with %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+	}
+
+	return fmt.Sprintf("server responded with %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// transient is implemented by errors of other protocols that know whether
+// they're worth retrying
+type transient interface {
+	Transient() bool
+}
+
+// RetryPolicy controls how transient failures are retried. They are retried
+// until shutdown, the samples wait in the sink's queue meanwhile.
+type RetryPolicy struct {
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+func NewRetryPolicy(cfg config.Retry) RetryPolicy {
+	policy := RetryPolicy{
+		InitialBackoff: cfg.InitialBackoff,
+		MaxBackoff:     cfg.MaxBackoff,
+	}
+
+	if policy.InitialBackoff == 0 {
+		policy.InitialBackoff = defaultInitialBackoff
+	}
+	if policy.MaxBackoff == 0 {
+		policy.MaxBackoff = defaultMaxBackoff
+	}
+
+	return policy
+}
+
+// AttemptObserver is told how long a delivery attempt took and its error, nil
+// when it succeeded
+type AttemptObserver func(took time.Duration, err error)
+
+type attemptObserverKey struct{}
+
+// WithAttemptObserver returns a context whose delivery attempts are reported to
+// the observer, see ObserveAttempt
+func WithAttemptObserver(ctx context.Context, o AttemptObserver) context.Context {
+	return context.WithValue(ctx, attemptObserverKey{}, o)
+}
+
+// ObserveAttempt reports a delivery attempt to the context's observer.
+// Attempts interrupted by shutdown aren't reported.
+func ObserveAttempt(ctx context.Context, took time.Duration, err error) {
+	o, ok := ctx.Value(attemptObserverKey{}).(AttemptObserver)
+	if !ok || ctx.Err() != nil {
+		return
+	}
+
+	o(took, err)
+}
+
+// Do calls fn until it succeeds, fails permanently or the context is
+// cancelled. Every attempt is reported, see ObserveAttempt.
+func (p RetryPolicy) Do(ctx context.Context, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		started := time.Now()
+		err := fn()
+		ObserveAttempt(ctx, time.Since(started), err)
+		if err == nil {
+			return nil
+		}
+
+		if !IsTransient(err) {
+			return err
+		}
+
+		delay := p.backoff(attempt, err)
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"attempt": attempt,
+			"delay":   delay,
+		}).Warn("retrying after transient failure")
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// backoff doubles the delay on every attempt, up to the maximum, and picks a
+// random delay between half and all of it. A Retry-After from the ingester is
+// used as is.
+func (p RetryPolicy) backoff(attempt int, err error) time.Duration {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && statusErr.RetryAfter > 0 {
+		return statusErr.RetryAfter
+	}
+
+	delay := p.InitialBackoff
+	for i := 1; i < attempt && delay < p.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+
+	jitterMu.Lock()
+	defer jitterMu.Unlock()
+
+	half := delay / 2
+	return half + time.Duration(jitter.Int63n(int64(half)+1))
+}
+
+// IsTransient reports whether a failed send is worth retrying: server errors,
+// rate limiting, timeouts and connection failures
+func IsTransient(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var t transient
+	if errors.As(err, &t) {
+		return t.Transient()
+	}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500 ||
+			statusErr.StatusCode == http.StatusTooManyRequests ||
+			statusErr.StatusCode == http.StatusRequestTimeout
+	}
+
+	// every *url.Error is a net.Error, certificate errors, unsupported schemes
+	// and malformed URLs are permanent
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	// refused and reset connections
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return true
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+
+	// the server closed the connection
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// ParseRetryAfter handles both the delay-seconds and HTTP-date forms
+func ParseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	seconds, err := strconv.Atoi(value)
+	if err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+
+	date, err := http.ParseTime(value)
+	if err != nil || date.Before(now) {
+		return 0
+	}
+
+	return date.Sub(now)
+}
@@ -0,0 +1,174 @@
+package metrics
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/ryanrolds/plant-collector/bridge/internal/config"
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
+)
+
+// defaultStaleAfter covers sensors that only advertise every few minutes
+const defaultStaleAfter = 30 * time.Minute
+
+// Labels every sensor series has
+var Labels = []string{"plant", "zone", "device"}
+
+// Names are the gauge names of the metrics, with their units
+var Names = map[string]string{
+	ingester.MetricTemperature:    "plant_temperature_celsius",
+	ingester.MetricLight:          "plant_illuminance_lux",
+	ingester.MetricMoisture:       "plant_soil_moisture_percent",
+	ingester.MetricConductivity:   "plant_soil_conductivity_microsiemens_per_centimeter",
+	ingester.MetricHumidity:       "plant_humidity_percent",
+	ingester.MetricBattery:        "plant_sensor_battery_percent",
+	ingester.MetricBatteryVoltage: "plant_sensor_battery_volts",
+	ingester.MetricVPD:            "plant_vapour_pressure_deficit_kilopascals",
+	ingester.MetricDewPoint:       "plant_dew_point_celsius",
+	ingester.MetricPPFD:           "plant_ppfd_micromoles_per_square_metre_per_second",
+	ingester.MetricDLI:            "plant_dli_moles_per_square_metre_per_day",
+	ingester.MetricRssi:           "plant_sensor_rssi_dbm",
+}
+
+// LastSeenName is the gauge holding when a sensor's last sample was taken
+const LastSeenName = "plant_sensor_last_seen_timestamp_seconds"
+
+var help = map[string]string{
+	ingester.MetricTemperature:    "Latest air temperature reported by the sensor.",
+	ingester.MetricLight:          "Latest illuminance reported by the sensor.",
+	ingester.MetricMoisture:       "Latest soil moisture reported by the sensor.",
+	ingester.MetricConductivity:   "Latest soil conductivity reported by the sensor.",
+	ingester.MetricHumidity:       "Latest air humidity reported by the sensor.",
+	ingester.MetricBattery:        "Latest battery level of the sensor.",
+	ingester.MetricBatteryVoltage: "Latest battery voltage of the sensor.",
+	ingester.MetricVPD:            "Latest vapour pressure deficit derived for the plant.",
+	ingester.MetricDewPoint:       "Latest dew point derived for the plant.",
+	ingester.MetricPPFD:           "Latest photosynthetic photon flux density estimated for the plant.",
+	ingester.MetricDLI:            "Daily light integral so far today.",
+	ingester.MetricRssi:           "Signal strength of the sensor's latest advertisement.",
+}
+
+// series is the latest state of a sensor
+type series struct {
+	labels   []string
+	values   map[string]float64
+	lastSeen time.Time
+}
+
+// Exporter is a pipeline stage that keeps the latest value of every metric of
+// every sensor and exposes them as Prometheus gauges. A sensor's series are
+// removed once it hasn't been seen for a while, e.g. after it was moved to
+// another plant or its battery died.
+type Exporter struct {
+	staleAfter time.Duration
+	now        func() time.Time
+
+	descs    map[string]*prometheus.Desc
+	lastSeen *prometheus.Desc
+
+	mu     sync.Mutex
+	series map[[3]string]*series
+}
+
+func NewExporter(cfg config.Prometheus) *Exporter {
+	e := &Exporter{
+		staleAfter: cfg.StaleAfter,
+		now:        time.Now,
+		descs:      make(map[string]*prometheus.Desc, len(Names)),
+		lastSeen: prometheus.NewDesc(LastSeenName,
+			"When the sensor's latest sample was taken, in seconds since the epoch.", Labels, nil),
+		series: make(map[[3]string]*series),
+	}
+
+	if e.staleAfter == 0 {
+		e.staleAfter = defaultStaleAfter
+	}
+
+	for metric, name := range Names {
+		e.descs[metric] = prometheus.NewDesc(name, help[metric], Labels, nil)
+	}
+
+	return e
+}
+
+// Process records the sample's metrics and passes it on. Readings flagged by
+// validation aren't recorded.
+func (e *Exporter) Process(s ingester.Sample) []ingester.Sample {
+	key := [3]string{s.Plant, s.Zone, s.Device}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	current, ok := e.series[key]
+	if !ok {
+		current = &series{
+			labels: key[:],
+			values: make(map[string]float64),
+		}
+		e.series[key] = current
+	}
+
+	for metric, value := range s.Values() {
+		if _, flagged := s.Quality[metric]; flagged {
+			continue
+		}
+
+		current.values[metric] = value
+	}
+
+	if s.Time.After(current.lastSeen) {
+		current.lastSeen = s.Time
+	}
+
+	e.prune()
+
+	return []ingester.Sample{s}
+}
+
+// prune removes the series of sensors that haven't been seen for a while
+func (e *Exporter) prune() {
+	cutoff := e.now().Add(-e.staleAfter)
+	for key, s := range e.series {
+		if s.lastSeen.Before(cutoff) {
+			delete(e.series, key)
+		}
+	}
+}
+
+// Describe implements prometheus.Collector
+func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range e.descs {
+		ch <- desc
+	}
+	ch <- e.lastSeen
+}
+
+// Collect implements prometheus.Collector
+func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.prune()
+
+	for _, s := range e.series {
+		for metric, value := range s.values {
+			ch <- prometheus.MustNewConstMetric(e.descs[metric], prometheus.GaugeValue, value, s.labels...)
+		}
+
+		ch <- prometheus.MustNewConstMetric(e.lastSeen, prometheus.GaugeValue,
+			float64(s.lastSeen.UnixNano())/float64(time.Second), s.labels...)
+	}
+}
+
+// Handler serves the exporter's gauges along with the bridge's own metrics,
+// those registered with the default registry
+func (e *Exporter) Handler() http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(e)
+
+	gatherers := prometheus.Gatherers{prometheus.DefaultGatherer, registry}
+	return promhttp.HandlerFor(gatherers, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,101 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/ryanrolds/plant-collector/bridge/internal/config"
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
+	"github.com/stretchr/testify/assert"
+)
+
+func float(v float32) *float32 {
+	return &v
+}
+
+func integer(v int) *int {
+	return &v
+}
+
+func TestExporter(t *testing.T) {
+	start := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+
+	e := NewExporter(config.Prometheus{StaleAfter: 10 * time.Minute})
+	e.now = func() time.Time { return start }
+
+	out := e.Process(ingester.Sample{
+		Time:     start.Add(-time.Minute),
+		Plant:    "monstera",
+		Zone:     "tent",
+		Device:   "C4:7C:8D:6A:3D:72",
+		Moisture: float(40),
+		Rssi:     integer(-71),
+	})
+	assert.Len(t, out, 1)
+
+	// battery polls only carry the battery, the other readings are kept
+	e.Process(ingester.Sample{
+		Time:    start,
+		Plant:   "monstera",
+		Zone:    "tent",
+		Device:  "C4:7C:8D:6A:3D:72",
+		Battery: integer(87),
+	})
+
+	// flagged readings aren't exposed
+	e.Process(ingester.Sample{
+		Time:        start,
+		Plant:       "fern",
+		Device:      "C4:7C:8D:6A:3D:73",
+		Temperature: float(85),
+		Moisture:    float(55),
+		Quality:     map[string]string{ingester.MetricTemperature: "out_of_range"},
+	})
+
+	expected := `
+# HELP plant_sensor_battery_percent Latest battery level of the sensor.
+# TYPE plant_sensor_battery_percent gauge
+plant_sensor_battery_percent{device="C4:7C:8D:6A:3D:72",plant="monstera",zone="tent"} 87
+# HELP plant_sensor_last_seen_timestamp_seconds When the sensor's latest sample was taken, in seconds since the epoch.
+# TYPE plant_sensor_last_seen_timestamp_seconds gauge
+plant_sensor_last_seen_timestamp_seconds{device="C4:7C:8D:6A:3D:72",plant="monstera",zone="tent"} 1.6673040e+09
+plant_sensor_last_seen_timestamp_seconds{device="C4:7C:8D:6A:3D:73",plant="fern",zone=""} 1.6673040e+09
+# HELP plant_sensor_rssi_dbm Signal strength of the sensor's latest advertisement.
+# TYPE plant_sensor_rssi_dbm gauge
+plant_sensor_rssi_dbm{device="C4:7C:8D:6A:3D:72",plant="monstera",zone="tent"} -71
+# HELP plant_soil_moisture_percent Latest soil moisture reported by the sensor.
+# TYPE plant_soil_moisture_percent gauge
+plant_soil_moisture_percent{device="C4:7C:8D:6A:3D:72",plant="monstera",zone="tent"} 40
+plant_soil_moisture_percent{device="C4:7C:8D:6A:3D:73",plant="fern",zone=""} 55
+`
+	assert.Nil(t, testutil.CollectAndCompare(e, strings.NewReader(expected)))
+
+	// the fern's sensor disappears
+	e.Process(ingester.Sample{
+		Time:     start.Add(8 * time.Minute),
+		Plant:    "monstera",
+		Zone:     "tent",
+		Device:   "C4:7C:8D:6A:3D:72",
+		Moisture: float(39),
+	})
+	e.now = func() time.Time { return start.Add(11 * time.Minute) }
+
+	assert.Equal(t, 4, testutil.CollectAndCount(e))
+	assert.Equal(t, 0, testutil.CollectAndCount(e, "plant_temperature_celsius"))
+}
+
+func TestExporterHandler(t *testing.T) {
+	e := NewExporter(config.Prometheus{})
+	e.Process(ingester.Sample{Time: time.Now(), Plant: "monstera", Moisture: float(40)})
+
+	recorder := httptest.NewRecorder()
+	e.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `plant_soil_moisture_percent{device="",plant="monstera",zone=""} 40`)
+	assert.Contains(t, recorder.Body.String(), "process_start_time_seconds")
+}
@@ -0,0 +1,206 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+
+	"github.com/ryanrolds/plant-collector/bridge/internal/config"
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
+	"github.com/ryanrolds/plant-collector/bridge/internal/scanner/devices"
+)
+
+const defaultDiscoveryPrefix = "homeassistant"
+
+// entity describes how a metric shows up in Home Assistant
+type entity struct {
+	name        string
+	deviceClass string
+	unit        string
+	icon        string
+	diagnostic  bool
+}
+
+var entities = map[string]entity{
+	ingester.MetricTemperature:    {name: "Temperature", deviceClass: "temperature", unit: "°C"},
+	ingester.MetricLight:          {name: "Illuminance", deviceClass: "illuminance", unit: "lx"},
+	ingester.MetricMoisture:       {name: "Moisture", deviceClass: "moisture", unit: "%"},
+	ingester.MetricConductivity:   {name: "Conductivity", unit: "µS/cm", icon: "mdi:flash"},
+	ingester.MetricHumidity:       {name: "Humidity", deviceClass: "humidity", unit: "%"},
+	ingester.MetricBattery:        {name: "Battery", deviceClass: "battery", unit: "%", diagnostic: true},
+	ingester.MetricBatteryVoltage: {name: "Battery voltage", deviceClass: "voltage", unit: "V", diagnostic: true},
+	ingester.MetricVPD:            {name: "VPD", deviceClass: "pressure", unit: "kPa"},
+	ingester.MetricDewPoint:       {name: "Dew point", deviceClass: "temperature", unit: "°C"},
+	ingester.MetricPPFD:           {name: "PPFD", unit: "µmol/m²/s", icon: "mdi:white-balance-sunny"},
+	ingester.MetricDLI:            {name: "DLI", unit: "mol/m²/d", icon: "mdi:weather-sunny"},
+	ingester.MetricRssi:           {name: "Signal strength", deviceClass: "signal_strength", unit: "dBm", diagnostic: true},
+}
+
+// model is the manufacturer and model shown on a plant's device
+type model struct {
+	manufacturer string
+	name         string
+}
+
+var models = map[string]model{
+	devices.TypeFlowerCare: {manufacturer: "Xiaomi", name: "Flower Care (HHCCJCY01)"},
+	devices.TypeBparasite:  {manufacturer: "rbaron", name: "b-parasite"},
+}
+
+var unsafeID = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+type discoveryDevice struct {
+	Identifiers   []string `json:"identifiers"`
+	Name          string   `json:"name"`
+	Manufacturer  string   `json:"manufacturer,omitempty"`
+	Model         string   `json:"model,omitempty"`
+	SWVersion     string   `json:"sw_version,omitempty"`
+	SuggestedArea string   `json:"suggested_area,omitempty"`
+}
+
+type discoveryConfig struct {
+	Name                string          `json:"name"`
+	UniqueID            string          `json:"unique_id"`
+	ObjectID            string          `json:"object_id"`
+	StateTopic          string          `json:"state_topic"`
+	ValueTemplate       string          `json:"value_template"`
+	DeviceClass         string          `json:"device_class,omitempty"`
+	UnitOfMeasurement   string          `json:"unit_of_measurement,omitempty"`
+	StateClass          string          `json:"state_class"`
+	Icon                string          `json:"icon,omitempty"`
+	EntityCategory      string          `json:"entity_category,omitempty"`
+	AvailabilityTopic   string          `json:"availability_topic,omitempty"`
+	PayloadAvailable    string          `json:"payload_available,omitempty"`
+	PayloadNotAvailable string          `json:"payload_not_available,omitempty"`
+	Device              discoveryDevice `json:"device"`
+}
+
+// announcement is a retained discovery config message
+type announcement struct {
+	topic   string
+	payload []byte
+}
+
+// announced is what a metric's config was last announced with
+type announced struct {
+	stateTopic string
+	firmware   string
+}
+
+// discovery announces a Home Assistant sensor for each metric of each plant
+// the first time it is published. Every plant is a device, its sensors read
+// their value from the plant's state topic. Metrics are announced again once
+// the plant's sensor reports its firmware, so the device shows it.
+type discovery struct {
+	prefix      string
+	statusTopic string
+	announced   map[string]announced
+	// firmware is the latest firmware reported by each plant's sensor
+	firmware map[string]string
+}
+
+func newDiscovery(cfg config.Discovery, statusTopic string) *discovery {
+	if !cfg.Enabled {
+		return nil
+	}
+
+	d := &discovery{
+		prefix:      cfg.Prefix,
+		statusTopic: statusTopic,
+		announced:   make(map[string]announced),
+		firmware:    make(map[string]string),
+	}
+
+	if d.prefix == "" {
+		d.prefix = defaultDiscoveryPrefix
+	}
+
+	return d
+}
+
+// announce returns the config messages for the sample's metrics that haven't
+// been announced with its state topic yet and marks them as announced
+func (d *discovery) announce(s ingester.Sample, stateTopic string) ([]announcement, error) {
+	plant := s.Collector + "/" + s.Plant
+	if s.Firmware != "" {
+		d.firmware[plant] = s.Firmware
+	}
+	current := announced{stateTopic: stateTopic, firmware: d.firmware[plant]}
+
+	var announcements []announcement
+	for _, metric := range ingester.Metrics {
+		if _, ok := s.Value(metric); !ok {
+			continue
+		}
+
+		key := plant + "/" + metric
+		if d.announced[key] == current {
+			continue
+		}
+
+		payload, err := json.Marshal(d.config(s, current, metric))
+		if err != nil {
+			return nil, err
+		}
+
+		announcements = append(announcements, announcement{
+			topic:   fmt.Sprintf("%s/sensor/%s/%s/config", d.prefix, nodeID(s), metric),
+			payload: payload,
+		})
+		d.announced[key] = current
+	}
+
+	return announcements, nil
+}
+
+func (d *discovery) config(s ingester.Sample, as announced, metric string) discoveryConfig {
+	e := entities[metric]
+	id := nodeID(s) + "_" + metric
+
+	// the device is named after the plant, or its ID when it has no name
+	name := s.PlantName
+	if name == "" {
+		name = s.Plant
+	}
+
+	c := discoveryConfig{
+		Name:       e.name,
+		UniqueID:   id,
+		ObjectID:   id,
+		StateTopic: as.stateTopic,
+		// samples only carry some metrics, the others keep their state
+		ValueTemplate:     fmt.Sprintf("{{ value_json.%s if value_json.%s is not none else this.state }}", metric, metric),
+		DeviceClass:       e.deviceClass,
+		UnitOfMeasurement: e.unit,
+		StateClass:        "measurement",
+		Icon:              e.icon,
+		Device: discoveryDevice{
+			Identifiers:   []string{nodeID(s)},
+			Name:          name,
+			SuggestedArea: s.Zone,
+			SWVersion:     as.firmware,
+		},
+	}
+
+	if e.diagnostic {
+		c.EntityCategory = "diagnostic"
+	}
+
+	if d.statusTopic != "" {
+		c.AvailabilityTopic = d.statusTopic
+		c.PayloadAvailable = StatusOnline
+		c.PayloadNotAvailable = StatusOffline
+	}
+
+	if m, ok := models[s.DeviceType]; ok {
+		c.Device.Manufacturer = m.manufacturer
+		c.Device.Model = m.name
+	}
+
+	return c
+}
+
+// nodeID identifies a plant's device, it's unique across bridges
+func nodeID(s ingester.Sample) string {
+	return unsafeID.ReplaceAllString("plant_"+s.Collector+"_"+s.Plant, "_")
+}
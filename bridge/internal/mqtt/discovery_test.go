@@ -0,0 +1,132 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/ryanrolds/plant-collector/bridge/internal/config"
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester/ingestertest"
+	"github.com/ryanrolds/plant-collector/bridge/internal/scanner/devices"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiscoveryAnnounce(t *testing.T) {
+	d := newDiscovery(config.Discovery{Enabled: true}, "plants/bridge/bridge-1/status")
+
+	s := ingester.Sample{
+		Collector:  "bridge-1",
+		Plant:      "monstera",
+		PlantName:  "Living room monstera",
+		Zone:       "tent",
+		DeviceType: devices.TypeFlowerCare,
+		Moisture:   float(40),
+	}
+
+	announcements, err := d.announce(s, "plants/tent/monstera/state")
+	assert.Nil(t, err)
+	assert.Len(t, announcements, 1)
+	assert.Equal(t, "homeassistant/sensor/plant_bridge-1_monstera/moist/config", announcements[0].topic)
+
+	var c discoveryConfig
+	assert.Nil(t, json.Unmarshal(announcements[0].payload, &c))
+	assert.Equal(t, "Moisture", c.Name)
+	assert.Equal(t, "plant_bridge-1_monstera_moist", c.UniqueID)
+	assert.Equal(t, "moisture", c.DeviceClass)
+	assert.Equal(t, "%", c.UnitOfMeasurement)
+	assert.Equal(t, "measurement", c.StateClass)
+	assert.Equal(t, "plants/tent/monstera/state", c.StateTopic)
+	assert.Equal(t, "plants/bridge/bridge-1/status", c.AvailabilityTopic)
+	assert.Equal(t, []string{"plant_bridge-1_monstera"}, c.Device.Identifiers)
+	assert.Equal(t, "Living room monstera", c.Device.Name)
+	assert.Equal(t, "Xiaomi", c.Device.Manufacturer)
+	assert.Equal(t, "tent", c.Device.SuggestedArea)
+
+	// only new metrics are announced
+	s.Rssi = new(int)
+	announcements, err = d.announce(s, "plants/tent/monstera/state")
+	assert.Nil(t, err)
+	assert.Len(t, announcements, 1)
+	assert.Equal(t, "homeassistant/sensor/plant_bridge-1_monstera/rssi/config", announcements[0].topic)
+
+	assert.Nil(t, json.Unmarshal(announcements[0].payload, &c))
+	assert.Equal(t, "diagnostic", c.EntityCategory)
+
+	announcements, err = d.announce(s, "plants/tent/monstera/state")
+	assert.Nil(t, err)
+	assert.Len(t, announcements, 0)
+
+	// a plant that moved zone is announced again with its new state topic
+	announcements, err = d.announce(s, "plants/window/monstera/state")
+	assert.Nil(t, err)
+	assert.Len(t, announcements, 2)
+}
+
+func TestDiscoveryAnnouncesFirmware(t *testing.T) {
+	d := newDiscovery(config.Discovery{Enabled: true}, "")
+
+	s := ingester.Sample{Collector: "bridge-1", Plant: "monstera", DeviceType: devices.TypeFlowerCare, Moisture: float(40)}
+	announcements, err := d.announce(s, "plants/none/monstera/state")
+	assert.Nil(t, err)
+	assert.Len(t, announcements, 1)
+
+	// a battery poll reports the firmware
+	battery := 87
+	announcements, err = d.announce(ingester.Sample{Collector: "bridge-1", Plant: "monstera", DeviceType: devices.TypeFlowerCare,
+		Battery: &battery, Firmware: "3.2.1"}, "plants/none/monstera/state")
+	assert.Nil(t, err)
+	assert.Len(t, announcements, 1)
+
+	var c discoveryConfig
+	assert.Nil(t, json.Unmarshal(announcements[0].payload, &c))
+	assert.Equal(t, "3.2.1", c.Device.SWVersion)
+	// without a name the device is named after the plant's ID
+	assert.Equal(t, "monstera", c.Device.Name)
+
+	// moisture is announced again with the firmware
+	announcements, err = d.announce(s, "plants/none/monstera/state")
+	assert.Nil(t, err)
+	assert.Len(t, announcements, 1)
+	assert.Nil(t, json.Unmarshal(announcements[0].payload, &c))
+	assert.Equal(t, "3.2.1", c.Device.SWVersion)
+
+	announcements, err = d.announce(s, "plants/none/monstera/state")
+	assert.Nil(t, err)
+	assert.Len(t, announcements, 0)
+}
+
+func TestDiscoveryDisabled(t *testing.T) {
+	assert.Nil(t, newDiscovery(config.Discovery{}, ""))
+}
+
+func TestPublisherAnnounces(t *testing.T) {
+	_, hook, broker := startBroker(t)
+
+	retain := false
+	publisher, err := NewPublisher(config.MQTT{
+		Broker:    broker,
+		Username:  "bridge",
+		Password:  "secret",
+		Retain:    &retain,
+		Discovery: config.Discovery{Enabled: true, Prefix: "ha"},
+	})
+	assert.Nil(t, err)
+
+	source := &ingestertest.SliceSource{Samples: []ingester.Sample{
+		{Collector: "bridge-1", Plant: "monstera", Zone: "tent", Moisture: float(40)},
+		{Collector: "bridge-1", Plant: "monstera", Zone: "tent", Moisture: float(41)},
+	}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	assert.Nil(t, publisher.SendAll(ctx, source))
+
+	configs := hook.on("ha/sensor/plant_bridge-1_monstera/moist/config")
+	assert.Len(t, configs, 1)
+	assert.True(t, configs[0].retain)
+
+	assert.Len(t, hook.on("plants/tent/monstera/state"), 2)
+}
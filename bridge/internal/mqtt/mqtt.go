@@ -0,0 +1,360 @@
+package mqtt
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ryanrolds/plant-collector/bridge/internal/config"
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
+	"github.com/ryanrolds/plant-collector/bridge/internal/tlsconfig"
+	"github.com/sirupsen/logrus"
+)
+
+// Protocol versions
+const (
+	Version311 = "3.1.1"
+	Version5   = "5"
+)
+
+// Bridge status payloads
+const (
+	StatusOnline  = "online"
+	StatusOffline = "offline"
+)
+
+const (
+	defaultTopic     = "plants/{zone}/{plant}/state"
+	defaultQoS       = 1
+	defaultKeepAlive = 30 * time.Second
+	// missingLevel replaces empty topic levels, e.g. plants without a zone
+	missingLevel = "none"
+	// statusTimeout bounds publishing the offline status on shutdown
+	statusTimeout = 2 * time.Second
+)
+
+var (
+	// publishRetryDelay is how long a failed publish waits before it is tried
+	// again, the client reconnects in the meantime
+	publishRetryDelay = 5 * time.Second
+	// reconnectDelay is how long the client waits between connection attempts
+	reconnectDelay = 10 * time.Second
+)
+
+var placeholder = regexp.MustCompile(`\{([a-z_]+)\}`)
+
+// client hides the differences between the protocol versions
+type client interface {
+	// connect waits until the client is connected, it keeps reconnecting until
+	// disconnect is called
+	connect(ctx context.Context) error
+	publish(ctx context.Context, topic string, qos byte, retain bool, payload []byte) error
+	// disconnect publishes the offline status and closes the connection
+	disconnect()
+}
+
+// options are the connection settings shared by both clients
+type options struct {
+	broker      *url.URL
+	clientID    string
+	username    string
+	password    string
+	tls         *tls.Config
+	keepAlive   time.Duration
+	statusTopic string
+}
+
+// status publishes the bridge's online and offline status. Clients publish
+// online whenever they connect, possibly from another goroutine, offline is
+// always the last one so the retained status can't go back to online.
+type status struct {
+	topic string
+
+	mu      sync.Mutex
+	closing bool
+	// published is closed once online has been published for the first time
+	published chan struct{}
+	once      sync.Once
+}
+
+func newStatus(topic string) *status {
+	s := &status{
+		topic:     topic,
+		published: make(chan struct{}),
+	}
+
+	if topic == "" {
+		close(s.published)
+	}
+
+	return s
+}
+
+// online publishes the online status unless the client is shutting down
+func (s *status) online(publish func(payload string) error) {
+	if s.topic == "" {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.once.Do(func() { close(s.published) })
+
+	if s.closing {
+		return
+	}
+
+	err := publish(StatusOnline)
+	if err != nil {
+		logrus.WithError(err).Warn("failed to publish online status")
+	}
+}
+
+// wait waits until online has been published after the first connection
+func (s *status) wait(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-s.published:
+		return nil
+	}
+}
+
+// offline publishes the offline status, a clean disconnect discards the will
+func (s *status) offline(publish func(payload string) error) {
+	if s.topic == "" {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closing = true
+
+	err := publish(StatusOffline)
+	if err != nil {
+		logrus.WithError(err).Warn("failed to publish offline status")
+	}
+}
+
+// Publisher sends each sample as JSON to a topic built from the sample's
+// plant, zone and other identifiers. Samples are acknowledged once the broker
+// has them, failed publishes are retried until shutdown and the unsent samples
+// stay queued.
+type Publisher struct {
+	client    client
+	topic     string
+	qos       byte
+	retain    bool
+	discovery *discovery
+}
+
+func NewPublisher(cfg config.MQTT) (*Publisher, error) {
+	if cfg.Broker == "" {
+		return nil, errors.New("broker must be set")
+	}
+
+	broker, err := url.Parse(cfg.Broker)
+	if err != nil {
+		return nil, fmt.Errorf("parsing broker url: %w", err)
+	}
+
+	p := &Publisher{
+		topic:  cfg.Topic,
+		qos:    defaultQoS,
+		retain: true,
+	}
+
+	if p.topic == "" {
+		p.topic = defaultTopic
+	}
+	for _, match := range placeholder.FindAllStringSubmatch(p.topic, -1) {
+		if _, ok := topicFields(ingester.Sample{})[match[1]]; !ok {
+			return nil, fmt.Errorf("unknown topic placeholder %s", match[0])
+		}
+	}
+
+	if cfg.QoS != nil {
+		if *cfg.QoS < 0 || *cfg.QoS > 2 {
+			return nil, fmt.Errorf("qos must be 0, 1 or 2, got %d", *cfg.QoS)
+		}
+		p.qos = byte(*cfg.QoS)
+	}
+	if cfg.Retain != nil {
+		p.retain = *cfg.Retain
+	}
+
+	p.discovery = newDiscovery(cfg.Discovery, cfg.StatusTopic)
+
+	opts := options{
+		broker:      broker,
+		clientID:    cfg.ClientID,
+		username:    cfg.Username,
+		password:    cfg.Password,
+		keepAlive:   cfg.KeepAlive,
+		statusTopic: cfg.StatusTopic,
+	}
+
+	if opts.keepAlive == 0 {
+		opts.keepAlive = defaultKeepAlive
+	}
+
+	if secure(broker) {
+		opts.tls, err = tlsconfig.Load(cfg.TLS)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch cfg.Version {
+	case Version311, "":
+		p.client = newV311Client(opts)
+	case Version5:
+		p.client = newV5Client(opts)
+	default:
+		return nil, fmt.Errorf("unknown protocol version %q", cfg.Version)
+	}
+
+	return p, nil
+}
+
+// SendAll publishes samples from the source until it returns io.EOF or the
+// context is cancelled
+func (p *Publisher) SendAll(ctx context.Context, source ingester.Source) error {
+	err := p.client.connect(ctx)
+	defer p.client.disconnect()
+	if ctx.Err() != nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for {
+		s, err := source.Next(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if errors.Is(err, io.EOF) {
+			logrus.Debug("all samples published")
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if !p.publish(ctx, s) {
+			return nil
+		}
+
+		err = source.Ack()
+		if err != nil {
+			logrus.WithError(err).Error("failed to acknowledge samples")
+		}
+	}
+}
+
+// publish sends the sample, and the discovery config of metrics that are new,
+// until the broker has it. Returns false when interrupted by shutdown.
+func (p *Publisher) publish(ctx context.Context, s ingester.Sample) bool {
+	payload, err := json.Marshal(s)
+	if err != nil {
+		logrus.WithError(err).Error("failed to encode sample")
+		return true
+	}
+
+	topic := p.Topic(s)
+
+	if p.discovery != nil {
+		announcements, err := p.discovery.announce(s, topic)
+		if err != nil {
+			logrus.WithError(err).Error("failed to encode discovery config")
+		}
+
+		for _, a := range announcements {
+			// discovery configs are always retained so Home Assistant finds
+			// them after a restart
+			if !p.send(ctx, a.topic, 1, true, a.payload) {
+				return false
+			}
+		}
+	}
+
+	return p.send(ctx, topic, p.qos, p.retain, payload)
+}
+
+// send publishes until the broker has the message, returns false when
+// interrupted by shutdown
+func (p *Publisher) send(ctx context.Context, topic string, qos byte, retain bool, payload []byte) bool {
+	for {
+		started := time.Now()
+		err := p.client.publish(ctx, topic, qos, retain, payload)
+		ingester.ObserveAttempt(ctx, time.Since(started), err)
+		if err == nil {
+			return true
+		}
+		if ctx.Err() != nil {
+			return false
+		}
+
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"topic": topic,
+			"delay": publishRetryDelay,
+		}).Warn("failed to publish")
+
+		timer := time.NewTimer(publishRetryDelay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return false
+		case <-timer.C:
+		}
+	}
+}
+
+// Topic fills in the topic template for the sample
+func (p *Publisher) Topic(s ingester.Sample) string {
+	fields := topicFields(s)
+	return placeholder.ReplaceAllStringFunc(p.topic, func(match string) string {
+		return level(fields[match[1:len(match)-1]])
+	})
+}
+
+func topicFields(s ingester.Sample) map[string]string {
+	return map[string]string{
+		"collector":   s.Collector,
+		"site":        s.Site,
+		"location":    s.Location,
+		"zone":        s.Zone,
+		"plant":       s.Plant,
+		"device":      s.Device,
+		"device_type": s.DeviceType,
+	}
+}
+
+// level makes a value safe to use as a topic level, separators and wildcards
+// would change the topic's meaning
+func level(value string) string {
+	if value == "" {
+		return missingLevel
+	}
+
+	return strings.NewReplacer("/", "_", "+", "_", "#", "_").Replace(value)
+}
+
+func secure(broker *url.URL) bool {
+	switch strings.ToLower(broker.Scheme) {
+	case "ssl", "tls", "mqtts", "mqtt+ssl", "tcps":
+		return true
+	}
+
+	return false
+}
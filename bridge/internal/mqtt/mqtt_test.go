@@ -0,0 +1,277 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	mqttserver "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/rs/zerolog"
+	"github.com/ryanrolds/plant-collector/bridge/internal/config"
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester/ingestertest"
+	"github.com/stretchr/testify/assert"
+)
+
+type message struct {
+	topic   string
+	payload string
+	retain  bool
+	qos     byte
+}
+
+// recorder is a broker hook that checks credentials and keeps every message
+// published to the broker
+type recorder struct {
+	mqttserver.HookBase
+
+	mu       sync.Mutex
+	messages []message
+}
+
+func (r *recorder) ID() string {
+	return "recorder"
+}
+
+func (r *recorder) Provides(b byte) bool {
+	return b == mqttserver.OnConnectAuthenticate ||
+		b == mqttserver.OnACLCheck ||
+		b == mqttserver.OnPublished ||
+		b == mqttserver.OnWillSent
+}
+
+func (r *recorder) OnConnectAuthenticate(cl *mqttserver.Client, pk packets.Packet) bool {
+	return string(pk.Connect.Username) == "bridge" && string(pk.Connect.Password) == "secret"
+}
+
+func (r *recorder) OnACLCheck(cl *mqttserver.Client, topic string, write bool) bool {
+	return true
+}
+
+func (r *recorder) OnPublished(cl *mqttserver.Client, pk packets.Packet) {
+	r.record(pk)
+}
+
+func (r *recorder) OnWillSent(cl *mqttserver.Client, pk packets.Packet) {
+	r.record(pk)
+}
+
+func (r *recorder) record(pk packets.Packet) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.messages = append(r.messages, message{
+		topic:   pk.TopicName,
+		payload: string(pk.Payload),
+		retain:  pk.FixedHeader.Retain,
+		qos:     pk.FixedHeader.Qos,
+	})
+}
+
+func (r *recorder) on(topic string) []message {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var messages []message
+	for _, m := range r.messages {
+		if m.topic == topic {
+			messages = append(messages, m)
+		}
+	}
+
+	return messages
+}
+
+// startBroker runs an in-process broker and returns its URL
+func startBroker(t *testing.T) (*mqttserver.Server, *recorder, string) {
+	logger := zerolog.Nop()
+	server := mqttserver.New(&mqttserver.Options{Logger: &logger})
+
+	hook := &recorder{}
+	assert.Nil(t, server.AddHook(hook, nil))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	assert.Nil(t, server.AddListener(listeners.NewNet("test", listener)))
+
+	go func() {
+		_ = server.Serve()
+	}()
+	t.Cleanup(func() {
+		server.Close()
+	})
+
+	return server, hook, "mqtt://" + listener.Addr().String()
+}
+
+func float(v float32) *float32 {
+	return &v
+}
+
+func TestPublisherSendAll(t *testing.T) {
+	for _, version := range []string{Version311, Version5} {
+		t.Run(version, func(t *testing.T) {
+			_, hook, broker := startBroker(t)
+
+			publisher, err := NewPublisher(config.MQTT{
+				Broker:      broker,
+				Version:     version,
+				ClientID:    "bridge-" + version,
+				Username:    "bridge",
+				Password:    "secret",
+				StatusTopic: "plants/bridge/test/status",
+			})
+			assert.Nil(t, err)
+
+			source := &ingestertest.SliceSource{Samples: []ingester.Sample{
+				{Plant: "monstera", Zone: "tent", Moisture: float(40)},
+				{Plant: "fern", Moisture: float(55)},
+			}}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			assert.Nil(t, publisher.SendAll(ctx, source))
+			assert.Equal(t, 2, source.Acked)
+
+			messages := hook.on("plants/tent/monstera/state")
+			assert.Len(t, messages, 1)
+			assert.True(t, messages[0].retain)
+			assert.Equal(t, byte(1), messages[0].qos)
+
+			var s ingester.Sample
+			assert.Nil(t, json.Unmarshal([]byte(messages[0].payload), &s))
+			assert.Equal(t, float32(40), *s.Moisture)
+
+			assert.Len(t, hook.on("plants/none/fern/state"), 1)
+
+			status := hook.on("plants/bridge/test/status")
+			assert.Equal(t, []message{
+				{topic: "plants/bridge/test/status", payload: StatusOnline, retain: true, qos: 1},
+				{topic: "plants/bridge/test/status", payload: StatusOffline, retain: true, qos: 1},
+			}, status)
+		})
+	}
+}
+
+func TestPublisherReconnects(t *testing.T) {
+	delay := reconnectDelay
+	reconnectDelay = 10 * time.Millisecond
+	defer func() {
+		reconnectDelay = delay
+	}()
+
+	tests := []struct {
+		version  string
+		statuses []string
+	}{
+		{
+			version:  Version311,
+			statuses: []string{StatusOnline, StatusOffline, StatusOnline},
+		},
+		{
+			// the will is delayed on 5 and dropped when the client is back in time
+			version:  Version5,
+			statuses: []string{StatusOnline, StatusOnline},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.version, func(t *testing.T) {
+			server, hook, broker := startBroker(t)
+
+			publisher, err := NewPublisher(config.MQTT{
+				Broker:      broker,
+				Version:     test.version,
+				ClientID:    "bridge",
+				Username:    "bridge",
+				Password:    "secret",
+				StatusTopic: "status",
+			})
+			assert.Nil(t, err)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			assert.Nil(t, publisher.client.connect(ctx))
+			defer publisher.client.disconnect()
+
+			assert.Eventually(t, func() bool {
+				return len(hook.on("status")) == 1
+			}, time.Second, 10*time.Millisecond)
+
+			// drop the connection without a disconnect
+			cl, ok := server.Clients.Get("bridge")
+			assert.True(t, ok)
+			cl.Stop(io.ErrUnexpectedEOF)
+
+			assert.Eventually(t, func() bool {
+				return len(hook.on("status")) == len(test.statuses)
+			}, 2*time.Second, 10*time.Millisecond)
+
+			statuses := []string{}
+			for _, m := range hook.on("status") {
+				statuses = append(statuses, m.payload)
+			}
+			assert.Equal(t, test.statuses, statuses)
+
+			assert.Nil(t, publisher.client.publish(ctx, "plants/tent/monstera/state", 1, true, []byte("{}")))
+		})
+	}
+}
+
+func TestPublisherTopic(t *testing.T) {
+	tests := []struct {
+		template string
+		sample   ingester.Sample
+		expected string
+	}{
+		{
+			sample:   ingester.Sample{Plant: "monstera", Zone: "tent"},
+			expected: "plants/tent/monstera/state",
+		},
+		{
+			sample:   ingester.Sample{Plant: "monstera"},
+			expected: "plants/none/monstera/state",
+		},
+		{
+			template: "{site}/{collector}/{device}",
+			sample:   ingester.Sample{Site: "farm", Collector: "bridge-1", Device: "C4:7C:8D:6A:3D:72"},
+			expected: "farm/bridge-1/C4:7C:8D:6A:3D:72",
+		},
+		{
+			template: "plants/{plant}",
+			sample:   ingester.Sample{Plant: "a/b+#"},
+			expected: "plants/a_b__",
+		},
+	}
+
+	for _, test := range tests {
+		publisher, err := NewPublisher(config.MQTT{Broker: "mqtt://localhost:1883", Topic: test.template})
+		assert.Nil(t, err)
+		assert.Equal(t, test.expected, publisher.Topic(test.sample))
+	}
+}
+
+func TestNewPublisherInvalid(t *testing.T) {
+	qos := 3
+
+	tests := []config.MQTT{
+		{},
+		{Broker: "mqtt://localhost:1883", Topic: "plants/{room}"},
+		{Broker: "mqtt://localhost:1883", QoS: &qos},
+		{Broker: "mqtt://localhost:1883", Version: "3.1"},
+		{Broker: "mqtts://localhost:8883", TLS: config.TLS{CA: "testdata/missing.pem"}},
+	}
+
+	for _, test := range tests {
+		_, err := NewPublisher(test)
+		assert.NotNil(t, err)
+	}
+}
@@ -0,0 +1,99 @@
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	paho3 "github.com/eclipse/paho.mqtt.golang"
+	"github.com/sirupsen/logrus"
+)
+
+// v311Client speaks MQTT 3.1.1
+type v311Client struct {
+	client paho3.Client
+	status *status
+}
+
+func newV311Client(opts options) *v311Client {
+	c := &v311Client{
+		status: newStatus(opts.statusTopic),
+	}
+
+	o := paho3.NewClientOptions().
+		AddBroker(opts.broker.String()).
+		SetClientID(opts.clientID).
+		SetUsername(opts.username).
+		SetPassword(opts.password).
+		SetProtocolVersion(4).
+		SetKeepAlive(opts.keepAlive).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(reconnectDelay).
+		SetMaxReconnectInterval(reconnectDelay).
+		SetConnectionLostHandler(func(_ paho3.Client, err error) {
+			logrus.WithError(err).Warn("mqtt connection lost")
+		}).
+		SetOnConnectHandler(func(client paho3.Client) {
+			logrus.WithField("broker", opts.broker.Host).Info("mqtt connected")
+
+			c.status.online(func(payload string) error {
+				return publishStatus(client, opts.statusTopic, payload)
+			})
+		})
+
+	if opts.tls != nil {
+		o.SetTLSConfig(opts.tls)
+	}
+
+	if opts.statusTopic != "" {
+		o.SetWill(opts.statusTopic, StatusOffline, 1, true)
+	}
+
+	c.client = paho3.NewClient(o)
+
+	return c
+}
+
+func (c *v311Client) connect(ctx context.Context) error {
+	err := wait(ctx, c.client.Connect())
+	if err != nil {
+		return err
+	}
+
+	return c.status.wait(ctx)
+}
+
+func (c *v311Client) publish(ctx context.Context, topic string, qos byte, retain bool, payload []byte) error {
+	return wait(ctx, c.client.Publish(topic, qos, retain, payload))
+}
+
+func (c *v311Client) disconnect() {
+	c.status.offline(func(payload string) error {
+		if !c.client.IsConnected() {
+			return nil
+		}
+
+		return publishStatus(c.client, c.status.topic, payload)
+	})
+
+	c.client.Disconnect(uint(statusTimeout / time.Millisecond))
+}
+
+func publishStatus(client paho3.Client, topic string, payload string) error {
+	token := client.Publish(topic, 1, true, payload)
+	if !token.WaitTimeout(statusTimeout) {
+		return errors.New("timed out")
+	}
+
+	return token.Error()
+}
+
+func wait(ctx context.Context, token paho3.Token) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-token.Done():
+		return token.Error()
+	}
+}
@@ -0,0 +1,132 @@
+package mqtt
+
+import (
+	"context"
+	"net/url"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/sirupsen/logrus"
+)
+
+// v5Client speaks MQTT 5
+type v5Client struct {
+	config autopaho.ClientConfig
+	status *status
+
+	manager *autopaho.ConnectionManager
+	stop    context.CancelFunc
+}
+
+func newV5Client(opts options) *v5Client {
+	c := &v5Client{
+		status: newStatus(opts.statusTopic),
+	}
+
+	c.config = autopaho.ClientConfig{
+		BrokerUrls:        []*url.URL{opts.broker},
+		TlsCfg:            opts.tls,
+		KeepAlive:         uint16(opts.keepAlive.Seconds()),
+		ConnectRetryDelay: reconnectDelay,
+		OnConnectionUp: func(manager *autopaho.ConnectionManager, _ *paho.Connack) {
+			logrus.WithField("broker", opts.broker.Host).Info("mqtt connected")
+
+			c.status.online(func(payload string) error {
+				return publishStatus5(manager, opts.statusTopic, payload)
+			})
+		},
+		OnConnectError: func(err error) {
+			logrus.WithError(err).Warn("mqtt connection failed")
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID: opts.clientID,
+			OnClientError: func(err error) {
+				logrus.WithError(err).Warn("mqtt connection lost")
+			},
+			OnServerDisconnect: func(d *paho.Disconnect) {
+				logrus.WithField("reason", d.ReasonCode).Warn("mqtt broker disconnected")
+			},
+		},
+	}
+
+	c.config.SetUsernamePassword(opts.username, []byte(opts.password))
+
+	if opts.statusTopic != "" {
+		c.config.SetWillMessage(opts.statusTopic, []byte(StatusOffline), 1, true)
+	}
+
+	return c
+}
+
+func (c *v5Client) connect(ctx context.Context) error {
+	// the manager reconnects until it's stopped, not just while connecting
+	managerCtx, stop := context.WithCancel(context.Background())
+
+	manager, err := autopaho.NewConnection(managerCtx, c.config)
+	if err != nil {
+		stop()
+		return err
+	}
+
+	c.manager = manager
+	c.stop = stop
+
+	err = manager.AwaitConnection(ctx)
+	if err != nil {
+		return err
+	}
+
+	return c.status.wait(ctx)
+}
+
+func (c *v5Client) publish(ctx context.Context, topic string, qos byte, retain bool, payload []byte) error {
+	err := c.manager.AwaitConnection(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.manager.Publish(ctx, &paho.Publish{
+		Topic:   topic,
+		QoS:     qos,
+		Retain:  retain,
+		Payload: payload,
+		Properties: &paho.PublishProperties{
+			ContentType: "application/json",
+		},
+	})
+
+	return err
+}
+
+func (c *v5Client) disconnect() {
+	if c.manager == nil {
+		return
+	}
+	defer c.stop()
+
+	c.status.offline(func(payload string) error {
+		return publishStatus5(c.manager, c.status.topic, payload)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), statusTimeout)
+	defer cancel()
+
+	err := c.manager.Disconnect(ctx)
+	if err != nil {
+		logrus.WithError(err).Debug("mqtt disconnect failed")
+	}
+}
+
+func publishStatus5(manager *autopaho.ConnectionManager, topic string, payload string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), statusTimeout)
+	defer cancel()
+
+	_, err := manager.Publish(ctx, &paho.Publish{
+		Topic:   topic,
+		QoS:     1,
+		Retain:  true,
+		Payload: []byte(payload),
+	})
+
+	return err
+}
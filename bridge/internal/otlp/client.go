@@ -0,0 +1,174 @@
+package otlp
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
+	"github.com/sirupsen/logrus"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	grpcgzip "google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// client sends export requests over one of the OTLP transports
+type client interface {
+	connect() error
+	export(ctx context.Context, request *colmetricspb.ExportMetricsServiceRequest) (*colmetricspb.ExportMetricsServiceResponse, error)
+	close()
+}
+
+// grpcError classifies gRPC failures the way the OTLP spec asks exporters to
+type grpcError struct {
+	err error
+}
+
+func (e *grpcError) Error() string {
+	return e.err.Error()
+}
+
+func (e *grpcError) Unwrap() error {
+	return e.err
+}
+
+func (e *grpcError) Transient() bool {
+	switch status.Code(e.err) {
+	case codes.Unavailable,
+		codes.ResourceExhausted,
+		codes.DeadlineExceeded,
+		codes.Aborted,
+		codes.OutOfRange,
+		codes.DataLoss:
+		return true
+	}
+
+	return false
+}
+
+type grpcClient struct {
+	endpoint string
+	tls      *tls.Config
+	headers  map[string]string
+	gzip     bool
+
+	conn    *grpc.ClientConn
+	service colmetricspb.MetricsServiceClient
+}
+
+func (c *grpcClient) connect() error {
+	creds := insecure.NewCredentials()
+	if c.tls != nil {
+		creds = credentials.NewTLS(c.tls)
+	}
+
+	// dialing doesn't wait for the connection, exports fail until it's up
+	conn, err := grpc.Dial(c.endpoint, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return err
+	}
+
+	c.conn = conn
+	c.service = colmetricspb.NewMetricsServiceClient(conn)
+
+	return nil
+}
+
+func (c *grpcClient) export(ctx context.Context, request *colmetricspb.ExportMetricsServiceRequest) (*colmetricspb.ExportMetricsServiceResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if len(c.headers) > 0 {
+		ctx = metadata.NewOutgoingContext(ctx, metadata.New(c.headers))
+	}
+
+	var opts []grpc.CallOption
+	if c.gzip {
+		opts = append(opts, grpc.UseCompressor(grpcgzip.Name))
+	}
+
+	resp, err := c.service.Export(ctx, request, opts...)
+	if err != nil {
+		return nil, &grpcError{err: err}
+	}
+
+	return resp, nil
+}
+
+func (c *grpcClient) close() {
+	if c.conn == nil {
+		return
+	}
+
+	err := c.conn.Close()
+	if err != nil {
+		logrus.WithError(err).Debug("closing otlp connection failed")
+	}
+}
+
+type httpClient struct {
+	url     string
+	headers map[string]string
+	gzip    bool
+	client  *http.Client
+}
+
+func (c *httpClient) connect() error {
+	return nil
+}
+
+func (c *httpClient) export(ctx context.Context, request *colmetricspb.ExportMetricsServiceRequest) (*colmetricspb.ExportMetricsServiceResponse, error) {
+	body, err := proto.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	headers := http.Header{}
+	headers.Set("Content-Type", "application/x-protobuf")
+	if c.gzip {
+		headers.Set("Content-Encoding", "gzip")
+	}
+	for key, value := range c.headers {
+		headers.Set(key, value)
+	}
+
+	data, err := ingester.PostBody(ctx, c.client, c.url, body, headers)
+	if err != nil {
+		var statusErr *ingester.StatusError
+		if errors.As(err, &statusErr) {
+			statusErr.Message = statusMessage(data)
+		}
+		return nil, err
+	}
+
+	response := &colmetricspb.ExportMetricsServiceResponse{}
+	err = proto.Unmarshal(data, response)
+	if err != nil {
+		return nil, fmt.Errorf("decoding response: %w", err)
+	}
+
+	return response, nil
+}
+
+func (c *httpClient) close() {}
+
+// statusMessage picks the message out of the google.rpc.Status the collector
+// responds with
+func statusMessage(data []byte) string {
+	s := &spb.Status{}
+	if proto.Unmarshal(data, s) == nil && s.GetMessage() != "" {
+		return s.GetMessage()
+	}
+
+	return strings.TrimSpace(string(data))
+}
@@ -0,0 +1,239 @@
+package otlp
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+)
+
+// scope names the instrumentation scope of everything the bridge exports
+const scope = "github.com/ryanrolds/plant-collector/bridge"
+
+// instrument is how a metric is exported
+type instrument struct {
+	name        string
+	unit        string
+	description string
+}
+
+// instruments use UCUM units as OpenTelemetry recommends
+var instruments = map[string]instrument{
+	ingester.MetricTemperature:    {name: "plant.temperature", unit: "Cel", description: "Air temperature"},
+	ingester.MetricLight:          {name: "plant.illuminance", unit: "lx", description: "Illuminance"},
+	ingester.MetricMoisture:       {name: "plant.soil.moisture", unit: "%", description: "Soil moisture"},
+	ingester.MetricConductivity:   {name: "plant.soil.conductivity", unit: "uS/cm", description: "Soil conductivity"},
+	ingester.MetricHumidity:       {name: "plant.humidity", unit: "%", description: "Air humidity"},
+	ingester.MetricBattery:        {name: "plant.sensor.battery", unit: "%", description: "Sensor battery level"},
+	ingester.MetricBatteryVoltage: {name: "plant.sensor.battery.voltage", unit: "V", description: "Sensor battery voltage"},
+	ingester.MetricVPD:            {name: "plant.vpd", unit: "kPa", description: "Vapour pressure deficit"},
+	ingester.MetricDewPoint:       {name: "plant.dew_point", unit: "Cel", description: "Dew point"},
+	ingester.MetricPPFD:           {name: "plant.ppfd", unit: "umol/m2/s", description: "Estimated photosynthetic photon flux density"},
+	ingester.MetricDLI:            {name: "plant.dli", unit: "mol/m2/d", description: "Daily light integral so far today"},
+	ingester.MetricRssi:           {name: "plant.sensor.rssi", unit: "dBm", description: "Signal strength of the sensor's advertisement"},
+}
+
+// resourceMetrics wraps metrics in the bridge's resource and scope
+func resourceMetrics(resource []*commonpb.KeyValue, metrics []*metricspb.Metric) *metricspb.ResourceMetrics {
+	return &metricspb.ResourceMetrics{
+		Resource: &resourcepb.Resource{Attributes: resource},
+		ScopeMetrics: []*metricspb.ScopeMetrics{{
+			Scope:   &commonpb.InstrumentationScope{Name: scope},
+			Metrics: metrics,
+		}},
+	}
+}
+
+// sampleMetrics maps each measurement to a gauge, a data point per sample
+// with the sample's plant, zone and device. Readings flagged by validation
+// aren't exported.
+func sampleMetrics(samples []ingester.Sample) []*metricspb.Metric {
+	gauges := make(map[string]*metricspb.Gauge)
+
+	var metrics []*metricspb.Metric
+	for _, s := range samples {
+		attributes := attributes(map[string]string{
+			"plant":       s.Plant,
+			"zone":        s.Zone,
+			"device":      s.Device,
+			"device_type": s.DeviceType,
+		})
+
+		for _, metric := range ingester.Metrics {
+			value, ok := s.Value(metric)
+			if !ok {
+				continue
+			}
+			if _, flagged := s.Quality[metric]; flagged {
+				continue
+			}
+
+			gauge, ok := gauges[metric]
+			if !ok {
+				gauge = &metricspb.Gauge{}
+				gauges[metric] = gauge
+
+				i := instruments[metric]
+				metrics = append(metrics, &metricspb.Metric{
+					Name:        i.name,
+					Unit:        i.unit,
+					Description: i.description,
+					Data:        &metricspb.Metric_Gauge{Gauge: gauge},
+				})
+			}
+
+			gauge.DataPoints = append(gauge.DataPoints, &metricspb.NumberDataPoint{
+				Attributes:   attributes,
+				TimeUnixNano: uint64(s.Time.UnixNano()),
+				Value:        &metricspb.NumberDataPoint_AsDouble{AsDouble: value},
+			})
+		}
+	}
+
+	return metrics
+}
+
+// familyMetrics converts metric families gathered from a Prometheus registry,
+// counters become cumulative sums that started with the bridge
+func familyMetrics(families []*dto.MetricFamily, start time.Time, now time.Time) []*metricspb.Metric {
+	startNano := uint64(start.UnixNano())
+	nowNano := uint64(now.UnixNano())
+
+	metrics := make([]*metricspb.Metric, 0, len(families))
+	for _, family := range families {
+		metric := &metricspb.Metric{
+			Name:        family.GetName(),
+			Description: family.GetHelp(),
+		}
+
+		switch family.GetType() {
+		case dto.MetricType_COUNTER:
+			sum := &metricspb.Sum{
+				IsMonotonic:            true,
+				AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+			}
+			for _, m := range family.GetMetric() {
+				sum.DataPoints = append(sum.DataPoints, &metricspb.NumberDataPoint{
+					Attributes:        labels(m.GetLabel()),
+					StartTimeUnixNano: startNano,
+					TimeUnixNano:      nowNano,
+					Value:             &metricspb.NumberDataPoint_AsDouble{AsDouble: m.GetCounter().GetValue()},
+				})
+			}
+			metric.Data = &metricspb.Metric_Sum{Sum: sum}
+		case dto.MetricType_GAUGE, dto.MetricType_UNTYPED:
+			gauge := &metricspb.Gauge{}
+			for _, m := range family.GetMetric() {
+				value := m.GetGauge().GetValue()
+				if family.GetType() == dto.MetricType_UNTYPED {
+					value = m.GetUntyped().GetValue()
+				}
+
+				gauge.DataPoints = append(gauge.DataPoints, &metricspb.NumberDataPoint{
+					Attributes:   labels(m.GetLabel()),
+					TimeUnixNano: nowNano,
+					Value:        &metricspb.NumberDataPoint_AsDouble{AsDouble: value},
+				})
+			}
+			metric.Data = &metricspb.Metric_Gauge{Gauge: gauge}
+		case dto.MetricType_SUMMARY:
+			summary := &metricspb.Summary{}
+			for _, m := range family.GetMetric() {
+				point := &metricspb.SummaryDataPoint{
+					Attributes:        labels(m.GetLabel()),
+					StartTimeUnixNano: startNano,
+					TimeUnixNano:      nowNano,
+					Count:             m.GetSummary().GetSampleCount(),
+					Sum:               m.GetSummary().GetSampleSum(),
+				}
+				for _, q := range m.GetSummary().GetQuantile() {
+					point.QuantileValues = append(point.QuantileValues, &metricspb.SummaryDataPoint_ValueAtQuantile{
+						Quantile: q.GetQuantile(),
+						Value:    q.GetValue(),
+					})
+				}
+
+				summary.DataPoints = append(summary.DataPoints, point)
+			}
+			metric.Data = &metricspb.Metric_Summary{Summary: summary}
+		case dto.MetricType_HISTOGRAM:
+			histogram := &metricspb.Histogram{
+				AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+			}
+			for _, m := range family.GetMetric() {
+				histogram.DataPoints = append(histogram.DataPoints, histogramPoint(m, startNano, nowNano))
+			}
+			metric.Data = &metricspb.Metric_Histogram{Histogram: histogram}
+		default:
+			continue
+		}
+
+		metrics = append(metrics, metric)
+	}
+
+	return metrics
+}
+
+// histogramPoint turns Prometheus' cumulative buckets into OpenTelemetry's
+// per bucket counts, the +Inf bucket is implied by the bounds
+func histogramPoint(m *dto.Metric, startNano uint64, nowNano uint64) *metricspb.HistogramDataPoint {
+	h := m.GetHistogram()
+	sum := h.GetSampleSum()
+
+	point := &metricspb.HistogramDataPoint{
+		Attributes:        labels(m.GetLabel()),
+		StartTimeUnixNano: startNano,
+		TimeUnixNano:      nowNano,
+		Count:             h.GetSampleCount(),
+		Sum:               &sum,
+	}
+
+	var previous uint64
+	for _, b := range h.GetBucket() {
+		if math.IsInf(b.GetUpperBound(), 1) {
+			continue
+		}
+
+		point.ExplicitBounds = append(point.ExplicitBounds, b.GetUpperBound())
+		point.BucketCounts = append(point.BucketCounts, b.GetCumulativeCount()-previous)
+		previous = b.GetCumulativeCount()
+	}
+	point.BucketCounts = append(point.BucketCounts, h.GetSampleCount()-previous)
+
+	return point
+}
+
+func labels(pairs []*dto.LabelPair) []*commonpb.KeyValue {
+	values := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		values[pair.GetName()] = pair.GetValue()
+	}
+
+	return attributes(values)
+}
+
+// attributes returns the non-empty values as attributes sorted by key
+func attributes(values map[string]string) []*commonpb.KeyValue {
+	keys := make([]string, 0, len(values))
+	for key, value := range values {
+		if value != "" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	kvs := make([]*commonpb.KeyValue, 0, len(keys))
+	for _, key := range keys {
+		kvs = append(kvs, &commonpb.KeyValue{
+			Key:   key,
+			Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: values[key]}},
+		})
+	}
+
+	return kvs
+}
@@ -0,0 +1,248 @@
+package otlp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ryanrolds/plant-collector/bridge/internal/config"
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
+	"github.com/ryanrolds/plant-collector/bridge/internal/tlsconfig"
+	"github.com/sirupsen/logrus"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+)
+
+// Transport protocols
+const (
+	ProtocolGRPC = "grpc"
+	ProtocolHTTP = "http/protobuf"
+)
+
+const (
+	defaultServiceName     = "plant-bridge"
+	defaultMetricsInterval = time.Minute
+	timeout                = 10 * time.Second
+)
+
+// Exporter sends samples to an OpenTelemetry collector, each measurement is a
+// gauge with a data point per sample. The bridge's own metrics, everything
+// registered with the default Prometheus registry, are exported alongside on
+// an interval.
+type Exporter struct {
+	client          client
+	resource        []*commonpb.KeyValue
+	retry           ingester.RetryPolicy
+	batch           ingester.BatchPolicy
+	deadLetter      ingester.DeadLetter
+	gatherer        prometheus.Gatherer
+	metricsInterval time.Duration
+	start           time.Time
+}
+
+func NewExporter(cfg config.OTLP) (*Exporter, error) {
+	if cfg.Endpoint == "" {
+		return nil, errors.New("endpoint must be set")
+	}
+
+	batch, err := ingester.NewBatchPolicy(cfg.Batch)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &Exporter{
+		retry:           ingester.NewRetryPolicy(cfg.Retry),
+		batch:           batch,
+		gatherer:        prometheus.DefaultGatherer,
+		metricsInterval: cfg.MetricsInterval,
+		start:           time.Now(),
+	}
+
+	if e.metricsInterval == 0 {
+		e.metricsInterval = defaultMetricsInterval
+	}
+
+	resource := map[string]string{"service.name": defaultServiceName}
+	for key, value := range cfg.Resource {
+		resource[key] = value
+	}
+	e.resource = attributes(resource)
+
+	if cfg.DeadLetterPath != "" {
+		e.deadLetter = ingester.NewFileDeadLetter(cfg.DeadLetterPath)
+	}
+
+	switch cfg.Protocol {
+	case ProtocolGRPC, "":
+		c := &grpcClient{
+			endpoint: cfg.Endpoint,
+			headers:  cfg.Headers,
+			gzip:     cfg.Gzip,
+		}
+
+		if !cfg.Insecure {
+			c.tls, err = tlsconfig.Load(cfg.TLS)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		e.client = c
+	case ProtocolHTTP:
+		c := &httpClient{
+			url:     cfg.Endpoint,
+			headers: cfg.Headers,
+			gzip:    cfg.Gzip,
+			client: &http.Client{
+				Timeout: timeout,
+			},
+		}
+
+		tlsCfg, err := tlsconfig.Load(cfg.TLS)
+		if err != nil {
+			return nil, err
+		}
+		c.client.Transport = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsCfg,
+		}
+
+		e.client = c
+	default:
+		return nil, fmt.Errorf("unknown protocol %q, use grpc or http/protobuf", cfg.Protocol)
+	}
+
+	return e, nil
+}
+
+// SendAll exports samples from the source until it returns io.EOF or the
+// context is cancelled, and the bridge's metrics until then
+func (e *Exporter) SendAll(ctx context.Context, source ingester.Source) error {
+	err := e.client.connect()
+	if err != nil {
+		return err
+	}
+	defer e.client.close()
+
+	metricsCtx, stopMetrics := context.WithCancel(ctx)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		e.exportBridgeMetrics(metricsCtx)
+	}()
+	defer func() {
+		stopMetrics()
+		<-stopped
+	}()
+
+	for {
+		// batches are sized by the samples' JSON, near enough to their protobuf
+		b, err := e.batch.Collect(ctx, source, ingester.EncodeJSON)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if errors.Is(err, io.EOF) {
+			logrus.Debug("all samples exported")
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if !e.deliver(ctx, b.Samples) {
+			return nil
+		}
+
+		err = source.Ack()
+		if err != nil {
+			logrus.WithError(err).Error("failed to acknowledge samples")
+		}
+	}
+}
+
+// deliver exports the samples, retrying transient failures. Returns false
+// when interrupted by shutdown, the samples are left to be sent again.
+func (e *Exporter) deliver(ctx context.Context, samples []ingester.Sample) bool {
+	metrics := sampleMetrics(samples)
+	if len(metrics) == 0 {
+		return true
+	}
+
+	err := e.retry.Do(ctx, func() error {
+		return e.export(ctx, metrics)
+	})
+	if err == nil {
+		return true
+	}
+
+	if ctx.Err() != nil {
+		logrus.WithError(err).Warn("samples not exported before shutdown")
+		return false
+	}
+
+	logrus.WithError(err).WithField("samples", len(samples)).Error("failed to export samples")
+	for _, s := range samples {
+		e.store(s, err)
+	}
+
+	return true
+}
+
+func (e *Exporter) export(ctx context.Context, metrics []*metricspb.Metric) error {
+	resp, err := e.client.export(ctx, &colmetricspb.ExportMetricsServiceRequest{
+		ResourceMetrics: []*metricspb.ResourceMetrics{resourceMetrics(e.resource, metrics)},
+	})
+	if err != nil {
+		return err
+	}
+
+	// the collector took the rest, sending the rejected points again won't help
+	if partial := resp.GetPartialSuccess(); partial.GetRejectedDataPoints() > 0 {
+		logrus.WithFields(logrus.Fields{
+			"rejected": partial.GetRejectedDataPoints(),
+			"message":  partial.GetErrorMessage(),
+		}).Warn("collector rejected some data points")
+	}
+
+	return nil
+}
+
+// exportBridgeMetrics exports the gathered metrics on every interval until
+// the context is cancelled, a failed export is skipped rather than retried
+func (e *Exporter) exportBridgeMetrics(ctx context.Context) {
+	ticker := time.NewTicker(e.metricsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			families, err := e.gatherer.Gather()
+			if err != nil {
+				logrus.WithError(err).Warn("failed to gather bridge metrics")
+			}
+
+			err = e.export(ctx, familyMetrics(families, e.start, now))
+			if err != nil && ctx.Err() == nil {
+				logrus.WithError(err).Warn("failed to export bridge metrics")
+			}
+		}
+	}
+}
+
+func (e *Exporter) store(s ingester.Sample, reason error) {
+	if e.deadLetter == nil {
+		return
+	}
+
+	err := e.deadLetter.Store(s, reason)
+	if err != nil {
+		logrus.WithError(err).Error("failed to store dead letter")
+	}
+}
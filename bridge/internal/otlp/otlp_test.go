@@ -0,0 +1,279 @@
+package otlp
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ryanrolds/plant-collector/bridge/internal/config"
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester/ingestertest"
+	"github.com/stretchr/testify/assert"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// collector records the requests exported to it over either transport
+type collector struct {
+	colmetricspb.UnimplementedMetricsServiceServer
+
+	mu       sync.Mutex
+	requests []*colmetricspb.ExportMetricsServiceRequest
+	headers  []string
+}
+
+func (c *collector) Export(ctx context.Context, request *colmetricspb.ExportMetricsServiceRequest) (*colmetricspb.ExportMetricsServiceResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.requests = append(c.requests, request)
+	c.headers = append(c.headers, md.Get("x-api-key")...)
+
+	return &colmetricspb.ExportMetricsServiceResponse{}, nil
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var reader io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		reader = gz
+	}
+
+	body, _ := io.ReadAll(reader)
+
+	request := &colmetricspb.ExportMetricsServiceRequest{}
+	if proto.Unmarshal(body, request) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	c.requests = append(c.requests, request)
+	c.headers = append(c.headers, r.Header.Get("X-Api-Key"))
+	c.mu.Unlock()
+
+	data, _ := proto.Marshal(&colmetricspb.ExportMetricsServiceResponse{})
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	_, _ = w.Write(data)
+}
+
+func (c *collector) sampleRequests() []*colmetricspb.ExportMetricsServiceRequest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var requests []*colmetricspb.ExportMetricsServiceRequest
+	for _, request := range c.requests {
+		if strings.HasPrefix(request.ResourceMetrics[0].ScopeMetrics[0].Metrics[0].GetName(), "plant.") {
+			requests = append(requests, request)
+		}
+	}
+
+	return requests
+}
+
+func startGRPC(t *testing.T, c *collector) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	server := grpc.NewServer()
+	colmetricspb.RegisterMetricsServiceServer(server, c)
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	t.Cleanup(server.Stop)
+
+	return listener.Addr().String()
+}
+
+func float(v float32) *float32 {
+	return &v
+}
+
+func TestExporterSendAll(t *testing.T) {
+	start := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, protocol := range []string{ProtocolGRPC, ProtocolHTTP} {
+		t.Run(protocol, func(t *testing.T) {
+			c := &collector{}
+
+			cfg := config.OTLP{
+				Protocol: protocol,
+				Headers:  map[string]string{"x-api-key": "secret"},
+				Resource: map[string]string{"service.instance.id": "bridge-1"},
+				Batch:    config.Batch{MaxSamples: 10, MaxLatency: time.Millisecond},
+				Gzip:     true,
+			}
+
+			if protocol == ProtocolGRPC {
+				cfg.Endpoint = startGRPC(t, c)
+				cfg.Insecure = true
+			} else {
+				server := httptest.NewServer(c)
+				t.Cleanup(server.Close)
+				cfg.Endpoint = server.URL + "/v1/metrics"
+			}
+
+			e, err := NewExporter(cfg)
+			assert.Nil(t, err)
+
+			source := &ingestertest.SliceSource{Samples: []ingester.Sample{
+				{Time: start, Plant: "monstera", Zone: "tent", Device: "C4:7C:8D:6A:3D:72", Moisture: float(40), Temperature: float(21.5)},
+				{Time: start.Add(time.Second), Plant: "fern", Moisture: float(55)},
+			}}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			assert.Nil(t, e.SendAll(ctx, source))
+			assert.Equal(t, 2, source.Acked)
+
+			requests := c.sampleRequests()
+			assert.Len(t, requests, 1)
+			assert.Equal(t, "secret", c.headers[0])
+
+			rm := requests[0].ResourceMetrics[0]
+			assert.Equal(t, map[string]string{
+				"service.instance.id": "bridge-1",
+				"service.name":        "plant-bridge",
+			}, attributeMap(rm.Resource.Attributes))
+
+			metrics := rm.ScopeMetrics[0].Metrics
+			assert.Len(t, metrics, 2)
+
+			assert.Equal(t, "plant.temperature", metrics[0].Name)
+			assert.Equal(t, "Cel", metrics[0].Unit)
+
+			moisture := metrics[1]
+			assert.Equal(t, "plant.soil.moisture", moisture.Name)
+			assert.Equal(t, "%", moisture.Unit)
+			points := moisture.GetGauge().DataPoints
+			assert.Len(t, points, 2)
+			assert.Equal(t, 40.0, points[0].GetAsDouble())
+			assert.Equal(t, uint64(start.UnixNano()), points[0].TimeUnixNano)
+			assert.Equal(t, map[string]string{
+				"device": "C4:7C:8D:6A:3D:72",
+				"plant":  "monstera",
+				"zone":   "tent",
+			}, attributeMap(points[0].Attributes))
+			assert.Equal(t, map[string]string{"plant": "fern"}, attributeMap(points[1].Attributes))
+		})
+	}
+}
+
+func TestExporterBridgeMetrics(t *testing.T) {
+	c := &collector{}
+
+	e, err := NewExporter(config.OTLP{
+		Endpoint:        startGRPC(t, c),
+		Insecure:        true,
+		MetricsInterval: 10 * time.Millisecond,
+	})
+	assert.Nil(t, err)
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(prometheus.NewCounter(prometheus.CounterOpts{Name: "bridge_samples_total"}))
+	e.gatherer = registry
+
+	assert.Nil(t, e.client.connect())
+	defer e.client.close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		e.exportBridgeMetrics(ctx)
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return len(c.requests) > 0
+	}, time.Second, 10*time.Millisecond)
+
+	cancel()
+	<-done
+
+	metric := c.requests[0].ResourceMetrics[0].ScopeMetrics[0].Metrics[0]
+	assert.Equal(t, "bridge_samples_total", metric.Name)
+	assert.True(t, metric.GetSum().IsMonotonic)
+}
+
+func TestFamilyMetrics(t *testing.T) {
+	start := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+
+	registry := prometheus.NewRegistry()
+
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "queue_samples", Help: "Queued samples."}, []string{"sink"})
+	gauge.WithLabelValues("mimir").Set(12)
+
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "send_seconds", Buckets: []float64{0.1, 1}})
+	histogram.Observe(0.05)
+	histogram.Observe(0.5)
+	histogram.Observe(5)
+
+	registry.MustRegister(gauge, histogram)
+
+	families, err := registry.Gather()
+	assert.Nil(t, err)
+
+	metrics := familyMetrics(families, start, start.Add(time.Minute))
+	assert.Len(t, metrics, 2)
+
+	assert.Equal(t, "queue_samples", metrics[0].Name)
+	assert.Equal(t, "Queued samples.", metrics[0].Description)
+	point := metrics[0].GetGauge().DataPoints[0]
+	assert.Equal(t, 12.0, point.GetAsDouble())
+	assert.Equal(t, map[string]string{"sink": "mimir"}, attributeMap(point.Attributes))
+
+	h := metrics[1].GetHistogram()
+	assert.Equal(t, metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE, h.AggregationTemporality)
+	assert.Equal(t, []float64{0.1, 1}, h.DataPoints[0].ExplicitBounds)
+	assert.Equal(t, []uint64{1, 1, 1}, h.DataPoints[0].BucketCounts)
+	assert.Equal(t, uint64(3), h.DataPoints[0].Count)
+	assert.Equal(t, uint64(start.UnixNano()), h.DataPoints[0].StartTimeUnixNano)
+}
+
+func TestGRPCErrorTransient(t *testing.T) {
+	assert.True(t, ingester.IsTransient(&grpcError{err: status.Error(codes.Unavailable, "down")}))
+	assert.False(t, ingester.IsTransient(&grpcError{err: status.Error(codes.InvalidArgument, "bad")}))
+}
+
+func TestNewExporterInvalid(t *testing.T) {
+	_, err := NewExporter(config.OTLP{})
+	assert.NotNil(t, err)
+
+	_, err = NewExporter(config.OTLP{Endpoint: "localhost:4317", Protocol: "http/json"})
+	assert.NotNil(t, err)
+
+	_, err = NewExporter(config.OTLP{Endpoint: "localhost:4317", TLS: config.TLS{CA: "testdata/missing.pem"}})
+	assert.NotNil(t, err)
+}
+
+func attributeMap(kvs []*commonpb.KeyValue) map[string]string {
+	values := make(map[string]string, len(kvs))
+	for _, kv := range kvs {
+		values[kv.Key] = kv.Value.GetStringValue()
+	}
+
+	return values
+}
@@ -0,0 +1,144 @@
+package pipeline
+
+import (
+	"context"
+	"time"
+
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
+	"github.com/sirupsen/logrus"
+)
+
+// Stage processes samples on their way from the scanner to the ingester. A
+// stage can modify a sample, drop it by returning nothing or emit extra samples.
+type Stage interface {
+	Process(s ingester.Sample) []ingester.Sample
+}
+
+// Flusher is a stage that also emits samples on its own schedule, flushed
+// samples continue through the stages after it
+type Flusher interface {
+	Flush(now time.Time) []ingester.Sample
+}
+
+// Drainer is a stage holding samples back, they are emitted when the pipeline's
+// input is closed on shutdown
+type Drainer interface {
+	Drain() []ingester.Sample
+}
+
+var flushInterval = 10 * time.Second
+
+type Pipeline struct {
+	stages []Stage
+}
+
+func New(stages ...Stage) *Pipeline {
+	return &Pipeline{
+		stages: stages,
+	}
+}
+
+// Run passes samples from in through the stages, in order, to out. When in is
+// closed the samples held by the stages are drained to out and Run returns,
+// cancelling the context stops it straight away.
+func (p *Pipeline) Run(ctx context.Context, in <-chan ingester.Sample, out chan<- ingester.Sample) error {
+	logrus.Debug("starting pipeline")
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	for {
+		var samples []ingester.Sample
+
+		select {
+		case <-ctx.Done():
+			logrus.Debug("pipeline context cancelled")
+			return nil
+		case s, ok := <-in:
+			if !ok {
+				logrus.Debug("pipeline input closed, draining")
+				p.send(ctx, p.Drain(), out)
+				return nil
+			}
+
+			samples = p.Process(s)
+		case now := <-ticker.C:
+			samples = p.Flush(now)
+		}
+
+		if !p.send(ctx, samples, out) {
+			return nil
+		}
+	}
+}
+
+// send returns false if the context was cancelled before every sample was sent
+func (p *Pipeline) send(ctx context.Context, samples []ingester.Sample, out chan<- ingester.Sample) bool {
+	for _, processed := range samples {
+		select {
+		case <-ctx.Done():
+			return false
+		case out <- processed:
+		}
+	}
+
+	return true
+}
+
+// Process runs a single sample through the stages
+func (p *Pipeline) Process(s ingester.Sample) []ingester.Sample {
+	return p.processFrom(0, []ingester.Sample{s})
+}
+
+// Flush collects samples from the stages that emit on a schedule
+func (p *Pipeline) Flush(now time.Time) []ingester.Sample {
+	var samples []ingester.Sample
+	for i, stage := range p.stages {
+		flusher, ok := stage.(Flusher)
+		if !ok {
+			continue
+		}
+
+		flushed := flusher.Flush(now)
+		if len(flushed) == 0 {
+			continue
+		}
+
+		samples = append(samples, p.processFrom(i+1, flushed)...)
+	}
+
+	return samples
+}
+
+// Drain collects the samples held back by the stages
+func (p *Pipeline) Drain() []ingester.Sample {
+	var samples []ingester.Sample
+	for i, stage := range p.stages {
+		drainer, ok := stage.(Drainer)
+		if !ok {
+			continue
+		}
+
+		drained := drainer.Drain()
+		if len(drained) == 0 {
+			continue
+		}
+
+		samples = append(samples, p.processFrom(i+1, drained)...)
+	}
+
+	return samples
+}
+
+func (p *Pipeline) processFrom(first int, samples []ingester.Sample) []ingester.Sample {
+	for _, stage := range p.stages[first:] {
+		next := make([]ingester.Sample, 0, len(samples))
+		for _, sample := range samples {
+			next = append(next, stage.Process(sample)...)
+		}
+
+		samples = next
+	}
+
+	return samples
+}
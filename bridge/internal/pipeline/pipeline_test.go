@@ -0,0 +1,65 @@
+package pipeline
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
+	"github.com/stretchr/testify/assert"
+)
+
+// holdStage keeps every sample until drained
+type holdStage struct {
+	held []ingester.Sample
+}
+
+func (h *holdStage) Process(s ingester.Sample) []ingester.Sample {
+	h.held = append(h.held, s)
+	return nil
+}
+
+func (h *holdStage) Drain() []ingester.Sample {
+	held := h.held
+	h.held = nil
+	return held
+}
+
+type tagStage struct {
+	zone string
+}
+
+func (t tagStage) Process(s ingester.Sample) []ingester.Sample {
+	s.Zone = t.zone
+	return []ingester.Sample{s}
+}
+
+func TestRunDrainsOnClose(t *testing.T) {
+	p := New(&holdStage{}, tagStage{zone: "tent"})
+
+	in := make(chan ingester.Sample, 2)
+	out := make(chan ingester.Sample, 2)
+	in <- ingester.Sample{Plant: "a"}
+	in <- ingester.Sample{Plant: "b"}
+	close(in)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	assert.Nil(t, p.Run(ctx, in, out))
+	assert.Len(t, out, 2)
+
+	// drained samples pass through the later stages
+	s := <-out
+	assert.Equal(t, "a", s.Plant)
+	assert.Equal(t, "tent", s.Zone)
+}
+
+func TestRunStopsOnCancel(t *testing.T) {
+	p := New(tagStage{zone: "tent"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	assert.Nil(t, p.Run(ctx, make(chan ingester.Sample), make(chan ingester.Sample)))
+}
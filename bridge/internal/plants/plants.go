@@ -0,0 +1,125 @@
+package plants
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/ryanrolds/plant-collector/bridge/internal/config"
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
+)
+
+type Plant struct {
+	ID      string
+	Name    string
+	Species string
+	Room    string
+	Zone    string
+}
+
+type assignment struct {
+	from  time.Time
+	plant Plant
+}
+
+// Registry maps sensors to the plants they are monitoring. A sensor can be
+// moved between plants, each assignment is effective from its start time until
+// the sensor's next assignment.
+type Registry struct {
+	plants      map[string]Plant
+	assignments map[string][]assignment
+}
+
+func NewRegistry(entries []config.Plant) (*Registry, error) {
+	r := &Registry{
+		plants:      make(map[string]Plant),
+		assignments: make(map[string][]assignment),
+	}
+
+	for _, entry := range entries {
+		if entry.ID == "" {
+			return nil, fmt.Errorf("plant %q is missing an id", entry.Name)
+		}
+
+		if _, ok := r.plants[entry.ID]; ok {
+			return nil, fmt.Errorf("duplicate plant id %q", entry.ID)
+		}
+
+		plant := Plant{
+			ID:      entry.ID,
+			Name:    entry.Name,
+			Species: entry.Species,
+			Room:    entry.Room,
+			Zone:    entry.Zone,
+		}
+		r.plants[plant.ID] = plant
+
+		for _, sensor := range entry.Sensors {
+			if sensor.Device == "" {
+				return nil, fmt.Errorf("plant %q has a sensor without a device", entry.ID)
+			}
+
+			for _, existing := range r.assignments[sensor.Device] {
+				if existing.from.Equal(sensor.From) {
+					return nil, fmt.Errorf("device %s is assigned to %q and %q from %s",
+						sensor.Device, existing.plant.ID, plant.ID, sensor.From.Format(time.RFC3339))
+				}
+			}
+
+			r.assignments[sensor.Device] = append(r.assignments[sensor.Device], assignment{
+				from:  sensor.From,
+				plant: plant,
+			})
+		}
+	}
+
+	// newest assignment first
+	for _, assignments := range r.assignments {
+		sort.Slice(assignments, func(i, j int) bool {
+			return assignments[i].from.After(assignments[j].from)
+		})
+	}
+
+	return r, nil
+}
+
+// Plants returns the registered plants ordered by id
+func (r *Registry) Plants() []Plant {
+	plants := make([]Plant, 0, len(r.plants))
+	for _, plant := range r.plants {
+		plants = append(plants, plant)
+	}
+
+	sort.Slice(plants, func(i, j int) bool {
+		return plants[i].ID < plants[j].ID
+	})
+
+	return plants
+}
+
+// Lookup returns the plant the device was assigned to at the given time
+func (r *Registry) Lookup(mac string, at time.Time) (Plant, bool) {
+	for _, a := range r.assignments[config.NormalizeMAC(mac)] {
+		if !a.from.After(at) {
+			return a.plant, true
+		}
+	}
+
+	return Plant{}, false
+}
+
+// Process sets the plant, its name and zone of a sample from its device. Samples from
+// unregistered devices keep using the device MAC as the plant.
+func (r *Registry) Process(s ingester.Sample) []ingester.Sample {
+	plant, ok := r.Lookup(s.Device, s.Time)
+	if !ok {
+		s.Plant = s.Device
+		return []ingester.Sample{s}
+	}
+
+	s.Plant = plant.ID
+	s.PlantName = plant.Name
+	s.Zone = plant.Zone
+
+	return []ingester.Sample{s}
+}
@@ -0,0 +1,84 @@
+package plants
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ryanrolds/plant-collector/bridge/internal/config"
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
+	"github.com/stretchr/testify/assert"
+)
+
+var swapped = time.Date(2022, 11, 1, 0, 0, 0, 0, time.UTC)
+
+func testRegistry(t *testing.T) *Registry {
+	registry, err := NewRegistry([]config.Plant{
+		{
+			ID:   "monstera",
+			Zone: "living-room",
+			Sensors: []config.PlantSensor{
+				{Device: "01:02:03:04:05:06"},
+			},
+		},
+		{
+			ID:   "fern",
+			Name: "Bathroom fern",
+			Zone: "bathroom",
+			Sensors: []config.PlantSensor{
+				{Device: "0A:0B:0C:0D:0E:0F"},
+				{Device: "01:02:03:04:05:06", From: swapped},
+			},
+		},
+	})
+	assert.Nil(t, err)
+
+	return registry
+}
+
+func TestRegistryLookup(t *testing.T) {
+	registry := testRegistry(t)
+
+	tests := []struct {
+		name     string
+		mac      string
+		at       time.Time
+		expected string
+		ok       bool
+	}{
+		{name: "before swap", mac: "01:02:03:04:05:06", at: swapped.Add(-time.Hour), expected: "monstera", ok: true},
+		{name: "at swap", mac: "01:02:03:04:05:06", at: swapped, expected: "fern", ok: true},
+		{name: "lower case mac", mac: "0a:0b:0c:0d:0e:0f", at: swapped, expected: "fern", ok: true},
+		{name: "unknown", mac: "FF:FF:FF:FF:FF:FF", at: swapped, ok: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plant, ok := registry.Lookup(tt.mac, tt.at)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.expected, plant.ID)
+		})
+	}
+}
+
+func TestRegistryProcess(t *testing.T) {
+	registry := testRegistry(t)
+
+	out := registry.Process(ingester.Sample{Time: swapped, Device: "01:02:03:04:05:06"})
+	assert.Len(t, out, 1)
+	assert.Equal(t, "fern", out[0].Plant)
+	assert.Equal(t, "Bathroom fern", out[0].PlantName)
+	assert.Equal(t, "bathroom", out[0].Zone)
+	assert.Equal(t, "01:02:03:04:05:06", out[0].Device)
+
+	out = registry.Process(ingester.Sample{Time: swapped, Device: "FF:FF:FF:FF:FF:FF"})
+	assert.Equal(t, "FF:FF:FF:FF:FF:FF", out[0].Plant)
+	assert.Equal(t, "", out[0].Zone)
+}
+
+func TestRegistryDuplicateAssignment(t *testing.T) {
+	_, err := NewRegistry([]config.Plant{
+		{ID: "a", Sensors: []config.PlantSensor{{Device: "01:02:03:04:05:06"}}},
+		{ID: "b", Sensors: []config.PlantSensor{{Device: "01:02:03:04:05:06"}}},
+	})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,293 @@
+package quality
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ryanrolds/plant-collector/bridge/internal/config"
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
+	"github.com/sirupsen/logrus"
+)
+
+// Rejection reasons, used as the sample's quality flag
+const (
+	ReasonRange   = "out_of_range"
+	ReasonRate    = "rate_of_change"
+	ReasonOutlier = "outlier"
+)
+
+const (
+	defaultWindow    = 7
+	defaultThreshold = 3
+	// scales the median absolute deviation to a standard deviation estimate
+	madScale = 1.4826
+)
+
+type rule struct {
+	min float64
+	max float64
+	// maxRate is the largest change per minute, 0 disables the check
+	maxRate float64
+	// hampel enables the outlier filter for the metric
+	hampel bool
+	// minDeviation stops the outlier filter rejecting small changes when the
+	// window's values are (nearly) identical
+	minDeviation float64
+}
+
+// defaultRules are physical limits of the supported sensors
+var defaultRules = map[string]rule{
+	ingester.MetricTemperature:    {min: -40, max: 80, maxRate: 5, hampel: true, minDeviation: 1},
+	ingester.MetricLight:          {min: 0, max: 200000, hampel: true, minDeviation: 500},
+	ingester.MetricMoisture:       {min: 0, max: 100, maxRate: 20, hampel: true, minDeviation: 2},
+	ingester.MetricConductivity:   {min: 0, max: 10000, hampel: true, minDeviation: 50},
+	ingester.MetricHumidity:       {min: 0, max: 100, maxRate: 20, hampel: true, minDeviation: 3},
+	ingester.MetricBattery:        {min: 0, max: 100},
+	ingester.MetricBatteryVoltage: {min: 0, max: 5},
+	ingester.MetricRssi:           {min: -127, max: 20},
+}
+
+type reading struct {
+	value float64
+	time  time.Time
+}
+
+// rejection counts a metric's rejected readings by reason
+type rejection struct {
+	metric string
+	reason string
+}
+
+type history struct {
+	lastAccepted *reading
+	window       []float64
+}
+
+// Validator rejects readings outside a metric's physical range, readings that
+// change faster than is physically plausible and outliers picked out by a
+// Hampel filter over each device's recent readings. Rejected readings are
+// removed from the sample, or kept and flagged when forwarding is enabled.
+type Validator struct {
+	rules     map[string]rule
+	window    int
+	threshold float64
+	forward   bool
+
+	history map[string]*history
+
+	rejectedDesc *prometheus.Desc
+
+	mu       sync.Mutex
+	rejected map[rejection]uint64
+}
+
+func NewValidator(cfg config.Validation) (*Validator, error) {
+	rules := make(map[string]rule, len(defaultRules))
+	for metric, r := range defaultRules {
+		rules[metric] = r
+	}
+
+	for metric, override := range cfg.Metrics {
+		r, ok := rules[metric]
+		if !ok {
+			if !ingester.IsMetric(metric) {
+				return nil, fmt.Errorf("unknown metric %q", metric)
+			}
+			r = rule{min: math.Inf(-1), max: math.Inf(1)}
+		}
+
+		if override.Min != nil {
+			r.min = *override.Min
+		}
+		if override.Max != nil {
+			r.max = *override.Max
+		}
+		if override.MaxRate != nil {
+			r.maxRate = *override.MaxRate
+		}
+		if override.Hampel != nil {
+			r.hampel = *override.Hampel
+		}
+		if override.MinDeviation != nil {
+			r.minDeviation = *override.MinDeviation
+		}
+
+		if r.min > r.max {
+			return nil, fmt.Errorf("metric %s: min %v is above max %v", metric, r.min, r.max)
+		}
+
+		rules[metric] = r
+	}
+
+	window := cfg.Hampel.Window
+	if window == 0 {
+		window = defaultWindow
+	}
+	if window < 3 {
+		return nil, fmt.Errorf("hampel window must be at least 3, got %d", window)
+	}
+
+	threshold := cfg.Hampel.Threshold
+	if threshold == 0 {
+		threshold = defaultThreshold
+	}
+
+	return &Validator{
+		rules:     rules,
+		window:    window,
+		threshold: threshold,
+		forward:   cfg.ForwardRejected,
+		history:   make(map[string]*history),
+		rejectedDesc: prometheus.NewDesc("bridge_rejected_readings_total",
+			"Readings validation rejected, by metric and reason.", []string{"metric", "reason"}, nil),
+		rejected: make(map[rejection]uint64),
+	}, nil
+}
+
+func (v *Validator) Process(s ingester.Sample) []ingester.Sample {
+	for _, metric := range ingester.Metrics {
+		value, ok := s.Value(metric)
+		if !ok {
+			continue
+		}
+
+		r, ok := v.rules[metric]
+		if !ok {
+			continue
+		}
+
+		reason := v.check(s.Device, metric, r, reading{value: value, time: s.Time})
+		if reason == "" {
+			continue
+		}
+
+		v.reject(metric, reason)
+		logrus.WithFields(logrus.Fields{
+			"device": s.Device,
+			"metric": metric,
+			"value":  value,
+			"reason": reason,
+		}).Warn("rejected reading")
+
+		if v.forward {
+			if s.Quality == nil {
+				s.Quality = make(map[string]string)
+			}
+			s.Quality[metric] = reason
+			continue
+		}
+
+		s.ClearValue(metric)
+	}
+
+	if len(s.Values()) == 0 {
+		return nil
+	}
+
+	return []ingester.Sample{s}
+}
+
+// check returns the reason the reading is rejected or an empty string
+func (v *Validator) check(device string, metric string, r rule, current reading) string {
+	if math.IsNaN(current.value) || current.value < r.min || current.value > r.max {
+		return ReasonRange
+	}
+
+	key := device + "/" + metric
+	h, ok := v.history[key]
+	if !ok {
+		h = &history{}
+		v.history[key] = h
+	}
+
+	reason := ""
+	if r.maxRate > 0 && h.lastAccepted != nil {
+		minutes := math.Max(current.time.Sub(h.lastAccepted.time).Minutes(), 1)
+		if math.Abs(current.value-h.lastAccepted.value) > r.maxRate*minutes {
+			reason = ReasonRate
+		}
+	}
+
+	if reason == "" && r.hampel && v.isOutlier(h.window, current.value, r.minDeviation) {
+		reason = ReasonOutlier
+	}
+
+	// the window holds every in-range value so the filter follows real steps
+	h.window = append(h.window, current.value)
+	if len(h.window) > v.window {
+		h.window = h.window[len(h.window)-v.window:]
+	}
+
+	if reason == "" {
+		h.lastAccepted = &current
+	}
+
+	return reason
+}
+
+func (v *Validator) isOutlier(window []float64, value float64, minDeviation float64) bool {
+	// wait for enough history to judge
+	if len(window) < v.window/2+1 {
+		return false
+	}
+
+	center := median(window)
+	deviations := make([]float64, len(window))
+	for i, w := range window {
+		deviations[i] = math.Abs(w - center)
+	}
+
+	limit := math.Max(v.threshold*madScale*median(deviations), minDeviation)
+	return math.Abs(value-center) > limit
+}
+
+func median(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[middle-1] + sorted[middle]) / 2
+	}
+
+	return sorted[middle]
+}
+
+func (v *Validator) reject(metric string, reason string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.rejected[rejection{metric: metric, reason: reason}]++
+}
+
+// Rejected returns the number of rejected readings keyed by metric/reason
+func (v *Validator) Rejected() map[string]uint64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	rejected := make(map[string]uint64, len(v.rejected))
+	for r, count := range v.rejected {
+		rejected[r.metric+"/"+r.reason] = count
+	}
+
+	return rejected
+}
+
+// Describe implements prometheus.Collector
+func (v *Validator) Describe(ch chan<- *prometheus.Desc) {
+	ch <- v.rejectedDesc
+}
+
+// Collect implements prometheus.Collector
+func (v *Validator) Collect(ch chan<- prometheus.Metric) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	for r, count := range v.rejected {
+		ch <- prometheus.MustNewConstMetric(v.rejectedDesc, prometheus.CounterValue, float64(count), r.metric, r.reason)
+	}
+}
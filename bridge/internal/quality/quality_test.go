@@ -0,0 +1,120 @@
+package quality
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/ryanrolds/plant-collector/bridge/internal/config"
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
+	"github.com/stretchr/testify/assert"
+)
+
+var start = time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+
+func float(v float32) *float32 {
+	return &v
+}
+
+func sample(minute int, metric string, value float64) ingester.Sample {
+	s := ingester.Sample{
+		Time:   start.Add(time.Duration(minute) * time.Minute),
+		Device: "01:02:03:04:05:06",
+	}
+	s.SetValue(metric, value)
+
+	return s
+}
+
+func TestRange(t *testing.T) {
+	validator, err := NewValidator(config.Validation{})
+	assert.Nil(t, err)
+
+	out := validator.Process(ingester.Sample{
+		Time:        start,
+		Device:      "01:02:03:04:05:06",
+		Temperature: float(655.35),
+		Moisture:    float(21),
+	})
+	assert.Len(t, out, 1)
+	assert.Nil(t, out[0].Temperature)
+	assert.Equal(t, float32(21), *out[0].Moisture)
+
+	out = validator.Process(sample(1, ingester.MetricTemperature, 655.35))
+	assert.Len(t, out, 0)
+
+	assert.Equal(t, uint64(2), validator.Rejected()["temp/out_of_range"])
+}
+
+func TestRateOfChange(t *testing.T) {
+	validator, err := NewValidator(config.Validation{})
+	assert.Nil(t, err)
+
+	assert.Len(t, validator.Process(sample(0, ingester.MetricTemperature, 20)), 1)
+	assert.Len(t, validator.Process(sample(1, ingester.MetricTemperature, 40)), 0)
+	// slow enough over ten minutes
+	assert.Len(t, validator.Process(sample(10, ingester.MetricTemperature, 40)), 1)
+
+	assert.Equal(t, uint64(1), validator.Rejected()["temp/rate_of_change"])
+}
+
+func TestOutlier(t *testing.T) {
+	validator, err := NewValidator(config.Validation{})
+	assert.Nil(t, err)
+
+	for i, lux := range []float64{31000, 30500, 32000, 31500, 30000} {
+		assert.Len(t, validator.Process(sample(i, ingester.MetricLight, lux)), 1)
+	}
+
+	assert.Len(t, validator.Process(sample(5, ingester.MetricLight, 0)), 0)
+	assert.Len(t, validator.Process(sample(6, ingester.MetricLight, 31200)), 1)
+	assert.Equal(t, uint64(1), validator.Rejected()["light/outlier"])
+}
+
+func TestValidatorCollect(t *testing.T) {
+	validator, err := NewValidator(config.Validation{})
+	assert.Nil(t, err)
+
+	validator.Process(sample(0, ingester.MetricTemperature, 20))
+	validator.Process(sample(1, ingester.MetricTemperature, 40))
+	validator.Process(sample(2, ingester.MetricTemperature, 655.35))
+	validator.Process(sample(3, ingester.MetricMoisture, 120))
+
+	expected := `
+# HELP bridge_rejected_readings_total Readings validation rejected, by metric and reason.
+# TYPE bridge_rejected_readings_total counter
+bridge_rejected_readings_total{metric="moist",reason="out_of_range"} 1
+bridge_rejected_readings_total{metric="temp",reason="out_of_range"} 1
+bridge_rejected_readings_total{metric="temp",reason="rate_of_change"} 1
+`
+	assert.Nil(t, testutil.CollectAndCompare(validator, strings.NewReader(expected)))
+}
+
+func TestForwardRejected(t *testing.T) {
+	validator, err := NewValidator(config.Validation{ForwardRejected: true})
+	assert.Nil(t, err)
+
+	out := validator.Process(sample(0, ingester.MetricMoisture, 150))
+	assert.Len(t, out, 1)
+	assert.Equal(t, float32(150), *out[0].Moisture)
+	assert.Equal(t, ReasonRange, out[0].Quality[ingester.MetricMoisture])
+}
+
+func TestOverrides(t *testing.T) {
+	limit := 40.0
+	disabled := false
+	validator, err := NewValidator(config.Validation{
+		Metrics: map[string]config.ValidationMetric{
+			ingester.MetricTemperature: {Max: &limit, Hampel: &disabled},
+		},
+	})
+	assert.Nil(t, err)
+
+	assert.Len(t, validator.Process(sample(0, ingester.MetricTemperature, 45)), 0)
+
+	_, err = NewValidator(config.Validation{
+		Metrics: map[string]config.ValidationMetric{"pressure": {}},
+	})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,742 @@
+package queue
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ryanrolds/plant-collector/bridge/internal/config"
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
+	"github.com/sirupsen/logrus"
+)
+
+// Fsync policies
+const (
+	FsyncAlways   = "always"
+	FsyncInterval = "interval"
+	FsyncNever    = "never"
+)
+
+const (
+	defaultSegmentSize   = 4 << 20
+	defaultMaxSize       = 512 << 20
+	defaultMaxAge        = 7 * 24 * time.Hour
+	defaultFsyncInterval = time.Second
+
+	segmentExt = ".seg"
+	cursorFile = "cursor"
+	// each record is its length and checksum followed by the JSON sample
+	headerSize = 8
+	// records larger than this are treated as corruption
+	maxRecordSize = 1 << 20
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var errClosed = errors.New("queue closed")
+
+type segment struct {
+	id      uint64
+	path    string
+	size    int64
+	records int
+	modTime time.Time
+}
+
+// position is the start of a record, index counts the records before it in
+// the segment
+type position struct {
+	segment uint64
+	offset  int64
+	index   int
+}
+
+// Queue is a write-ahead queue of samples on disk. Samples are appended to
+// segment files and read back in order, a sample is only removed once it is
+// acknowledged so samples that weren't delivered are replayed after a restart.
+// When the queue grows past its size or age cap the oldest segments are dropped.
+type Queue struct {
+	dir           string
+	segmentSize   int64
+	maxSize       int64
+	maxAge        time.Duration
+	fsync         string
+	fsyncInterval time.Duration
+
+	mu       sync.Mutex
+	segments []*segment
+	writer   *os.File
+	dirty    bool
+	reader   *os.File
+	readerID uint64
+	read     position
+	pending  position
+	acked    position
+	// cursorDirty is set when the acked position hasn't been persisted
+	cursorDirty bool
+	notify      chan struct{}
+	// sealed is set once nothing more will be appended
+	sealed bool
+	closed bool
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// Open opens or creates the queue in the configured directory and replays
+// everything that wasn't acknowledged
+func Open(cfg config.Queue) (*Queue, error) {
+	q := &Queue{
+		dir:           cfg.Dir,
+		segmentSize:   cfg.SegmentSize,
+		maxSize:       cfg.MaxSize,
+		maxAge:        cfg.MaxAge,
+		fsync:         cfg.Fsync,
+		fsyncInterval: cfg.FsyncInterval,
+		notify:        make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+
+	if q.segmentSize == 0 {
+		q.segmentSize = defaultSegmentSize
+	}
+	if q.maxSize == 0 {
+		q.maxSize = defaultMaxSize
+	}
+	if q.maxAge == 0 {
+		q.maxAge = defaultMaxAge
+	}
+	if q.fsync == "" {
+		q.fsync = FsyncInterval
+	}
+	if q.fsyncInterval == 0 {
+		q.fsyncInterval = defaultFsyncInterval
+	}
+
+	switch q.fsync {
+	case FsyncAlways, FsyncInterval, FsyncNever:
+	default:
+		return nil, fmt.Errorf("unknown fsync policy %q", q.fsync)
+	}
+
+	if q.dir == "" {
+		return nil, errors.New("queue directory is required")
+	}
+
+	err := os.MkdirAll(q.dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	err = q.load()
+	if err != nil {
+		return nil, err
+	}
+
+	if q.fsync != FsyncAlways {
+		q.wg.Add(1)
+		go q.syncLoop()
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"dir":      q.dir,
+		"segments": len(q.segments),
+		"pending":  q.Len(),
+	}).Info("queue opened")
+
+	return q, nil
+}
+
+func (q *Queue) load() error {
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		seg, err := q.scan(id, filepath.Join(q.dir, name))
+		if err != nil {
+			return err
+		}
+
+		q.segments = append(q.segments, seg)
+	}
+
+	sort.Slice(q.segments, func(i, j int) bool {
+		return q.segments[i].id < q.segments[j].id
+	})
+
+	q.acked, err = q.loadCursor()
+	if err != nil {
+		return err
+	}
+
+	// the cursor may point at a segment that was dropped or truncated
+	if len(q.segments) > 0 {
+		seg := q.segment(q.acked.segment)
+		if seg == nil {
+			q.acked = position{segment: q.segments[0].id}
+		} else if q.acked.offset > seg.size || q.acked.index > seg.records {
+			q.acked = position{segment: seg.id, offset: seg.size, index: seg.records}
+		}
+	}
+
+	q.read = q.acked
+	q.pending = q.acked
+	q.removeAcked()
+
+	if len(q.segments) == 0 {
+		return q.rotate()
+	}
+
+	// keep appending to the newest segment
+	last := q.segments[len(q.segments)-1]
+	q.writer, err = os.OpenFile(last.path, os.O_WRONLY|os.O_APPEND, 0o644)
+	return err
+}
+
+// scan validates a segment's records, anything after the first bad record,
+// usually a write torn by a power cut, is cut off
+func (q *Queue) scan(id uint64, path string) (*segment, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	seg := &segment{id: id, path: path, modTime: info.ModTime()}
+	for seg.size < info.Size() {
+		n, _, err := readRecord(file, seg.size)
+		if err != nil {
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"segment": path,
+				"offset":  seg.size,
+			}).Warn("truncating corrupt segment")
+			break
+		}
+
+		seg.size += n
+		seg.records++
+	}
+
+	if seg.size < info.Size() {
+		err = os.Truncate(path, seg.size)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return seg, nil
+}
+
+func readRecord(file *os.File, offset int64) (int64, []byte, error) {
+	header := make([]byte, headerSize)
+	_, err := file.ReadAt(header, offset)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	checksum := binary.BigEndian.Uint32(header[4:8])
+	if length > maxRecordSize {
+		return 0, nil, fmt.Errorf("record length %d is too large", length)
+	}
+
+	payload := make([]byte, length)
+	_, err = file.ReadAt(payload, offset+headerSize)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if crc32.Checksum(payload, crcTable) != checksum {
+		return 0, nil, errors.New("record checksum mismatch")
+	}
+
+	return headerSize + int64(length), payload, nil
+}
+
+func (q *Queue) loadCursor() (position, error) {
+	data, err := os.ReadFile(filepath.Join(q.dir, cursorFile))
+	if errors.Is(err, os.ErrNotExist) {
+		if len(q.segments) > 0 {
+			return position{segment: q.segments[0].id}, nil
+		}
+		return position{}, nil
+	}
+	if err != nil {
+		return position{}, err
+	}
+
+	var p position
+	_, err = fmt.Sscanf(string(data), "%d %d %d", &p.segment, &p.offset, &p.index)
+	if err != nil {
+		return position{}, fmt.Errorf("reading queue cursor: %w", err)
+	}
+
+	return p, nil
+}
+
+func (q *Queue) saveCursor() error {
+	path := filepath.Join(q.dir, cursorFile)
+	tmp := path + ".tmp"
+
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(file, "%d %d %d\n", q.acked.segment, q.acked.offset, q.acked.index)
+	if err == nil && q.fsync == FsyncAlways {
+		err = file.Sync()
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	q.cursorDirty = false
+	return os.Rename(tmp, path)
+}
+
+// rotate starts a new segment, must be called with the lock held
+func (q *Queue) rotate() error {
+	if q.writer != nil {
+		err := q.writer.Sync()
+		if err != nil {
+			return err
+		}
+
+		err = q.writer.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	var id uint64 = 1
+	if len(q.segments) > 0 {
+		id = q.segments[len(q.segments)-1].id + 1
+	} else if q.acked.segment >= id {
+		id = q.acked.segment + 1
+	}
+
+	path := filepath.Join(q.dir, fmt.Sprintf("%020d%s", id, segmentExt))
+	writer, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+
+	q.writer = writer
+	q.dirty = false
+	q.segments = append(q.segments, &segment{id: id, path: path, modTime: time.Now()})
+
+	// an empty queue reads from the new segment
+	if len(q.segments) == 1 {
+		q.read = position{segment: id}
+		q.pending = q.read
+		q.acked = q.read
+	}
+
+	return nil
+}
+
+// Append adds a sample to the end of the queue
+func (q *Queue) Append(s ingester.Sample) error {
+	payload, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	record := make([]byte, headerSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(payload, crcTable))
+	copy(record[headerSize:], payload)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return errClosed
+	}
+	if q.sealed {
+		return errors.New("queue sealed")
+	}
+
+	active := q.segments[len(q.segments)-1]
+	if active.size >= q.segmentSize {
+		err = q.rotate()
+		if err != nil {
+			return err
+		}
+		active = q.segments[len(q.segments)-1]
+	}
+
+	_, err = q.writer.Write(record)
+	if err != nil {
+		return err
+	}
+
+	active.size += int64(len(record))
+	active.records++
+	active.modTime = time.Now()
+	q.dirty = true
+
+	if q.fsync == FsyncAlways {
+		err = q.writer.Sync()
+		if err != nil {
+			return err
+		}
+		q.dirty = false
+	}
+
+	q.enforceCaps()
+
+	// wake up a waiting reader
+	close(q.notify)
+	q.notify = make(chan struct{})
+
+	return nil
+}
+
+// AppendAll appends samples from the channel until it is closed or the
+// context is cancelled
+func (q *Queue) AppendAll(ctx context.Context, c <-chan ingester.Sample) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case s, ok := <-c:
+			if !ok {
+				return nil
+			}
+
+			err := q.Append(s)
+			if err != nil {
+				logrus.WithError(err).Error("failed to queue sample")
+			}
+		}
+	}
+}
+
+// enforceCaps drops the oldest segments while the queue is too large or they
+// are too old, the active segment is never dropped
+func (q *Queue) enforceCaps() {
+	var total int64
+	for _, seg := range q.segments {
+		total += seg.size
+	}
+
+	for len(q.segments) > 1 {
+		oldest := q.segments[0]
+		if total <= q.maxSize && time.Since(oldest.modTime) <= q.maxAge {
+			return
+		}
+
+		dropped := oldest.records
+		if q.acked.segment == oldest.id {
+			dropped -= q.acked.index
+		}
+
+		total -= oldest.size
+		q.dropSegment()
+
+		logrus.WithFields(logrus.Fields{
+			"segment": oldest.path,
+			"dropped": dropped,
+		}).Warn("queue cap reached, dropped oldest samples")
+	}
+}
+
+// dropSegment removes the oldest segment and moves positions pointing into it
+// to the start of the next one
+func (q *Queue) dropSegment() {
+	oldest := q.segments[0]
+	q.segments = q.segments[1:]
+
+	if q.reader != nil && q.readerID == oldest.id {
+		q.reader.Close()
+		q.reader = nil
+	}
+
+	err := os.Remove(oldest.path)
+	if err != nil {
+		logrus.WithError(err).WithField("segment", oldest.path).Error("failed to remove segment")
+	}
+
+	next := position{segment: q.segments[0].id}
+	if q.read.segment <= oldest.id {
+		q.read = next
+	}
+	if q.pending.segment <= oldest.id {
+		q.pending = next
+	}
+	if q.acked.segment <= oldest.id {
+		q.acked = next
+		q.cursorDirty = true
+	}
+}
+
+// removeAcked deletes segments that have been completely acknowledged
+func (q *Queue) removeAcked() {
+	for len(q.segments) > 1 && q.segments[0].id < q.acked.segment {
+		q.dropSegment()
+	}
+}
+
+// Seal marks the end of the input, once everything has been read Next returns
+// io.EOF instead of waiting
+func (q *Queue) Seal() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.sealed = true
+	close(q.notify)
+	q.notify = make(chan struct{})
+}
+
+// Next returns the next unread sample, waiting until one is available
+func (q *Queue) Next(ctx context.Context) (ingester.Sample, error) {
+	for {
+		q.mu.Lock()
+		if q.closed {
+			q.mu.Unlock()
+			return ingester.Sample{}, errClosed
+		}
+
+		s, ok := q.next()
+		notify := q.notify
+		sealed := q.sealed
+		q.mu.Unlock()
+
+		if ok {
+			return s, nil
+		}
+
+		if sealed {
+			return ingester.Sample{}, io.EOF
+		}
+
+		select {
+		case <-ctx.Done():
+			return ingester.Sample{}, ctx.Err()
+		case <-q.done:
+			return ingester.Sample{}, errClosed
+		case <-notify:
+		}
+	}
+}
+
+// next reads the record at the read position, must be called with the lock held
+func (q *Queue) next() (ingester.Sample, bool) {
+	for {
+		seg := q.segment(q.read.segment)
+		if seg == nil {
+			return ingester.Sample{}, false
+		}
+
+		if q.read.offset >= seg.size {
+			if seg == q.segments[len(q.segments)-1] {
+				return ingester.Sample{}, false
+			}
+
+			q.read = position{segment: q.nextSegmentID(seg.id)}
+			continue
+		}
+
+		if q.reader == nil || q.readerID != seg.id {
+			if q.reader != nil {
+				q.reader.Close()
+			}
+
+			reader, err := os.Open(seg.path)
+			if err != nil {
+				logrus.WithError(err).WithField("segment", seg.path).Error("failed to open segment")
+				return ingester.Sample{}, false
+			}
+
+			q.reader = reader
+			q.readerID = seg.id
+		}
+
+		n, payload, err := readRecord(q.reader, q.read.offset)
+		if err != nil {
+			// skip the rest of a segment that was damaged after it was written
+			logrus.WithError(err).WithField("segment", seg.path).Error("skipping corrupt segment")
+			q.read.offset = seg.size
+			q.read.index = seg.records
+			continue
+		}
+
+		q.read.offset += n
+		q.read.index++
+
+		var s ingester.Sample
+		err = json.Unmarshal(payload, &s)
+		if err != nil {
+			logrus.WithError(err).Error("skipping undecodable sample")
+			continue
+		}
+
+		q.pending = q.read
+		return s, true
+	}
+}
+
+func (q *Queue) segment(id uint64) *segment {
+	for _, seg := range q.segments {
+		if seg.id == id {
+			return seg
+		}
+	}
+
+	return nil
+}
+
+func (q *Queue) nextSegmentID(id uint64) uint64 {
+	for _, seg := range q.segments {
+		if seg.id > id {
+			return seg.id
+		}
+	}
+
+	return id
+}
+
+// Ack acknowledges every sample returned by Next so far, they won't be
+// replayed after a restart
+func (q *Queue) Ack() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return errClosed
+	}
+
+	q.acked = q.pending
+	q.cursorDirty = true
+	q.removeAcked()
+
+	if q.fsync == FsyncAlways {
+		return q.saveCursor()
+	}
+
+	return nil
+}
+
+// Len returns the number of samples that haven't been acknowledged
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	count := 0
+	for _, seg := range q.segments {
+		if seg.id < q.acked.segment {
+			continue
+		}
+
+		count += seg.records
+		if seg.id == q.acked.segment {
+			count -= q.acked.index
+		}
+	}
+
+	return count
+}
+
+func (q *Queue) syncLoop() {
+	defer q.wg.Done()
+
+	ticker := time.NewTicker(q.fsyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-q.done:
+			return
+		case <-ticker.C:
+			q.mu.Lock()
+			err := q.sync()
+			q.mu.Unlock()
+			if err != nil {
+				logrus.WithError(err).Error("failed to sync queue")
+			}
+		}
+	}
+}
+
+// sync flushes appended records, unless fsync is disabled, and saves the
+// cursor. Must be called with the lock held.
+func (q *Queue) sync() error {
+	if q.dirty && q.fsync != FsyncNever {
+		err := q.writer.Sync()
+		if err != nil {
+			return err
+		}
+		q.dirty = false
+	}
+
+	if q.cursorDirty {
+		return q.saveCursor()
+	}
+
+	return nil
+}
+
+// Close flushes the queue to disk
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return nil
+	}
+
+	q.closed = true
+	close(q.done)
+	q.mu.Unlock()
+
+	q.wg.Wait()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	err := q.sync()
+	if q.reader != nil {
+		q.reader.Close()
+	}
+
+	closeErr := q.writer.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	return err
+}
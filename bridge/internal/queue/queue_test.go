@@ -0,0 +1,152 @@
+package queue
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ryanrolds/plant-collector/bridge/internal/config"
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
+	"github.com/stretchr/testify/assert"
+)
+
+func openQueue(t *testing.T, cfg config.Queue) *Queue {
+	q, err := Open(cfg)
+	assert.Nil(t, err)
+
+	return q
+}
+
+func appendPlants(t *testing.T, q *Queue, plants ...string) {
+	for _, plant := range plants {
+		assert.Nil(t, q.Append(ingester.Sample{Plant: plant}))
+	}
+}
+
+func next(t *testing.T, q *Queue) string {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	s, err := q.Next(ctx)
+	assert.Nil(t, err)
+
+	return s.Plant
+}
+
+func TestQueueInOrder(t *testing.T) {
+	q := openQueue(t, config.Queue{Dir: t.TempDir()})
+	defer q.Close()
+
+	appendPlants(t, q, "a", "b", "c")
+	assert.Equal(t, 3, q.Len())
+
+	assert.Equal(t, "a", next(t, q))
+	assert.Nil(t, q.Ack())
+	assert.Equal(t, "b", next(t, q))
+	assert.Nil(t, q.Ack())
+	assert.Equal(t, 1, q.Len())
+}
+
+func TestQueueWaitsForAppend(t *testing.T) {
+	q := openQueue(t, config.Queue{Dir: t.TempDir()})
+	defer q.Close()
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		appendPlants(t, q, "late")
+	}()
+
+	assert.Equal(t, "late", next(t, q))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := q.Next(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestQueueReplaysUnacked(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.Queue{Dir: dir, SegmentSize: 64}
+
+	q := openQueue(t, cfg)
+	appendPlants(t, q, "a", "b", "c", "d")
+	assert.Equal(t, "a", next(t, q))
+	assert.Equal(t, "b", next(t, q))
+	assert.Nil(t, q.Ack())
+	// read but not acknowledged
+	assert.Equal(t, "c", next(t, q))
+	assert.Nil(t, q.Close())
+
+	q = openQueue(t, cfg)
+	defer q.Close()
+
+	assert.Equal(t, 2, q.Len())
+	assert.Equal(t, "c", next(t, q))
+	assert.Equal(t, "d", next(t, q))
+	assert.Nil(t, q.Ack())
+	assert.Equal(t, 0, q.Len())
+
+	// acknowledged segments are removed
+	segments, err := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	assert.Nil(t, err)
+	assert.Len(t, segments, 1)
+}
+
+func TestQueueTruncatesTornWrite(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.Queue{Dir: dir, Fsync: FsyncAlways}
+
+	q := openQueue(t, cfg)
+	appendPlants(t, q, "a", "b")
+	assert.Nil(t, q.Close())
+
+	segments, err := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	assert.Nil(t, err)
+	info, err := os.Stat(segments[0])
+	assert.Nil(t, err)
+	assert.Nil(t, os.Truncate(segments[0], info.Size()-3))
+
+	q = openQueue(t, cfg)
+	defer q.Close()
+
+	assert.Equal(t, 1, q.Len())
+	assert.Equal(t, "a", next(t, q))
+
+	appendPlants(t, q, "c")
+	assert.Equal(t, "c", next(t, q))
+}
+
+func TestQueueSizeCap(t *testing.T) {
+	q := openQueue(t, config.Queue{Dir: t.TempDir(), SegmentSize: 64, MaxSize: 300})
+	defer q.Close()
+
+	for i := 0; i < 20; i++ {
+		appendPlants(t, q, "plant")
+	}
+
+	assert.Less(t, q.Len(), 20)
+	assert.Greater(t, q.Len(), 0)
+	assert.Equal(t, "plant", next(t, q))
+}
+
+func TestInvalidFsync(t *testing.T) {
+	_, err := Open(config.Queue{Dir: t.TempDir(), Fsync: "sometimes"})
+	assert.NotNil(t, err)
+}
+
+func TestQueueSeal(t *testing.T) {
+	q := openQueue(t, config.Queue{Dir: t.TempDir()})
+	defer q.Close()
+
+	appendPlants(t, q, "a")
+	q.Seal()
+
+	assert.NotNil(t, q.Append(ingester.Sample{Plant: "b"}))
+	assert.Equal(t, "a", next(t, q))
+
+	_, err := q.Next(context.Background())
+	assert.ErrorIs(t, err, io.EOF)
+}
@@ -0,0 +1,111 @@
+package remotewrite
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
+	"github.com/ryanrolds/plant-collector/bridge/internal/metrics"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Field numbers of the remote write protobuf messages, see prompb in the
+// Prometheus repository
+const (
+	writeRequestTimeseries = 1
+
+	timeSeriesLabels  = 1
+	timeSeriesSamples = 2
+
+	labelName  = 1
+	labelValue = 2
+
+	sampleValue     = 1
+	sampleTimestamp = 2
+)
+
+type label struct {
+	name  string
+	value string
+}
+
+// encode returns the sample as the timeseries entries of a WriteRequest, a
+// series per metric plus the sensor's last seen time. The entries of several
+// samples concatenate into a valid WriteRequest. Unlike /metrics, which is
+// scraped from a single bridge, the series carry the collector and site that
+// heard the sample so several bridges can write to the same receiver.
+func encode(s ingester.Sample) ([]byte, error) {
+	labels := make([]label, 0, len(metrics.Labels)+2)
+	for _, l := range []label{
+		{name: metrics.Labels[0], value: s.Plant},
+		{name: metrics.Labels[1], value: s.Zone},
+		{name: metrics.Labels[2], value: s.Device},
+		{name: "collector", value: s.Collector},
+		{name: "site", value: s.Site},
+	} {
+		// an empty label is the same as a missing one
+		if l.value == "" {
+			continue
+		}
+
+		labels = append(labels, l)
+	}
+
+	timestamp := s.Time.UnixMilli()
+
+	var b []byte
+	for _, metric := range ingester.Metrics {
+		value, ok := s.Value(metric)
+		if !ok {
+			continue
+		}
+		if _, flagged := s.Quality[metric]; flagged {
+			continue
+		}
+
+		b = appendSeries(b, metrics.Names[metric], labels, value, timestamp)
+	}
+
+	if len(b) == 0 {
+		return nil, nil
+	}
+
+	lastSeen := float64(s.Time.UnixNano()) / float64(time.Second)
+	b = appendSeries(b, metrics.LastSeenName, labels, lastSeen, timestamp)
+
+	return b, nil
+}
+
+// appendSeries appends a TimeSeries with one sample, receivers expect the
+// labels sorted by name
+func appendSeries(b []byte, name string, labels []label, value float64, timestamp int64) []byte {
+	all := append([]label{{name: "__name__", value: name}}, labels...)
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].name < all[j].name
+	})
+
+	var series []byte
+	for _, l := range all {
+		var encoded []byte
+		encoded = protowire.AppendTag(encoded, labelName, protowire.BytesType)
+		encoded = protowire.AppendString(encoded, l.name)
+		encoded = protowire.AppendTag(encoded, labelValue, protowire.BytesType)
+		encoded = protowire.AppendString(encoded, l.value)
+
+		series = protowire.AppendTag(series, timeSeriesLabels, protowire.BytesType)
+		series = protowire.AppendBytes(series, encoded)
+	}
+
+	var sample []byte
+	sample = protowire.AppendTag(sample, sampleValue, protowire.Fixed64Type)
+	sample = protowire.AppendFixed64(sample, math.Float64bits(value))
+	sample = protowire.AppendTag(sample, sampleTimestamp, protowire.VarintType)
+	sample = protowire.AppendVarint(sample, uint64(timestamp))
+
+	series = protowire.AppendTag(series, timeSeriesSamples, protowire.BytesType)
+	series = protowire.AppendBytes(series, sample)
+
+	b = protowire.AppendTag(b, writeRequestTimeseries, protowire.BytesType)
+	return protowire.AppendBytes(b, series)
+}
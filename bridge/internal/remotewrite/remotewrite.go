@@ -0,0 +1,146 @@
+package remotewrite
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/ryanrolds/plant-collector/bridge/internal/config"
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	timeout = 10 * time.Second
+)
+
+// Writer pushes samples to a Prometheus remote write receiver such as
+// Prometheus, Mimir or VictoriaMetrics. Series are named and labelled like the
+// /metrics endpoint's gauges, see the metrics package.
+type Writer struct {
+	url         string
+	client      *http.Client
+	bearerToken string
+	username    string
+	password    string
+	retry       ingester.RetryPolicy
+	batch       ingester.BatchPolicy
+	deadLetter  ingester.DeadLetter
+}
+
+func NewWriter(cfg config.RemoteWrite) (*Writer, error) {
+	if cfg.URL == "" {
+		return nil, errors.New("url must be set")
+	}
+
+	batch, err := ingester.NewBatchPolicy(cfg.Batch)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Writer{
+		url: cfg.URL,
+		client: &http.Client{
+			Timeout: timeout,
+		},
+		bearerToken: cfg.BearerToken,
+		username:    cfg.Username,
+		password:    cfg.Password,
+		retry:       ingester.NewRetryPolicy(cfg.Retry),
+		batch:       batch,
+	}
+
+	if cfg.DeadLetterPath != "" {
+		w.deadLetter = ingester.NewFileDeadLetter(cfg.DeadLetterPath)
+	}
+
+	return w, nil
+}
+
+// SendAll pushes samples from the source until it returns io.EOF or the
+// context is cancelled
+func (w *Writer) SendAll(ctx context.Context, source ingester.Source) error {
+	for {
+		b, err := w.batch.Collect(ctx, source, encode)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if errors.Is(err, io.EOF) {
+			logrus.Debug("all samples pushed")
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if !w.deliver(ctx, b.Samples, bytes.Join(b.Encoded, nil)) {
+			return nil
+		}
+
+		err = source.Ack()
+		if err != nil {
+			logrus.WithError(err).Error("failed to acknowledge samples")
+		}
+	}
+}
+
+// deliver pushes the write request, retrying transient failures. Returns
+// false when interrupted by shutdown, the samples are left to be sent again.
+func (w *Writer) deliver(ctx context.Context, samples []ingester.Sample, request []byte) bool {
+	if len(request) == 0 {
+		return true
+	}
+
+	body := snappy.Encode(nil, request)
+	err := w.retry.Do(ctx, func() error {
+		return w.send(ctx, body)
+	})
+	if err == nil {
+		return true
+	}
+
+	if ctx.Err() != nil {
+		logrus.WithError(err).Warn("samples not pushed before shutdown")
+		return false
+	}
+
+	// receivers reject the whole request, e.g. for out of order samples, so
+	// retrying parts of it isn't worth it
+	logrus.WithError(err).WithField("samples", len(samples)).Error("failed to push samples")
+	for _, s := range samples {
+		w.store(s, err)
+	}
+
+	return true
+}
+
+func (w *Writer) store(s ingester.Sample, reason error) {
+	if w.deadLetter == nil {
+		return
+	}
+
+	err := w.deadLetter.Store(s, reason)
+	if err != nil {
+		logrus.WithError(err).Error("failed to store dead letter")
+	}
+}
+
+func (w *Writer) send(ctx context.Context, body []byte) error {
+	headers := http.Header{}
+	headers.Set("Content-Type", "application/x-protobuf")
+	headers.Set("Content-Encoding", "snappy")
+	headers.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	if w.bearerToken != "" {
+		headers.Set("Authorization", "Bearer "+w.bearerToken)
+	} else if w.username != "" {
+		headers.Set("Authorization", ingester.BasicAuth(w.username, w.password))
+	}
+
+	_, err := ingester.PostBody(ctx, w.client, w.url, body, headers)
+	return err
+}
@@ -0,0 +1,232 @@
+package remotewrite
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/ryanrolds/plant-collector/bridge/internal/config"
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester/ingestertest"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// series is a decoded TimeSeries with a single sample
+type series struct {
+	labels    []label
+	value     float64
+	timestamp int64
+}
+
+// messages returns the length-delimited fields of a message
+func messages(t *testing.T, b []byte) map[protowire.Number][][]byte {
+	fields := make(map[protowire.Number][][]byte)
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		assert.True(t, n > 0)
+		b = b[n:]
+
+		switch typ {
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			assert.True(t, n > 0)
+			fields[num] = append(fields[num], v)
+			b = b[n:]
+		case protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(b)
+			fields[num] = append(fields[num], protowire.AppendFixed64(nil, v))
+			b = b[n:]
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			fields[num] = append(fields[num], protowire.AppendVarint(nil, v))
+			b = b[n:]
+		default:
+			t.Fatalf("unexpected wire type %d", typ)
+		}
+	}
+
+	return fields
+}
+
+func decode(t *testing.T, request []byte) []series {
+	var decoded []series
+	for _, ts := range messages(t, request)[writeRequestTimeseries] {
+		fields := messages(t, ts)
+
+		var s series
+		for _, l := range fields[timeSeriesLabels] {
+			lf := messages(t, l)
+			s.labels = append(s.labels, label{name: string(lf[labelName][0]), value: string(lf[labelValue][0])})
+		}
+
+		assert.Len(t, fields[timeSeriesSamples], 1)
+		sf := messages(t, fields[timeSeriesSamples][0])
+		bits, _ := protowire.ConsumeFixed64(sf[sampleValue][0])
+		s.value = math.Float64frombits(bits)
+		timestamp, _ := protowire.ConsumeVarint(sf[sampleTimestamp][0])
+		s.timestamp = int64(timestamp)
+
+		decoded = append(decoded, s)
+	}
+
+	return decoded
+}
+
+type receiver struct {
+	t *testing.T
+
+	mu       sync.Mutex
+	headers  []http.Header
+	requests [][]series
+	status   int
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	request, err := snappy.Decode(nil, body)
+	assert.Nil(r.t, err)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.headers = append(r.headers, req.Header)
+	r.requests = append(r.requests, decode(r.t, request))
+
+	if r.status != 0 {
+		http.Error(w, "out of order sample", r.status)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type memoryDeadLetter struct {
+	samples []ingester.Sample
+}
+
+func (d *memoryDeadLetter) Store(s ingester.Sample, reason error) error {
+	d.samples = append(d.samples, s)
+	return nil
+}
+
+func float(v float32) *float32 {
+	return &v
+}
+
+func integer(v int) *int {
+	return &v
+}
+
+func TestWriterSendAll(t *testing.T) {
+	start := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+
+	r := &receiver{t: t}
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	w, err := NewWriter(config.RemoteWrite{
+		URL:         server.URL,
+		BearerToken: "secret-token",
+		Batch:       config.Batch{MaxSamples: 10, MaxLatency: time.Millisecond},
+	})
+	assert.Nil(t, err)
+
+	source := &ingestertest.SliceSource{Samples: []ingester.Sample{
+		{
+			Time:        start,
+			Plant:       "monstera",
+			Zone:        "tent",
+			Device:      "C4:7C:8D:6A:3D:72",
+			Collector:   "greenhouse-pi",
+			Site:        "home",
+			Temperature: float(85),
+			Moisture:    float(40),
+			Quality:     map[string]string{ingester.MetricTemperature: "out_of_range"},
+		},
+		{Time: start.Add(time.Second), Plant: "fern", Rssi: integer(-71)},
+		{Time: start, Plant: "fern"},
+	}}
+
+	assert.Nil(t, w.SendAll(context.Background(), source))
+	assert.Equal(t, 3, source.Acked)
+
+	assert.Len(t, r.requests, 1)
+	assert.Equal(t, "snappy", r.headers[0].Get("Content-Encoding"))
+	assert.Equal(t, "application/x-protobuf", r.headers[0].Get("Content-Type"))
+	assert.Equal(t, "0.1.0", r.headers[0].Get("X-Prometheus-Remote-Write-Version"))
+	assert.Equal(t, "Bearer secret-token", r.headers[0].Get("Authorization"))
+
+	monstera := []label{
+		{name: "collector", value: "greenhouse-pi"},
+		{name: "device", value: "C4:7C:8D:6A:3D:72"},
+		{name: "plant", value: "monstera"},
+		{name: "site", value: "home"},
+		{name: "zone", value: "tent"},
+	}
+	fern := []label{{name: "plant", value: "fern"}}
+
+	assert.Equal(t, []series{
+		{
+			labels:    append([]label{{name: "__name__", value: "plant_soil_moisture_percent"}}, monstera...),
+			value:     40,
+			timestamp: 1667304000000,
+		},
+		{
+			labels:    append([]label{{name: "__name__", value: "plant_sensor_last_seen_timestamp_seconds"}}, monstera...),
+			value:     1667304000,
+			timestamp: 1667304000000,
+		},
+		{
+			labels:    append([]label{{name: "__name__", value: "plant_sensor_rssi_dbm"}}, fern...),
+			value:     -71,
+			timestamp: 1667304001000,
+		},
+		{
+			labels:    append([]label{{name: "__name__", value: "plant_sensor_last_seen_timestamp_seconds"}}, fern...),
+			value:     1667304001,
+			timestamp: 1667304001000,
+		},
+	}, r.requests[0])
+}
+
+func TestWriterRejected(t *testing.T) {
+	r := &receiver{t: t, status: http.StatusBadRequest}
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	deadLetter := &memoryDeadLetter{}
+	w, err := NewWriter(config.RemoteWrite{URL: server.URL, Username: "bridge", Password: "secret"})
+	assert.Nil(t, err)
+	w.deadLetter = deadLetter
+
+	source := &ingestertest.SliceSource{Samples: []ingester.Sample{
+		{Time: time.Now(), Plant: "monstera", Moisture: float(40)},
+	}}
+
+	assert.Nil(t, w.SendAll(context.Background(), source))
+	assert.Equal(t, 1, source.Acked)
+
+	// client errors aren't retried
+	assert.Len(t, r.requests, 1)
+	user, password, ok := (&http.Request{Header: r.headers[0]}).BasicAuth()
+	assert.True(t, ok)
+	assert.Equal(t, "bridge", user)
+	assert.Equal(t, "secret", password)
+
+	assert.Len(t, deadLetter.samples, 1)
+}
+
+func TestNewWriterInvalid(t *testing.T) {
+	_, err := NewWriter(config.RemoteWrite{})
+	assert.NotNil(t, err)
+
+	_, err = NewWriter(config.RemoteWrite{URL: "http://localhost:9009/api/v1/push", Batch: config.Batch{Format: "xml"}})
+	assert.NotNil(t, err)
+}
@@ -4,12 +4,20 @@ import (
 	"encoding/binary"
 	"time"
 
+	"github.com/ryanrolds/plant-collector/bridge/internal/battery"
 	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
 	"github.com/sirupsen/logrus"
 	"tinygo.org/x/bluetooth"
 )
 
-func ParseBparasiteData(device bluetooth.ScanResult) (ingester.Sample, bool) {
+// TypeBparasite identifies samples from b-parasite sensors
+const TypeBparasite = "b-parasite"
+
+// BparasiteBattery is the battery profile used when a b-parasite isn't configured
+// with one, the stock board runs from a CR2032
+var BparasiteBattery = battery.CR2032
+
+func ParseBparasiteData(device bluetooth.ScanResult, profile battery.Profile) (ingester.Sample, bool) {
 	macAddr := device.Address.String()
 	log := logrus.WithField("mac", macAddr)
 
@@ -31,21 +39,20 @@ func ParseBparasiteData(device bluetooth.ScanResult) (ingester.Sample, bool) {
 		soilMoisture := 100 * (float32(binary.BigEndian.Uint16(sensorData[8:10])) / (1 << 16)) // percent
 		lux := float32(binary.BigEndian.Uint16(sensorData[16:18]))
 
-		// very basic % calculation
-		// TODO figure out the actual battery voltage range and curve
-		batteryPercentage := int(batteryVoltage / 3.3 * 100)
+		batteryPercentage := profile.Percent(batteryVoltage)
 		rssi := int(device.RSSI)
 
 		s := ingester.Sample{
-			Time:        time.Now(),
-			Collector:   "bridge",
-			Plant:       device.Address.String(),
-			Temperature: &tempCelcius,
-			Humidity:    &humidity,
-			Moisture:    &soilMoisture,
-			Light:       &lux,
-			Battery:     &batteryPercentage,
-			Rssi:        &rssi,
+			Time:           time.Now(),
+			Device:         device.Address.String(),
+			DeviceType:     TypeBparasite,
+			Temperature:    &tempCelcius,
+			Humidity:       &humidity,
+			Moisture:       &soilMoisture,
+			Light:          &lux,
+			Battery:        &batteryPercentage,
+			BatteryVoltage: &batteryVoltage,
+			Rssi:           &rssi,
 		}
 
 		log.WithField("sample", s).Debug("received bparasite samples")
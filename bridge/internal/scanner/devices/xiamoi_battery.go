@@ -1,6 +1,8 @@
 package devices
 
 import (
+	"errors"
+	"strings"
 	"time"
 
 	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
@@ -8,6 +10,13 @@ import (
 	"tinygo.org/x/bluetooth"
 )
 
+// the Flower Care data service, its firmware characteristic (handle 0x38)
+// holds the battery level and the firmware version
+var (
+	xiaomiDataService            = mustParseUUID("00001204-0000-1000-8000-00805f9b34fb")
+	xiaomiFirmwareCharacteristic = mustParseUUID("00001a02-0000-1000-8000-00805f9b34fb")
+)
+
 var lastSeenFreshness = 30 * time.Minute
 var maxLastPollAge = 1 * time.Minute // 30 minutes
 
@@ -18,6 +27,14 @@ type XiaomiDevice struct {
 	Battery    int
 }
 
+// PollResult is the outcome of connecting to a device to read it, Err is nil
+// when the read succeeded
+type PollResult struct {
+	Device string
+	Time   time.Time
+	Err    error
+}
+
 type XiaomiBatteryPoller struct {
 	devices map[string]XiaomiDevice
 }
@@ -49,7 +66,10 @@ func (p *XiaomiBatteryPoller) AddDevice(mac string) {
 	}
 }
 
-func (p *XiaomiBatteryPoller) Poll(adapter *bluetooth.Adapter, samples chan<- ingester.Sample) {
+func (p *XiaomiBatteryPoller) Poll(adapter *bluetooth.Adapter) ([]ingester.Sample, []PollResult) {
+	var samples []ingester.Sample
+	var results []PollResult
+
 	for mac, sensor := range p.devices {
 		// if we haven't seen the device in 30 minutes, remove it
 		if time.Since(sensor.LastSeen) > lastSeenFreshness {
@@ -71,39 +91,81 @@ func (p *XiaomiBatteryPoller) Poll(adapter *bluetooth.Adapter, samples chan<- in
 			}, bluetooth.ConnectionParams{})
 			if err != nil {
 				logrus.WithError(err).Error("failed to connect to device")
+				results = append(results, PollResult{Device: mac, Time: time.Now(), Err: err})
 				continue
 			}
 
-			battery, err := p.readDeviceBattery(device)
+			battery, firmware, err := p.readDeviceBattery(device)
+			if err := device.Disconnect(); err != nil {
+				logrus.WithField("mac", mac).WithError(err).Warn("failed to disconnect from device")
+			}
+			results = append(results, PollResult{Device: mac, Time: time.Now(), Err: err})
 			if err != nil {
 				logrus.WithError(err).Error("failed to read device battery")
+				continue
 			}
 
+			sensor.LastPoll = time.Now()
 			p.devices[mac] = sensor
 
-			samples <- ingester.Sample{
-				Time:      time.Now(),
-				Collector: "bridge",
-				Plant:     mac,
-				Battery:   &battery,
-			}
+			samples = append(samples, ingester.Sample{
+				Time:       time.Now(),
+				Device:     mac,
+				DeviceType: TypeFlowerCare,
+				Battery:    &battery,
+				Firmware:   firmware,
+			})
 		}
 	}
+
+	return samples, results
 }
 
-func (p *XiaomiBatteryPoller) readDeviceBattery(device *bluetooth.Device) (int, error) {
+// readDeviceBattery reads the battery level and firmware version
+func (p *XiaomiBatteryPoller) readDeviceBattery(device *bluetooth.Device) (int, string, error) {
 	logrus.WithField("device", device).Info("polling device")
 
-	//readService := bluetooth.New16BitUUID(0x0033)
-	services, err := device.DiscoverServices(nil)
+	services, err := device.DiscoverServices([]bluetooth.UUID{xiaomiDataService})
+	if err != nil {
+		return 0, "", err
+	}
+	if len(services) == 0 {
+		return 0, "", errors.New("device has no data service")
+	}
+
+	characteristics, err := services[0].DiscoverCharacteristics([]bluetooth.UUID{xiaomiFirmwareCharacteristic})
+	if err != nil {
+		return 0, "", err
+	}
+	if len(characteristics) == 0 {
+		return 0, "", errors.New("device has no firmware characteristic")
+	}
+
+	buf := make([]byte, 16)
+	n, err := characteristics[0].Read(buf)
 	if err != nil {
-		logrus.Info("failed to discover services")
-		return 0, err
+		return 0, "", err
+	}
+
+	return parseXiaomiFirmware(buf[:n])
+}
+
+// parseXiaomiFirmware returns the battery percentage and firmware version
+// read from the firmware characteristic, the battery level followed by a
+// separator and the version as ASCII, e.g. 3.2.1
+func parseXiaomiFirmware(data []byte) (int, string, error) {
+	if len(data) < 3 {
+		return 0, "", errors.New("firmware characteristic too short")
 	}
 
-	for _, service := range services {
-		logrus.WithField("service", service).Info("found service")
+	return int(data[0]), strings.TrimRight(string(data[2:]), "\x00"), nil
+}
+
+func mustParseUUID(s string) bluetooth.UUID {
+	uuid, err := bluetooth.ParseUUID(s)
+	if err != nil {
+		panic(err)
 	}
 
-	return 0, nil
+	return uuid
 }
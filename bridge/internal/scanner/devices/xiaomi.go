@@ -10,7 +10,13 @@ import (
 	"tinygo.org/x/bluetooth"
 )
 
-func HandleXiaomiResult(device bluetooth.ScanResult, samples chan<- ingester.Sample) {
+// TypeFlowerCare identifies samples from Xiaomi Flower Care (HHCCJCY01) sensors
+const TypeFlowerCare = "flower_care"
+
+// ParseXiaomiResult returns the samples in a Flower Care advertisement
+func ParseXiaomiResult(device bluetooth.ScanResult) []ingester.Sample {
+	var samples []ingester.Sample
+
 	macAddr := device.Address.String()
 	log := logrus.WithField("mac", macAddr)
 
@@ -36,8 +42,10 @@ func HandleXiaomiResult(device bluetooth.ScanResult, samples chan<- ingester.Sam
 
 		log.WithField("sample", sample).Debug("received xiaomi sample")
 
-		samples <- sample
+		samples = append(samples, sample)
 	}
+
+	return samples
 }
 
 /*
@@ -81,9 +89,9 @@ func parseXiaomiSensorData(sensorData []byte) (ingester.Sample, error) {
 	}
 
 	m := ingester.Sample{
-		Time:      time.Now(),
-		Collector: "bridge",
-		Plant:     macAddr.String(),
+		Time:       time.Now(),
+		Device:     macAddr.String(),
+		DeviceType: TypeFlowerCare,
 	}
 
 	if len(sensorData) < 15 {
@@ -79,8 +79,8 @@ func TestParseXiaomiData(t *testing.T) {
 			sample, err := parseXiaomiSensorData(testData)
 			assert.Nil(t, err)
 
-			assert.Equal(t, "01:02:03:04:05:06", sample.Plant)
-			assert.Equal(t, "bridge", sample.Collector)
+			assert.Equal(t, "01:02:03:04:05:06", sample.Device)
+			assert.Equal(t, TypeFlowerCare, sample.DeviceType)
 
 			switch tt.expectedMeasurementType {
 			case "conductivity":
@@ -97,3 +97,13 @@ func TestParseXiaomiData(t *testing.T) {
 		})
 	}
 }
+
+func TestParseXiaomiFirmware(t *testing.T) {
+	battery, firmware, err := parseXiaomiFirmware([]byte{0x57, 0x15, '3', '.', '2', '.', '1'})
+	assert.Nil(t, err)
+	assert.Equal(t, 87, battery)
+	assert.Equal(t, "3.2.1", firmware)
+
+	_, _, err = parseXiaomiFirmware([]byte{0x57})
+	assert.NotNil(t, err)
+}
@@ -2,8 +2,12 @@ package scanner
 
 import (
 	"context"
+	"errors"
+	"sync"
 	"time"
 
+	"github.com/ryanrolds/plant-collector/bridge/internal/battery"
+	"github.com/ryanrolds/plant-collector/bridge/internal/config"
 	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
 	"github.com/ryanrolds/plant-collector/bridge/internal/scanner/devices"
 	"github.com/sirupsen/logrus"
@@ -12,22 +16,130 @@ import (
 
 var batteryPollTickerInterval = 5 * time.Minute
 
-type BTLEScanner struct{}
+// adapterRestartDelay is the wait before enabling the adapter again after the
+// scan failed
+var adapterRestartDelay = 10 * time.Second
 
-func NewBTLEScanner() *BTLEScanner {
-	return &BTLEScanner{}
+// Adapter states
+const (
+	AdapterStarting = "starting"
+	AdapterScanning = "scanning"
+	AdapterStopped  = "stopped"
+	AdapterFailed   = "failed"
+)
+
+// errNoSensorData is the decode error of sensor advertisements without
+// readings
+var errNoSensorData = errors.New("advertisement has no sensor data")
+
+// Sink receives scanned samples, Offer is called from the scan callback and
+// must not block
+type Sink interface {
+	Offer(s ingester.Sample)
+}
+
+// Advertisement is a received advertisement. Driver is the type of sensor that
+// decoded it, empty when the device isn't a plant sensor, and Err is set when
+// the driver couldn't decode it.
+type Advertisement struct {
+	Time        time.Time
+	Address     string
+	Name        string
+	RSSI        int
+	Driver      string
+	ServiceData []ServiceData
+	Err         error
+}
+
+// ServiceData is a service's data from an advertisement
+type ServiceData struct {
+	UUID string
+	Data []byte
+}
+
+// Observer is told about every advertisement, Observe is called from the scan
+// callback and must not block
+type Observer interface {
+	Observe(a Advertisement)
 }
 
-func (s *BTLEScanner) Scan(ctx context.Context, samples chan<- ingester.Sample) error {
+// Poll is the outcome of connecting to a sensor to read it, Err is nil when
+// the read succeeded
+type Poll struct {
+	Time    time.Time
+	Address string
+	Driver  string
+	Err     error
+}
+
+// PollObserver is an Observer that's also told about every poll
+type PollObserver interface {
+	ObservePoll(p Poll)
+}
+
+type BTLEScanner struct {
+	config    *config.Config
+	observers []Observer
+
+	mu       sync.Mutex
+	state    string
+	restarts int
+}
+
+func NewBTLEScanner(cfg *config.Config) *BTLEScanner {
+	return &BTLEScanner{
+		config: cfg,
+		state:  AdapterStarting,
+	}
+}
+
+// AddObserver adds an observer of advertisements, before scanning starts
+func (s *BTLEScanner) AddObserver(o Observer) {
+	s.observers = append(s.observers, o)
+}
+
+// AdapterState returns whether the adapter is starting, scanning, stopped or
+// failed
+func (s *BTLEScanner) AdapterState() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.state
+}
+
+// AdapterRestarts returns how many times the adapter was enabled again after
+// the scan failed
+func (s *BTLEScanner) AdapterRestarts() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.restarts
+}
+
+func (s *BTLEScanner) setState(state string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.state = state
+}
+
+func (s *BTLEScanner) Scan(ctx context.Context, sink Sink) error {
 	adapter := bluetooth.DefaultAdapter
 	err := adapter.Enable()
 	if err != nil {
+		s.setState(AdapterFailed)
 		return err
 	}
 
+	// the poller offers samples too, Scan doesn't return until it has stopped
+	pollers := sync.WaitGroup{}
+	defer pollers.Wait()
+
 	xiaomiBatteryPoller := devices.NewXiaomiBatteryPoller()
 	// Poll battery levels on a ticker
+	pollers.Add(1)
 	go func() {
+		defer pollers.Done()
 		logrus.Info("starting battery polling")
 
 		ticker := time.NewTicker(batteryPollTickerInterval)
@@ -40,7 +152,18 @@ func (s *BTLEScanner) Scan(ctx context.Context, samples chan<- ingester.Sample)
 				return
 			case <-ticker.C:
 				logrus.Debug("polling battery levels")
-				xiaomiBatteryPoller.Poll(adapter, samples)
+				samples, results := xiaomiBatteryPoller.Poll(adapter)
+				for _, result := range results {
+					s.observePoll(Poll{
+						Time:    result.Time,
+						Address: result.Device,
+						Driver:  devices.TypeFlowerCare,
+						Err:     result.Err,
+					})
+				}
+				for _, m := range samples {
+					sink.Offer(m)
+				}
 			}
 		}
 	}()
@@ -55,8 +178,7 @@ func (s *BTLEScanner) Scan(ctx context.Context, samples chan<- ingester.Sample)
 		}
 	}()
 
-	logrus.Info("starting scan")
-	adapter.Scan(func(adapter *bluetooth.Adapter, device bluetooth.ScanResult) {
+	onResult := func(adapter *bluetooth.Adapter, device bluetooth.ScanResult) {
 		log := logrus.WithFields(logrus.Fields{
 			"mac":  device.Address.String(),
 			"name": device.LocalName(),
@@ -64,23 +186,129 @@ func (s *BTLEScanner) Scan(ctx context.Context, samples chan<- ingester.Sample)
 
 		// Flower Care
 		if device.LocalName() == "Flower care" {
-			devices.HandleXiaomiResult(device, samples)
+			s.observe(device, devices.TypeFlowerCare, nil)
+			for _, m := range devices.ParseXiaomiResult(device) {
+				sink.Offer(m)
+			}
 			xiaomiBatteryPoller.AddDevice(device.Address.String())
 			return
 		}
 
 		// b-parasite
 		if device.LocalName() == "prst" {
-			m, ok := devices.ParseBparasiteData(device)
-			if ok {
-				samples <- m
+			profile := s.batteryProfile(device.Address.String(), devices.BparasiteBattery)
+			m, ok := devices.ParseBparasiteData(device, profile)
+			if !ok {
+				s.observe(device, devices.TypeBparasite, errNoSensorData)
+				return
 			}
 
+			s.observe(device, devices.TypeBparasite, nil)
+			sink.Offer(m)
 			return
 		}
 
+		s.observe(device, "", nil)
 		log.Debug("not a plant sensor")
-	})
+	}
 
+	// a scan that fails after it started is restarted, the adapter may have
+	// been reset or bluetoothd restarted
+	for ctx.Err() == nil {
+		logrus.Info("starting scan")
+		s.setState(AdapterScanning)
+		err = adapter.Scan(onResult)
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+
+		s.setState(AdapterFailed)
+		logrus.WithError(err).Error("scan failed")
+		if !s.restart(ctx, adapter) {
+			break
+		}
+	}
+
+	s.setState(AdapterStopped)
 	return nil
 }
+
+// restart enables the adapter again, retrying until it succeeds. Returns false
+// when interrupted by shutdown.
+func (s *BTLEScanner) restart(ctx context.Context, adapter *bluetooth.Adapter) bool {
+	for {
+		logrus.WithField("delay", adapterRestartDelay).Info("restarting adapter")
+
+		timer := time.NewTimer(adapterRestartDelay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return false
+		case <-timer.C:
+		}
+
+		s.mu.Lock()
+		s.restarts++
+		s.mu.Unlock()
+
+		err := adapter.Enable()
+		if err == nil {
+			return true
+		}
+
+		logrus.WithError(err).Error("failed to enable adapter")
+	}
+}
+
+// observe tells the observers about the advertisement. The scan result is only
+// valid during the callback, so its service data is copied.
+func (s *BTLEScanner) observe(device bluetooth.ScanResult, driver string, decodeErr error) {
+	if len(s.observers) == 0 {
+		return
+	}
+
+	a := Advertisement{
+		Time:    time.Now(),
+		Address: device.Address.String(),
+		Name:    device.LocalName(),
+		RSSI:    int(device.RSSI),
+		Driver:  driver,
+		Err:     decodeErr,
+	}
+
+	for _, data := range device.GetServiceDatas() {
+		a.ServiceData = append(a.ServiceData, ServiceData{
+			UUID: data.UUID.String(),
+			Data: append([]byte(nil), data.Data...),
+		})
+	}
+
+	for _, o := range s.observers {
+		o.Observe(a)
+	}
+}
+
+func (s *BTLEScanner) observePoll(p Poll) {
+	for _, o := range s.observers {
+		if po, ok := o.(PollObserver); ok {
+			po.ObservePoll(p)
+		}
+	}
+}
+
+// batteryProfile returns the battery profile configured for the device or the
+// driver's default
+func (s *BTLEScanner) batteryProfile(mac string, fallback battery.Profile) battery.Profile {
+	device, ok := s.config.Device(mac)
+	if !ok || device.Battery == "" {
+		return fallback
+	}
+
+	profile, err := battery.Lookup(device.Battery)
+	if err != nil {
+		logrus.WithField("mac", mac).WithError(err).Warn("using default battery profile")
+		return fallback
+	}
+
+	return profile
+}
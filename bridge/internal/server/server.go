@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/ryanrolds/plant-collector/bridge/internal/config"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultListen = ":8080"
+	// shutdownTimeout bounds waiting for open requests when stopping
+	shutdownTimeout = 2 * time.Second
+	readTimeout     = 10 * time.Second
+)
+
+// Server serves the bridge's HTTP endpoints
+type Server struct {
+	listen string
+	mux    *http.ServeMux
+}
+
+func NewServer(cfg config.Server) *Server {
+	s := &Server{
+		listen: cfg.Listen,
+		mux:    http.NewServeMux(),
+	}
+
+	if s.listen == "" {
+		s.listen = defaultListen
+	}
+
+	return s
+}
+
+// Handle registers the handler for the pattern, see http.ServeMux
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// Run serves until the context is cancelled
+func (s *Server) Run(ctx context.Context) error {
+	listener, err := net.Listen("tcp", s.listen)
+	if err != nil {
+		return err
+	}
+
+	return s.serve(ctx, listener)
+}
+
+func (s *Server) serve(ctx context.Context, listener net.Listener) error {
+	server := &http.Server{
+		Handler:           s.mux,
+		ReadHeaderTimeout: readTimeout,
+		// requests are cancelled on shutdown so long lived streams end
+		BaseContext: func(net.Listener) context.Context {
+			return ctx
+		},
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+
+		err := server.Shutdown(shutdownCtx)
+		if err != nil {
+			logrus.WithError(err).Warn("http server didn't shut down cleanly")
+		}
+	}()
+
+	logrus.WithField("address", listener.Addr().String()).Info("http server listening")
+
+	err := server.Serve(listener)
+	if errors.Is(err, http.ErrServerClosed) {
+		<-stopped
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/ryanrolds/plant-collector/bridge/internal/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServer(t *testing.T) {
+	s := NewServer(config.Server{})
+	assert.Equal(t, defaultListen, s.listen)
+
+	s.Handle("/hello", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	}))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- s.serve(ctx, listener)
+	}()
+
+	resp, err := http.Get("http://" + listener.Addr().String() + "/hello")
+	assert.Nil(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "hello", string(body))
+
+	cancel()
+	assert.Nil(t, <-done)
+}
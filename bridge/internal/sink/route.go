@@ -0,0 +1,100 @@
+package sink
+
+import (
+	"fmt"
+
+	"github.com/ryanrolds/plant-collector/bridge/internal/config"
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
+)
+
+// Route picks the samples and metrics a sink receives
+type Route struct {
+	plants  map[string]bool
+	zones   map[string]bool
+	metrics map[string]bool
+}
+
+func NewRoute(cfg config.Route) (Route, error) {
+	for _, metric := range cfg.Metrics {
+		if !ingester.IsMetric(metric) {
+			return Route{}, fmt.Errorf("unknown metric %q", metric)
+		}
+	}
+
+	return Route{
+		plants:  set(cfg.Plants),
+		zones:   set(cfg.Zones),
+		metrics: set(cfg.Metrics),
+	}, nil
+}
+
+// Apply returns the sample as the sink should see it, false if it isn't
+// routed to the sink
+func (r Route) Apply(s ingester.Sample) (ingester.Sample, bool) {
+	if r.plants != nil && !r.plants[s.Plant] {
+		return s, false
+	}
+
+	if r.zones != nil && !r.zones[s.Zone] {
+		return s, false
+	}
+
+	if r.metrics == nil {
+		return s, true
+	}
+
+	values := s.Values()
+	kept := 0
+	for metric := range values {
+		if r.metrics[metric] {
+			kept++
+			continue
+		}
+
+		s.ClearValue(metric)
+	}
+
+	if kept == 0 {
+		return s, false
+	}
+
+	s.Stats = only(s.Stats, r.metrics)
+	s.Quality = only(s.Quality, r.metrics)
+
+	return s, true
+}
+
+// only copies the entries of m for the given metrics, the sample's maps are
+// shared with the other sinks
+func only[T any](m map[string]T, metrics map[string]bool) map[string]T {
+	if m == nil {
+		return nil
+	}
+
+	kept := make(map[string]T, len(m))
+	for metric, value := range m {
+		if metrics[metric] {
+			kept[metric] = value
+		}
+	}
+
+	if len(kept) == 0 {
+		return nil
+	}
+
+	return kept
+}
+
+// set returns nil for an empty list so it matches everything
+func set(values []string) map[string]bool {
+	if len(values) == 0 {
+		return nil
+	}
+
+	s := make(map[string]bool, len(values))
+	for _, value := range values {
+		s[value] = true
+	}
+
+	return s
+}
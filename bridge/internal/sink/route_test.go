@@ -0,0 +1,95 @@
+package sink
+
+import (
+	"testing"
+
+	"github.com/ryanrolds/plant-collector/bridge/internal/config"
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
+	"github.com/stretchr/testify/assert"
+)
+
+func float(v float32) *float32 {
+	return &v
+}
+
+func TestRoute(t *testing.T) {
+	sample := ingester.Sample{
+		Plant:       "monstera",
+		Zone:        "tent",
+		Temperature: float(21),
+		Moisture:    float(40),
+		Quality:     map[string]string{ingester.MetricTemperature: "outlier"},
+	}
+
+	tests := []struct {
+		name     string
+		route    config.Route
+		routed   bool
+		expected map[string]float64
+	}{
+		{
+			name:     "everything",
+			routed:   true,
+			expected: map[string]float64{ingester.MetricTemperature: 21, ingester.MetricMoisture: 40},
+		},
+		{
+			name:     "plant",
+			route:    config.Route{Plants: []string{"monstera"}},
+			routed:   true,
+			expected: map[string]float64{ingester.MetricTemperature: 21, ingester.MetricMoisture: 40},
+		},
+		{
+			name:  "other plant",
+			route: config.Route{Plants: []string{"fern"}},
+		},
+		{
+			name:  "other zone",
+			route: config.Route{Zones: []string{"window"}},
+		},
+		{
+			name:     "metric",
+			route:    config.Route{Metrics: []string{ingester.MetricMoisture}},
+			routed:   true,
+			expected: map[string]float64{ingester.MetricMoisture: 40},
+		},
+		{
+			name:  "missing metric",
+			route: config.Route{Metrics: []string{ingester.MetricLight}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			route, err := NewRoute(test.route)
+			assert.Nil(t, err)
+
+			s, ok := route.Apply(sample)
+			assert.Equal(t, test.routed, ok)
+			if ok {
+				assert.Equal(t, test.expected, s.Values())
+			}
+		})
+	}
+
+	// the original sample is untouched
+	assert.Len(t, sample.Values(), 2)
+	assert.Len(t, sample.Quality, 1)
+}
+
+func TestRouteDropsFlagsOfRemovedMetrics(t *testing.T) {
+	route, err := NewRoute(config.Route{Metrics: []string{ingester.MetricMoisture}})
+	assert.Nil(t, err)
+
+	s, ok := route.Apply(ingester.Sample{
+		Temperature: float(21),
+		Moisture:    float(40),
+		Quality:     map[string]string{ingester.MetricTemperature: "outlier"},
+	})
+	assert.True(t, ok)
+	assert.Nil(t, s.Quality)
+}
+
+func TestNewRouteUnknownMetric(t *testing.T) {
+	_, err := NewRoute(config.Route{Metrics: []string{"soil"}})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,280 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ryanrolds/plant-collector/bridge/internal/config"
+	"github.com/ryanrolds/plant-collector/bridge/internal/influx"
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
+	"github.com/ryanrolds/plant-collector/bridge/internal/mqtt"
+	"github.com/ryanrolds/plant-collector/bridge/internal/otlp"
+	"github.com/ryanrolds/plant-collector/bridge/internal/queue"
+	"github.com/ryanrolds/plant-collector/bridge/internal/remotewrite"
+	"github.com/sirupsen/logrus"
+)
+
+// Sink types
+const (
+	TypeHTTP        = "http"
+	TypeMQTT        = "mqtt"
+	TypeInflux      = "influx"
+	TypeRemoteWrite = "remote_write"
+	TypeOTLP        = "otlp"
+)
+
+// Sink delivers samples to a destination. SendAll reads the source until it
+// returns io.EOF or the context is cancelled, retrying failed deliveries itself.
+type Sink interface {
+	SendAll(ctx context.Context, source ingester.Source) error
+}
+
+// New creates a sink of the configured type
+func New(cfg config.Sink) (Sink, error) {
+	switch cfg.Type {
+	case TypeHTTP:
+		if cfg.HTTP.URL == "" {
+			return nil, errors.New("url must be set")
+		}
+
+		batch, err := ingester.NewBatchPolicy(cfg.HTTP.Batch)
+		if err != nil {
+			return nil, err
+		}
+
+		return ingester.NewIngester(cfg.HTTP.URL, ingester.Options{
+			Retry:      ingester.NewRetryPolicy(cfg.HTTP.Retry),
+			Batch:      batch,
+			Gzip:       cfg.HTTP.Gzip,
+			DeadLetter: ingester.NewFileDeadLetter(cfg.HTTP.DeadLetterPath),
+		}), nil
+	case TypeMQTT:
+		return mqtt.NewPublisher(cfg.MQTT)
+	case TypeInflux:
+		return influx.NewWriter(cfg.Influx)
+	case TypeRemoteWrite:
+		return remotewrite.NewWriter(cfg.RemoteWrite)
+	case TypeOTLP:
+		return otlp.NewExporter(cfg.OTLP)
+	default:
+		return nil, fmt.Errorf("unknown sink type %q", cfg.Type)
+	}
+}
+
+// Output is a sink with its own queue and route
+type Output struct {
+	Name  string
+	Sink  Sink
+	Route Route
+	Queue *queue.Queue
+	// Raw outputs are queued by the FanOut's pipeline stage instead of
+	// Append, so they get samples before report-on-change and downsampling
+	Raw bool
+
+	mu sync.Mutex
+	// delivered is when the sink last acknowledged samples
+	delivered time.Time
+}
+
+// Status is the state of an output's deliveries
+type Status struct {
+	Name string `json:"name"`
+	// Queued is how many samples wait to be delivered
+	Queued        int       `json:"queued"`
+	LastDelivered time.Time `json:"last_delivered"`
+}
+
+// ackSource records when the sink acknowledges samples
+type ackSource struct {
+	ingester.Source
+	out *Output
+}
+
+func (s ackSource) Ack() error {
+	err := s.Source.Ack()
+	if err != nil {
+		return err
+	}
+
+	s.out.mu.Lock()
+	s.out.delivered = time.Now()
+	s.out.mu.Unlock()
+
+	return nil
+}
+
+// Open creates the configured sink and opens its queue
+func Open(cfg config.Sink) (*Output, error) {
+	s, err := New(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("sink %s: %w", cfg.Name, err)
+	}
+
+	route, err := NewRoute(cfg.Route)
+	if err != nil {
+		return nil, fmt.Errorf("sink %s: %w", cfg.Name, err)
+	}
+
+	q, err := queue.Open(cfg.Queue)
+	if err != nil {
+		return nil, fmt.Errorf("sink %s: %w", cfg.Name, err)
+	}
+
+	return &Output{
+		Name:  cfg.Name,
+		Sink:  s,
+		Route: route,
+		Queue: q,
+	}, nil
+}
+
+// SendObserver is told about every delivery attempt of the sinks that send
+// over the network, err is nil when the attempt succeeded
+type SendObserver interface {
+	ObserveSend(sink string, took time.Duration, err error)
+}
+
+// FanOut copies samples to the queue of every output they are routed to. Each
+// output is sent from its own queue so a slow or failing sink doesn't hold up
+// the others, its samples wait on disk instead.
+type FanOut struct {
+	outputs   []*Output
+	observers []SendObserver
+}
+
+func NewFanOut(outputs ...*Output) *FanOut {
+	return &FanOut{
+		outputs: outputs,
+	}
+}
+
+// AddObserver adds an observer of delivery attempts, before sending starts
+func (f *FanOut) AddObserver(o SendObserver) {
+	f.observers = append(f.observers, o)
+}
+
+// Append queues the sample on every output it is routed to, except the raw
+// ones
+func (f *FanOut) Append(s ingester.Sample) {
+	f.append(s, false)
+}
+
+// Process queues the sample on the raw outputs and passes it on, as a
+// pipeline stage
+func (f *FanOut) Process(s ingester.Sample) []ingester.Sample {
+	f.append(s, true)
+	return []ingester.Sample{s}
+}
+
+func (f *FanOut) append(s ingester.Sample, raw bool) {
+	for _, out := range f.outputs {
+		if out.Raw != raw {
+			continue
+		}
+
+		routed, ok := out.Route.Apply(s)
+		if !ok {
+			continue
+		}
+
+		err := out.Queue.Append(routed)
+		if err != nil {
+			logrus.WithError(err).WithField("sink", out.Name).Error("failed to queue sample")
+		}
+	}
+}
+
+// AppendAll queues samples from the channel until it is closed or the context
+// is cancelled
+func (f *FanOut) AppendAll(ctx context.Context, c <-chan ingester.Sample) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case s, ok := <-c:
+			if !ok {
+				return nil
+			}
+
+			f.Append(s)
+		}
+	}
+}
+
+// Seal marks the end of the input, SendAll returns once every queue is empty
+func (f *FanOut) Seal() {
+	for _, out := range f.outputs {
+		out.Queue.Seal()
+	}
+}
+
+// SendAll runs every sink until its queue is sealed and empty or the context
+// is cancelled
+func (f *FanOut) SendAll(ctx context.Context) {
+	wg := sync.WaitGroup{}
+	for _, out := range f.outputs {
+		wg.Add(1)
+		go func(out *Output) {
+			defer wg.Done()
+
+			err := out.Sink.SendAll(f.observe(ctx, out.Name), ackSource{Source: out.Queue, out: out})
+			if err != nil {
+				logrus.WithError(err).WithField("sink", out.Name).Error("sink failed")
+			}
+
+			logrus.WithField("sink", out.Name).Info("sink finished")
+		}(out)
+	}
+
+	wg.Wait()
+}
+
+// observe reports the sink's delivery attempts to the observers
+func (f *FanOut) observe(ctx context.Context, name string) context.Context {
+	if len(f.observers) == 0 {
+		return ctx
+	}
+
+	return ingester.WithAttemptObserver(ctx, func(took time.Duration, err error) {
+		for _, o := range f.observers {
+			o.ObserveSend(name, took, err)
+		}
+	})
+}
+
+// Status returns the state of every output
+func (f *FanOut) Status() []Status {
+	statuses := make([]Status, len(f.outputs))
+	for i, out := range f.outputs {
+		out.mu.Lock()
+		statuses[i] = Status{
+			Name:          out.Name,
+			Queued:        out.Queue.Len(),
+			LastDelivered: out.delivered,
+		}
+		out.mu.Unlock()
+	}
+
+	return statuses
+}
+
+// Close closes every queue, unsent samples are sent after the next start
+func (f *FanOut) Close() error {
+	var closeErr error
+	for _, out := range f.outputs {
+		logrus.WithFields(logrus.Fields{
+			"sink":   out.Name,
+			"unsent": out.Queue.Len(),
+		}).Info("closing sink queue")
+
+		err := out.Queue.Close()
+		if err != nil && closeErr == nil {
+			closeErr = fmt.Errorf("sink %s: %w", out.Name, err)
+		}
+	}
+
+	return closeErr
+}
@@ -0,0 +1,164 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ryanrolds/plant-collector/bridge/internal/config"
+	"github.com/ryanrolds/plant-collector/bridge/internal/influx"
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
+	"github.com/ryanrolds/plant-collector/bridge/internal/otlp"
+	"github.com/ryanrolds/plant-collector/bridge/internal/queue"
+	"github.com/ryanrolds/plant-collector/bridge/internal/remotewrite"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingSink keeps the plants of the samples it is sent
+type recordingSink struct {
+	mu     sync.Mutex
+	plants []string
+}
+
+func (r *recordingSink) SendAll(ctx context.Context, source ingester.Source) error {
+	for {
+		s, err := source.Next(ctx)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		r.mu.Lock()
+		r.plants = append(r.plants, s.Plant)
+		r.mu.Unlock()
+		ingester.ObserveAttempt(ctx, time.Millisecond, nil)
+
+		err = source.Ack()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// blockedSink never sends anything
+type blockedSink struct{}
+
+func (blockedSink) SendAll(ctx context.Context, source ingester.Source) error {
+	<-ctx.Done()
+	return nil
+}
+
+// sendCounter counts the delivery attempts of each sink
+type sendCounter struct {
+	mu    sync.Mutex
+	sends map[string]int
+}
+
+func (c *sendCounter) ObserveSend(sink string, took time.Duration, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.sends[sink]++
+}
+
+func testOutput(t *testing.T, name string, s Sink, route config.Route) *Output {
+	q, err := queue.Open(config.Queue{Dir: t.TempDir()})
+	assert.Nil(t, err)
+
+	r, err := NewRoute(route)
+	assert.Nil(t, err)
+
+	return &Output{Name: name, Sink: s, Route: r, Queue: q}
+}
+
+func TestFanOut(t *testing.T) {
+	all := &recordingSink{}
+	fern := &recordingSink{}
+
+	fanOut := NewFanOut(
+		testOutput(t, "all", all, config.Route{}),
+		testOutput(t, "fern", fern, config.Route{Plants: []string{"fern"}}),
+		testOutput(t, "blocked", blockedSink{}, config.Route{}),
+	)
+	defer fanOut.Close()
+
+	counter := &sendCounter{sends: make(map[string]int)}
+	fanOut.AddObserver(counter)
+
+	for _, plant := range []string{"monstera", "fern", "pothos"} {
+		fanOut.Append(ingester.Sample{Plant: plant, Moisture: float(40)})
+	}
+	fanOut.Seal()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	// the blocked sink runs until the context is cancelled without holding up
+	// the others
+	fanOut.SendAll(ctx)
+
+	assert.Equal(t, []string{"monstera", "fern", "pothos"}, all.plants)
+	assert.Equal(t, []string{"fern"}, fern.plants)
+	assert.Equal(t, map[string]int{"all": 3, "fern": 1}, counter.sends)
+
+	statuses := fanOut.Status()
+	assert.Len(t, statuses, 3)
+	assert.Equal(t, "all", statuses[0].Name)
+	assert.Equal(t, 0, statuses[0].Queued)
+	assert.False(t, statuses[0].LastDelivered.IsZero())
+	assert.Equal(t, 3, statuses[2].Queued)
+	assert.True(t, statuses[2].LastDelivered.IsZero())
+}
+
+func TestFanOutRaw(t *testing.T) {
+	sent := &recordingSink{}
+	raw := &recordingSink{}
+
+	rawOutput := testOutput(t, "raw", raw, config.Route{})
+	rawOutput.Raw = true
+
+	fanOut := NewFanOut(testOutput(t, "sent", sent, config.Route{}), rawOutput)
+	defer fanOut.Close()
+
+	// every sample passes the raw stage, only some make it past report-on-change
+	for _, plant := range []string{"monstera", "fern"} {
+		s := ingester.Sample{Plant: plant, Moisture: float(40)}
+		assert.Equal(t, []ingester.Sample{s}, fanOut.Process(s))
+	}
+	fanOut.Append(ingester.Sample{Plant: "fern", Moisture: float(40)})
+	fanOut.Seal()
+
+	fanOut.SendAll(context.Background())
+
+	assert.Equal(t, []string{"fern"}, sent.plants)
+	assert.Equal(t, []string{"monstera", "fern"}, raw.plants)
+}
+
+func TestNew(t *testing.T) {
+	_, err := New(config.Sink{Type: "carrier-pigeon"})
+	assert.NotNil(t, err)
+
+	_, err = New(config.Sink{Type: TypeHTTP})
+	assert.NotNil(t, err)
+
+	s, err := New(config.Sink{Type: TypeHTTP, HTTP: config.Ingester{URL: "http://localhost"}})
+	assert.Nil(t, err)
+	assert.IsType(t, &ingester.Ingester{}, s)
+
+	s, err = New(config.Sink{Type: TypeInflux, Influx: config.Influx{URL: "http://localhost:8086", Bucket: "plants"}})
+	assert.Nil(t, err)
+	assert.IsType(t, &influx.Writer{}, s)
+
+	s, err = New(config.Sink{Type: TypeRemoteWrite, RemoteWrite: config.RemoteWrite{URL: "http://localhost:9009/api/v1/push"}})
+	assert.Nil(t, err)
+	assert.IsType(t, &remotewrite.Writer{}, s)
+
+	s, err = New(config.Sink{Type: TypeOTLP, OTLP: config.OTLP{Endpoint: "localhost:4317", Insecure: true}})
+	assert.Nil(t, err)
+	assert.IsType(t, &otlp.Exporter{}, s)
+}
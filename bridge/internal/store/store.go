@@ -0,0 +1,599 @@
+package store
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ryanrolds/plant-collector/bridge/internal/config"
+	"github.com/ryanrolds/plant-collector/bridge/internal/downsample"
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
+	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	defaultRetention     = 90 * 24 * time.Hour
+	defaultCompactAfter  = 7 * 24 * time.Hour
+	defaultCompactWindow = time.Hour
+
+	// samples are written in batches, one transaction each
+	batchSamples = 500
+	batchLatency = time.Second
+
+	openTimeout = 5 * time.Second
+	// keys are the sample's time in nanoseconds followed by a sequence number
+	keySize = 16
+)
+
+var (
+	// raw holds a bucket of samples per plant as they were received
+	rawBucket = []byte("raw")
+	// compacted holds a bucket per plant of samples aggregated into windows
+	compactedBucket = []byte("compacted")
+)
+
+// maintenanceInterval is how often samples are compacted and expired
+var maintenanceInterval = time.Hour
+
+// compactSamples bounds how many raw samples a compaction transaction reads,
+// it always finishes the window it's in
+var compactSamples = 10000
+
+// Store keeps samples in an embedded database, indexed by plant and time.
+// Samples older than compact_after are replaced with one sample per window
+// holding the window's mean and stats, everything older than the retention is
+// deleted.
+type Store struct {
+	db            *bolt.DB
+	retention     time.Duration
+	compactAfter  time.Duration
+	compactWindow time.Duration
+	batch         ingester.BatchPolicy
+	// retry backs off writes the database fails
+	retry ingester.RetryPolicy
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Open opens or creates the database and starts compacting it in the
+// background
+func Open(cfg config.Store) (*Store, error) {
+	if cfg.Path == "" {
+		return nil, errors.New("store path is required")
+	}
+
+	s := &Store{
+		retention:     cfg.Retention,
+		compactAfter:  cfg.CompactAfter,
+		compactWindow: cfg.CompactWindow,
+		batch: ingester.BatchPolicy{
+			MaxSamples: batchSamples,
+			MaxBytes:   batchSamples * 1024,
+			MaxLatency: batchLatency,
+		},
+		retry: ingester.NewRetryPolicy(config.Retry{}),
+		done:  make(chan struct{}),
+	}
+
+	if s.retention == 0 {
+		s.retention = defaultRetention
+	}
+	if s.compactAfter == 0 {
+		s.compactAfter = defaultCompactAfter
+	}
+	if s.compactWindow == 0 {
+		s.compactWindow = defaultCompactWindow
+	}
+
+	if s.compactWindow < time.Second {
+		return nil, fmt.Errorf("compact window must be at least a second, got %s", s.compactWindow)
+	}
+
+	err := os.MkdirAll(filepath.Dir(cfg.Path), 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	s.db, err = bolt.Open(cfg.Path, 0o644, &bolt.Options{Timeout: openTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %w", cfg.Path, err)
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{rawBucket, compactedBucket} {
+			_, err := tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		s.db.Close()
+		return nil, err
+	}
+
+	s.wg.Add(1)
+	go s.maintain()
+
+	return s, nil
+}
+
+// permanent are the errors of a database that can't be written to, retrying
+// them won't help
+var permanent = []error{
+	bolt.ErrDatabaseNotOpen,
+	bolt.ErrDatabaseReadOnly,
+	bolt.ErrInvalid,
+	bolt.ErrInvalidMapping,
+	bolt.ErrVersionMismatch,
+	bolt.ErrChecksum,
+}
+
+// writeError is a failed write to the database, it's retried until the
+// samples are stored or the bridge shuts down unless the database can't be
+// written to at all
+type writeError struct {
+	err error
+}
+
+func (e writeError) Error() string {
+	return fmt.Sprintf("writing samples: %s", e.err)
+}
+
+func (e writeError) Unwrap() error {
+	return e.err
+}
+
+func (e writeError) Transient() bool {
+	for _, err := range permanent {
+		if errors.Is(e.err, err) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// SendAll writes samples from the source to the store until it returns
+// io.EOF or the context is cancelled. Failed writes are retried with backoff,
+// the samples wait in the queue meanwhile.
+func (s *Store) SendAll(ctx context.Context, source ingester.Source) error {
+	for {
+		b, err := s.batch.Collect(ctx, source, ingester.EncodeJSON)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if errors.Is(err, io.EOF) {
+			logrus.Debug("all samples stored")
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		err = s.retry.Do(ctx, func() error {
+			err := s.append(b.Samples, b.Encoded)
+			if err != nil {
+				return writeError{err: err}
+			}
+
+			return nil
+		})
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		err = source.Ack()
+		if err != nil {
+			logrus.WithError(err).Error("failed to acknowledge samples")
+		}
+	}
+}
+
+// Append writes the samples to the store
+func (s *Store) Append(samples ...ingester.Sample) error {
+	encoded := make([][]byte, len(samples))
+	for i, sample := range samples {
+		var err error
+		encoded[i], err = json.Marshal(sample)
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.append(samples, encoded)
+}
+
+func (s *Store) append(samples []ingester.Sample, encoded [][]byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return put(tx.Bucket(rawBucket), samples, encoded)
+	})
+}
+
+// put adds the samples to their plants' buckets
+func put(b *bolt.Bucket, samples []ingester.Sample, encoded [][]byte) error {
+	for i, sample := range samples {
+		plant, err := b.CreateBucketIfNotExists([]byte(sample.Plant))
+		if err != nil {
+			return err
+		}
+
+		seq, err := plant.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		err = plant.Put(key(sample.Time, seq), encoded[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Plants returns the IDs of the plants with stored samples
+func (s *Store) Plants() ([]string, error) {
+	plants := make(map[string]bool)
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{rawBucket, compactedBucket} {
+			err := tx.Bucket(name).ForEach(func(k, v []byte) error {
+				plants[string(k)] = true
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(plants))
+	for id := range plants {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return ids, nil
+}
+
+// Range calls fn with the plant's samples from from up to, but not including,
+// to in time order. Compacted samples come first, they're all older than the
+// raw ones.
+func (s *Store) Range(plant string, from time.Time, to time.Time, fn func(ingester.Sample) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{compactedBucket, rawBucket} {
+			b := tx.Bucket(name).Bucket([]byte(plant))
+			if b == nil {
+				continue
+			}
+
+			c := b.Cursor()
+			end := key(to, 0)
+			for k, v := c.Seek(key(from, 0)); k != nil && string(k) < string(end); k, v = c.Next() {
+				var sample ingester.Sample
+				err := json.Unmarshal(v, &sample)
+				if err != nil {
+					return fmt.Errorf("decoding sample %x of %s: %w", k, plant, err)
+				}
+
+				err = fn(sample)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+// Reverse calls fn with the plant's samples from the newest to the oldest
+// until fn returns false
+func (s *Store) Reverse(plant string, fn func(ingester.Sample) bool) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{rawBucket, compactedBucket} {
+			b := tx.Bucket(name).Bucket([]byte(plant))
+			if b == nil {
+				continue
+			}
+
+			c := b.Cursor()
+			for k, v := c.Last(); k != nil; k, v = c.Prev() {
+				var sample ingester.Sample
+				err := json.Unmarshal(v, &sample)
+				if err != nil {
+					return fmt.Errorf("decoding sample %x of %s: %w", k, plant, err)
+				}
+
+				if !fn(sample) {
+					return nil
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+// maintain compacts and expires samples on startup and every interval
+func (s *Store) maintain() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(maintenanceInterval)
+	defer ticker.Stop()
+
+	for {
+		err := s.Compact(time.Now())
+		if err != nil {
+			logrus.WithError(err).Error("failed to compact store")
+		}
+
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Compact aggregates the raw samples older than compact_after into windows
+// and deletes samples older than the retention
+func (s *Store) Compact(now time.Time) error {
+	// whole windows are compacted, samples that arrive for a compacted window
+	// are merged into it
+	cutoff := now.Add(-s.compactAfter).Truncate(s.compactWindow)
+	expiry := now.Add(-s.retention)
+
+	plants, err := s.Plants()
+	if err != nil {
+		return err
+	}
+
+	for _, plant := range plants {
+		// short transactions of up to compactSamples samples each, writes
+		// wait on them
+		for done := false; !done; {
+			err := s.db.Update(func(tx *bolt.Tx) error {
+				var err error
+				done, err = s.compact(tx, plant, cutoff)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("compacting %s: %w", plant, err)
+			}
+		}
+
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			for _, name := range [][]byte{rawBucket, compactedBucket} {
+				err := expire(tx.Bucket(name), plant, expiry)
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("expiring %s: %w", plant, err)
+		}
+	}
+
+	return nil
+}
+
+// compact replaces the oldest of the plant's raw samples before the cutoff
+// with one per window. It stops at the first window boundary after
+// compactSamples samples and reports whether it got to the cutoff.
+func (s *Store) compact(tx *bolt.Tx, plant string, cutoff time.Time) (bool, error) {
+	raw := tx.Bucket(rawBucket).Bucket([]byte(plant))
+	if raw == nil {
+		return true, nil
+	}
+
+	aggregator, err := downsample.NewAggregator(config.Downsample{Window: s.compactWindow})
+	if err != nil {
+		return false, err
+	}
+
+	var compacted []ingester.Sample
+	var keys [][]byte
+	var window time.Time
+
+	done := true
+	end := key(cutoff, 0)
+	c := raw.Cursor()
+	for k, v := c.First(); k != nil && string(k) < string(end); k, v = c.Next() {
+		var sample ingester.Sample
+		err := json.Unmarshal(v, &sample)
+		if err != nil {
+			logrus.WithError(err).WithField("plant", plant).Warn("dropping undecodable sample")
+		} else {
+			start := sample.Time.Truncate(s.compactWindow)
+			if len(keys) >= compactSamples && !start.Equal(window) {
+				done = false
+				break
+			}
+			window = start
+
+			compacted = append(compacted, aggregator.Process(sample)...)
+		}
+
+		keys = append(keys, append([]byte(nil), k...))
+	}
+
+	if len(keys) == 0 {
+		return true, nil
+	}
+
+	compacted = append(compacted, aggregator.Drain()...)
+
+	err = s.putCompacted(tx.Bucket(compactedBucket), compacted)
+	if err != nil {
+		return false, err
+	}
+
+	for _, k := range keys {
+		err := raw.Delete(k)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"plant":     plant,
+		"raw":       len(keys),
+		"compacted": len(compacted),
+	}).Debug("compacted samples")
+
+	return done, nil
+}
+
+// putCompacted adds the windows to their plants' buckets, a window that was
+// already compacted has the late samples merged into it
+func (s *Store) putCompacted(b *bolt.Bucket, windows []ingester.Sample) error {
+	for _, w := range windows {
+		plant, err := b.CreateBucketIfNotExists([]byte(w.Plant))
+		if err != nil {
+			return err
+		}
+
+		k, v := plant.Cursor().Seek(key(w.Time, 0))
+		if k == nil || string(k) >= string(key(w.Time.Add(s.compactWindow), 0)) {
+			encoded, err := json.Marshal(w)
+			if err != nil {
+				return err
+			}
+
+			err = put(b, []ingester.Sample{w}, [][]byte{encoded})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		var existing ingester.Sample
+		err = json.Unmarshal(v, &existing)
+		if err != nil {
+			return fmt.Errorf("decoding compacted window: %w", err)
+		}
+
+		encoded, err := json.Marshal(merge(existing, w))
+		if err != nil {
+			return err
+		}
+
+		err = plant.Put(append([]byte(nil), k...), encoded)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// merge adds the stats of a window compacted late to the window's sample, the
+// late samples don't change the last values
+func merge(existing, late ingester.Sample) ingester.Sample {
+	stats := make(map[string]ingester.Stats, len(existing.Stats)+len(late.Stats))
+	for metric, st := range existing.Stats {
+		stats[metric] = st
+	}
+
+	for metric, st := range late.Stats {
+		old, ok := stats[metric]
+		if !ok {
+			stats[metric] = st
+			existing.SetValue(metric, st.Mean)
+			continue
+		}
+
+		count := old.Count + st.Count
+		old.Mean = (old.Mean*float64(old.Count) + st.Mean*float64(st.Count)) / float64(count)
+		old.Count = count
+		if st.Min < old.Min {
+			old.Min = st.Min
+		}
+		if st.Max > old.Max {
+			old.Max = st.Max
+		}
+
+		stats[metric] = old
+		existing.SetValue(metric, old.Mean)
+	}
+
+	existing.Stats = stats
+	return existing
+}
+
+// expire deletes the plant's samples before the expiry, and the plant's
+// bucket once it's empty
+func expire(b *bolt.Bucket, plant string, expiry time.Time) error {
+	samples := b.Bucket([]byte(plant))
+	if samples == nil {
+		return nil
+	}
+
+	var keys [][]byte
+	end := key(expiry, 0)
+	c := samples.Cursor()
+	for k, _ := c.First(); k != nil && string(k) < string(end); k, _ = c.Next() {
+		keys = append(keys, append([]byte(nil), k...))
+	}
+
+	for _, k := range keys {
+		err := samples.Delete(k)
+		if err != nil {
+			return err
+		}
+	}
+
+	if k, _ := samples.Cursor().First(); k == nil {
+		return b.DeleteBucket([]byte(plant))
+	}
+
+	return nil
+}
+
+// Close stops compacting and closes the database
+func (s *Store) Close() error {
+	close(s.done)
+	s.wg.Wait()
+
+	return s.db.Close()
+}
+
+// key sorts samples by time, times before 1970 sort first
+func key(t time.Time, seq uint64) []byte {
+	k := make([]byte, keySize)
+
+	nanos := t.UnixNano()
+	if nanos < 0 {
+		nanos = 0
+	}
+
+	binary.BigEndian.PutUint64(k, uint64(nanos))
+	binary.BigEndian.PutUint64(k[8:], seq)
+
+	return k
+}
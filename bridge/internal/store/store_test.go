@@ -0,0 +1,244 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ryanrolds/plant-collector/bridge/internal/config"
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester/ingestertest"
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+)
+
+func float(v float32) *float32 {
+	return &v
+}
+
+func open(t *testing.T, cfg config.Store) *Store {
+	cfg.Path = filepath.Join(t.TempDir(), "samples.db")
+
+	s, err := Open(cfg)
+	assert.Nil(t, err)
+	t.Cleanup(func() {
+		assert.Nil(t, s.Close())
+	})
+
+	return s
+}
+
+func collect(t *testing.T, s *Store, plant string, from, to time.Time) []ingester.Sample {
+	var samples []ingester.Sample
+	err := s.Range(plant, from, to, func(sample ingester.Sample) error {
+		samples = append(samples, sample)
+		return nil
+	})
+	assert.Nil(t, err)
+
+	return samples
+}
+
+func TestStoreSendAll(t *testing.T) {
+	start := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+
+	s := open(t, config.Store{})
+
+	source := &ingestertest.SliceSource{Samples: []ingester.Sample{
+		{Time: start.Add(time.Minute), Plant: "monstera", Moisture: float(41)},
+		{Time: start, Plant: "monstera", Moisture: float(40)},
+		{Time: start, Plant: "fern", Moisture: float(55)},
+		// same time, both are kept
+		{Time: start, Plant: "fern", Temperature: float(20)},
+	}}
+
+	assert.Nil(t, s.SendAll(context.Background(), source))
+	assert.Equal(t, 4, source.Acked)
+
+	plants, err := s.Plants()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"fern", "monstera"}, plants)
+
+	samples := collect(t, s, "monstera", start, start.Add(time.Hour))
+	assert.Len(t, samples, 2)
+	assert.Equal(t, float32(40), *samples[0].Moisture)
+	assert.Equal(t, float32(41), *samples[1].Moisture)
+
+	// to is exclusive
+	assert.Len(t, collect(t, s, "monstera", start, start.Add(time.Minute)), 1)
+	assert.Len(t, collect(t, s, "fern", start, start.Add(time.Second)), 2)
+	assert.Len(t, collect(t, s, "cactus", start, start.Add(time.Hour)), 0)
+}
+
+func TestStoreSendAllRetries(t *testing.T) {
+	start := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+
+	s := open(t, config.Store{})
+	s.retry = ingester.RetryPolicy{InitialBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond}
+
+	// a value where the plant's bucket goes fails the write until it's removed
+	block := func(tx *bolt.Tx) error {
+		return tx.Bucket(rawBucket).Put([]byte("monstera"), []byte("blocked"))
+	}
+	unblock := func(tx *bolt.Tx) error {
+		return tx.Bucket(rawBucket).Delete([]byte("monstera"))
+	}
+	assert.Nil(t, s.db.Update(block))
+
+	failures := 0
+	ctx := ingester.WithAttemptObserver(context.Background(), func(took time.Duration, err error) {
+		if err == nil {
+			return
+		}
+
+		failures++
+		if failures == 3 {
+			assert.Nil(t, s.db.Update(unblock))
+		}
+	})
+
+	source := &ingestertest.SliceSource{Samples: []ingester.Sample{
+		{Time: start, Plant: "monstera", Moisture: float(40)},
+	}}
+
+	assert.Nil(t, s.SendAll(ctx, source))
+	assert.Equal(t, 3, failures)
+	assert.Equal(t, 1, source.Acked)
+	assert.Len(t, collect(t, s, "monstera", start, start.Add(time.Hour)), 1)
+}
+
+func TestWriteErrorTransient(t *testing.T) {
+	assert.True(t, ingester.IsTransient(writeError{err: bolt.ErrTimeout}))
+	assert.True(t, ingester.IsTransient(writeError{err: bolt.ErrIncompatibleValue}))
+
+	// the database won't become writable by retrying
+	assert.False(t, ingester.IsTransient(writeError{err: bolt.ErrDatabaseReadOnly}))
+	assert.False(t, ingester.IsTransient(writeError{err: fmt.Errorf("page 12: %w", bolt.ErrInvalid)}))
+}
+
+func TestStoreReverse(t *testing.T) {
+	start := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+
+	s := open(t, config.Store{})
+	assert.Nil(t, s.Append(
+		ingester.Sample{Time: start, Plant: "monstera", Moisture: float(40)},
+		ingester.Sample{Time: start.Add(time.Minute), Plant: "monstera", Moisture: float(41)},
+	))
+
+	var latest ingester.Sample
+	err := s.Reverse("monstera", func(sample ingester.Sample) bool {
+		latest = sample
+		return false
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, float32(41), *latest.Moisture)
+}
+
+func TestStoreCompact(t *testing.T) {
+	start := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+
+	s := open(t, config.Store{
+		Retention:     30 * 24 * time.Hour,
+		CompactAfter:  24 * time.Hour,
+		CompactWindow: time.Hour,
+	})
+
+	assert.Nil(t, s.Append(
+		// expired
+		ingester.Sample{Time: start.Add(-40 * 24 * time.Hour), Plant: "monstera", Moisture: float(10)},
+		// compacted into one sample
+		ingester.Sample{Time: start, Plant: "monstera", Moisture: float(40)},
+		ingester.Sample{Time: start.Add(10 * time.Minute), Plant: "monstera", Moisture: float(44)},
+		// kept as is
+		ingester.Sample{Time: start.Add(25 * time.Hour), Plant: "monstera", Moisture: float(50)},
+		// gone entirely
+		ingester.Sample{Time: start.Add(-40 * 24 * time.Hour), Plant: "fern", Moisture: float(55)},
+	))
+
+	now := start.Add(26 * time.Hour)
+	assert.Nil(t, s.Compact(now))
+
+	plants, err := s.Plants()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"monstera"}, plants)
+
+	samples := collect(t, s, "monstera", start.Add(-60*24*time.Hour), now)
+	assert.Len(t, samples, 2)
+
+	assert.Equal(t, start, samples[0].Time.UTC())
+	assert.Equal(t, float32(42), *samples[0].Moisture)
+	assert.Equal(t, "1h0m0s", samples[0].Window)
+	assert.Equal(t, ingester.Stats{Min: 40, Max: 44, Mean: 42, Last: 44, Count: 2}, samples[0].Stats[ingester.MetricMoisture])
+
+	assert.Equal(t, float32(50), *samples[1].Moisture)
+	assert.Equal(t, "", samples[1].Window)
+
+	// compacting again changes nothing
+	assert.Nil(t, s.Compact(now))
+	assert.Len(t, collect(t, s, "monstera", start.Add(-60*24*time.Hour), now), 2)
+}
+
+func TestStoreCompactBounded(t *testing.T) {
+	start := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+
+	defer func(samples int) {
+		compactSamples = samples
+	}(compactSamples)
+	compactSamples = 2
+
+	s := open(t, config.Store{CompactAfter: 24 * time.Hour, CompactWindow: time.Hour})
+
+	// three samples in the first window are compacted together, the rest
+	// in the next transaction
+	for _, offset := range []time.Duration{0, 10 * time.Minute, 20 * time.Minute, time.Hour, 2 * time.Hour} {
+		assert.Nil(t, s.Append(ingester.Sample{Time: start.Add(offset), Plant: "monstera", Moisture: float(40)}))
+	}
+
+	now := start.Add(30 * time.Hour)
+	assert.Nil(t, s.Compact(now))
+
+	samples := collect(t, s, "monstera", start, now)
+	assert.Len(t, samples, 3)
+	for i, count := range []int{3, 1, 1} {
+		assert.Equal(t, start.Add(time.Duration(i)*time.Hour), samples[i].Time.UTC())
+		assert.Equal(t, count, samples[i].Stats[ingester.MetricMoisture].Count)
+	}
+}
+
+func TestStoreCompactLate(t *testing.T) {
+	start := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+
+	s := open(t, config.Store{CompactAfter: 24 * time.Hour, CompactWindow: time.Hour})
+
+	assert.Nil(t, s.Append(
+		ingester.Sample{Time: start, Plant: "monstera", Moisture: float(40)},
+		ingester.Sample{Time: start.Add(10 * time.Minute), Plant: "monstera", Moisture: float(44)},
+	))
+
+	now := start.Add(26 * time.Hour)
+	assert.Nil(t, s.Compact(now))
+
+	// a sample that arrives after its window was compacted is merged into it
+	assert.Nil(t, s.Append(ingester.Sample{Time: start.Add(5 * time.Minute), Plant: "monstera", Moisture: float(30), Temperature: float(20)}))
+	assert.Nil(t, s.Compact(now))
+
+	samples := collect(t, s, "monstera", start, now)
+	assert.Len(t, samples, 1)
+	assert.Equal(t, float32(38), *samples[0].Moisture)
+	assert.Equal(t, float32(20), *samples[0].Temperature)
+	assert.Equal(t, ingester.Stats{Min: 30, Max: 44, Mean: 38, Last: 44, Count: 3}, samples[0].Stats[ingester.MetricMoisture])
+	assert.Equal(t, 1, samples[0].Stats[ingester.MetricTemperature].Count)
+}
+
+func TestOpenInvalid(t *testing.T) {
+	_, err := Open(config.Store{})
+	assert.NotNil(t, err)
+
+	_, err = Open(config.Store{
+		Path:          filepath.Join(t.TempDir(), "samples.db"),
+		CompactWindow: time.Millisecond,
+	})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,144 @@
+package stream
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// keepAlive stops proxies from closing quiet streams
+	keepAlive    = 15 * time.Second
+	writeTimeout = 10 * time.Second
+	// pongTimeout is how long a WebSocket client has to answer a ping
+	pongTimeout = 2 * keepAlive
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 4096,
+}
+
+// Handler serves the stream as Server-Sent Events on /stream/sse and over a
+// WebSocket on /stream/ws, filtered by the query, see ParseFilter
+func (h *Hub) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stream/sse", h.serveSSE)
+	mux.HandleFunc("/stream/ws", h.serveWebSocket)
+
+	return mux
+}
+
+func (h *Hub) serveSSE(w http.ResponseWriter, r *http.Request) {
+	filter, err := ParseFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming isn't supported", http.StatusInternalServerError)
+		return
+	}
+
+	sub := h.subscribe(filter)
+	defer h.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(keepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			_, err = fmt.Fprint(w, ": keep-alive\n\n")
+		case event := <-sub.events:
+			var data []byte
+			data, err = json.Marshal(event)
+			if err != nil {
+				logrus.WithError(err).Error("failed to encode stream event")
+				continue
+			}
+
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+		}
+
+		if err != nil {
+			logrus.WithError(err).Debug("stream client went away")
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func (h *Hub) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	filter, err := ParseFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader has responded
+		logrus.WithError(err).Debug("websocket upgrade failed")
+		return
+	}
+	defer conn.Close()
+
+	sub := h.subscribe(filter)
+	defer h.unsubscribe(sub)
+
+	// the client only sends control messages, reading handles pongs and closes
+	closed := make(chan struct{})
+	_ = conn.SetReadDeadline(time.Now().Add(pongTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongTimeout))
+	})
+	go func() {
+		defer close(closed)
+		for {
+			_, _, err := conn.NextReader()
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(keepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			_ = conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseGoingAway, "shutting down"),
+				time.Now().Add(writeTimeout))
+			return
+		case <-closed:
+			return
+		case <-ticker.C:
+			err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout))
+		case event := <-sub.events:
+			_ = conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			err = conn.WriteJSON(event)
+		}
+
+		if err != nil {
+			logrus.WithError(err).Debug("stream client went away")
+			return
+		}
+	}
+}
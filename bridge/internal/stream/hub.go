@@ -0,0 +1,282 @@
+package stream
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
+	"github.com/ryanrolds/plant-collector/bridge/internal/scanner"
+	"github.com/sirupsen/logrus"
+)
+
+// subscriberBuffer is how many events a slow client can fall behind before
+// events are dropped
+const subscriberBuffer = 64
+
+// Event types
+const (
+	TypeSample        = "sample"
+	TypeAdvertisement = "advertisement"
+)
+
+// Event is a message on the stream
+type Event struct {
+	Type          string           `json:"type"`
+	Sample        *ingester.Sample `json:"sample,omitempty"`
+	Advertisement *Advertisement   `json:"advertisement,omitempty"`
+}
+
+// Advertisement is a received advertisement, service data is hex encoded
+type Advertisement struct {
+	Time        time.Time     `json:"time"`
+	Address     string        `json:"address"`
+	Name        string        `json:"name,omitempty"`
+	RSSI        int           `json:"rssi"`
+	DeviceType  string        `json:"device_type,omitempty"`
+	ServiceData []ServiceData `json:"service_data,omitempty"`
+	// Error is why the sensor's driver couldn't decode it
+	Error string `json:"error,omitempty"`
+}
+
+type ServiceData struct {
+	UUID string `json:"uuid"`
+	Data string `json:"data"`
+}
+
+// Filter picks the events a client receives. Empty sets match everything,
+// advertisements are only sent when asked for and don't match a plant filter
+// as they aren't assigned to plants.
+type Filter struct {
+	Plants         map[string]bool
+	Devices        map[string]bool
+	DeviceTypes    map[string]bool
+	Metrics        map[string]bool
+	Advertisements bool
+}
+
+// ParseFilter reads a filter from the plant, device, device_type, metric and
+// advertisements query parameters, lists are repeated or comma separated
+func ParseFilter(query url.Values) (Filter, error) {
+	f := Filter{
+		Plants:      set(query["plant"]),
+		Devices:     set(query["device"]),
+		DeviceTypes: set(query["device_type"]),
+		Metrics:     set(query["metric"]),
+	}
+
+	for metric := range f.Metrics {
+		if !ingester.IsMetric(metric) {
+			return Filter{}, fmt.Errorf("unknown metric %q", metric)
+		}
+	}
+
+	switch query.Get("advertisements") {
+	case "", "false", "0":
+	case "true", "1":
+		f.Advertisements = true
+	default:
+		return Filter{}, fmt.Errorf("invalid advertisements %q, use true or false", query.Get("advertisements"))
+	}
+
+	return f, nil
+}
+
+func set(values []string) map[string]bool {
+	var items map[string]bool
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+
+			if items == nil {
+				items = make(map[string]bool)
+			}
+			items[item] = true
+		}
+	}
+
+	return items
+}
+
+// sample returns the sample with only the filtered metrics, false if it
+// doesn't match
+func (f Filter) sample(s ingester.Sample) (ingester.Sample, bool) {
+	if f.Plants != nil && !f.Plants[s.Plant] {
+		return s, false
+	}
+	if f.Devices != nil && !f.Devices[s.Device] {
+		return s, false
+	}
+	if f.DeviceTypes != nil && !f.DeviceTypes[s.DeviceType] {
+		return s, false
+	}
+	if f.Metrics == nil {
+		return s, true
+	}
+
+	kept := 0
+	for metric := range s.Values() {
+		if f.Metrics[metric] {
+			kept++
+			continue
+		}
+
+		s.ClearValue(metric)
+	}
+
+	return s, kept > 0
+}
+
+func (f Filter) advertisement(a *Advertisement) bool {
+	if !f.Advertisements || f.Plants != nil {
+		return false
+	}
+	if f.Devices != nil && !f.Devices[a.Address] {
+		return false
+	}
+	if f.DeviceTypes != nil && !f.DeviceTypes[a.DeviceType] {
+		return false
+	}
+
+	return true
+}
+
+type subscriber struct {
+	filter  Filter
+	events  chan Event
+	dropped int
+}
+
+// Hub is a pipeline stage that publishes every sample to the clients watching
+// the stream. It also observes the scanner for clients that want the raw
+// advertisements. Publishing never blocks, a client that falls behind misses
+// events.
+type Hub struct {
+	mu          sync.Mutex
+	subscribers map[*subscriber]bool
+	// advertisements counts the subscribers that want them, most don't
+	advertisements int
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		subscribers: make(map[*subscriber]bool),
+	}
+}
+
+// Process publishes the sample and passes it on
+func (h *Hub) Process(s ingester.Sample) []ingester.Sample {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for sub := range h.subscribers {
+		filtered, ok := sub.filter.sample(s)
+		if !ok {
+			continue
+		}
+
+		sub.send(Event{Type: TypeSample, Sample: clone(filtered)})
+	}
+
+	return []ingester.Sample{s}
+}
+
+// Observe publishes the advertisement to the clients that want them
+func (h *Hub) Observe(a scanner.Advertisement) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.advertisements == 0 {
+		return
+	}
+
+	event := &Advertisement{
+		Time:       a.Time,
+		Address:    a.Address,
+		Name:       a.Name,
+		RSSI:       a.RSSI,
+		DeviceType: a.Driver,
+	}
+	if a.Err != nil {
+		event.Error = a.Err.Error()
+	}
+	for _, data := range a.ServiceData {
+		event.ServiceData = append(event.ServiceData, ServiceData{
+			UUID: data.UUID,
+			Data: hex.EncodeToString(data.Data),
+		})
+	}
+
+	for sub := range h.subscribers {
+		if sub.filter.advertisement(event) {
+			sub.send(Event{Type: TypeAdvertisement, Advertisement: event})
+		}
+	}
+}
+
+// clone copies the sample's maps, the sample is encoded on the client's
+// goroutine while later stages may change them
+func clone(s ingester.Sample) *ingester.Sample {
+	if s.Stats != nil {
+		stats := make(map[string]ingester.Stats, len(s.Stats))
+		for metric, st := range s.Stats {
+			stats[metric] = st
+		}
+		s.Stats = stats
+	}
+
+	if s.Quality != nil {
+		quality := make(map[string]string, len(s.Quality))
+		for metric, reason := range s.Quality {
+			quality[metric] = reason
+		}
+		s.Quality = quality
+	}
+
+	return &s
+}
+
+func (s *subscriber) send(e Event) {
+	select {
+	case s.events <- e:
+	default:
+		s.dropped++
+	}
+}
+
+func (h *Hub) subscribe(f Filter) *subscriber {
+	sub := &subscriber{
+		filter: f,
+		events: make(chan Event, subscriberBuffer),
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.subscribers[sub] = true
+	if f.Advertisements {
+		h.advertisements++
+	}
+
+	return sub
+}
+
+func (h *Hub) unsubscribe(sub *subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.subscribers, sub)
+	if sub.filter.Advertisements {
+		h.advertisements--
+	}
+
+	if sub.dropped > 0 {
+		logrus.WithField("dropped", sub.dropped).Debug("stream client fell behind")
+	}
+}
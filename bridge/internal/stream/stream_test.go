@@ -0,0 +1,175 @@
+package stream
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
+	"github.com/ryanrolds/plant-collector/bridge/internal/scanner"
+	"github.com/stretchr/testify/assert"
+)
+
+func float(v float32) *float32 {
+	return &v
+}
+
+func TestParseFilter(t *testing.T) {
+	f, err := ParseFilter(url.Values{
+		"plant":          {"monstera,fern", "cactus"},
+		"metric":         {"moist"},
+		"advertisements": {"true"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, Filter{
+		Plants:         map[string]bool{"monstera": true, "fern": true, "cactus": true},
+		Metrics:        map[string]bool{"moist": true},
+		Advertisements: true,
+	}, f)
+
+	_, err = ParseFilter(url.Values{"metric": {"wetness"}})
+	assert.NotNil(t, err)
+
+	_, err = ParseFilter(url.Values{"advertisements": {"maybe"}})
+	assert.NotNil(t, err)
+}
+
+func TestFilterSample(t *testing.T) {
+	s := ingester.Sample{Plant: "monstera", DeviceType: "b-parasite", Moisture: float(40), Temperature: float(20)}
+
+	tests := []struct {
+		name    string
+		filter  Filter
+		matches bool
+		metrics int
+	}{
+		{name: "everything", filter: Filter{}, matches: true, metrics: 2},
+		{name: "plant", filter: Filter{Plants: map[string]bool{"monstera": true}}, matches: true, metrics: 2},
+		{name: "other plant", filter: Filter{Plants: map[string]bool{"fern": true}}},
+		{name: "other device type", filter: Filter{DeviceTypes: map[string]bool{"flower_care": true}}},
+		{name: "metric", filter: Filter{Metrics: map[string]bool{"moist": true}}, matches: true, metrics: 1},
+		{name: "missing metric", filter: Filter{Metrics: map[string]bool{"light": true}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filtered, ok := test.filter.sample(s)
+			assert.Equal(t, test.matches, ok)
+			if ok {
+				assert.Len(t, filtered.Values(), test.metrics)
+			}
+		})
+	}
+}
+
+func TestHubSlowClient(t *testing.T) {
+	h := NewHub()
+	sub := h.subscribe(Filter{})
+
+	for i := 0; i < subscriberBuffer+10; i++ {
+		h.Process(ingester.Sample{Plant: "monstera", Moisture: float(40)})
+	}
+
+	assert.Len(t, sub.events, subscriberBuffer)
+	assert.Equal(t, 10, sub.dropped)
+
+	h.unsubscribe(sub)
+	assert.Len(t, h.subscribers, 0)
+}
+
+func TestSSE(t *testing.T) {
+	start := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+
+	h := NewHub()
+	server := httptest.NewServer(h.Handler())
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/stream/sse?plant=monstera&advertisements=true", nil)
+	assert.Nil(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	waitForSubscribers(t, h, 1)
+
+	h.Process(ingester.Sample{Time: start, Plant: "fern", Moisture: float(55)})
+	h.Process(ingester.Sample{Time: start, Plant: "monstera", Moisture: float(40)})
+	// plant filters leave out advertisements
+	h.Observe(scanner.Advertisement{Time: start, Address: "11:22:33:44:55:66"})
+
+	reader := bufio.NewReader(resp.Body)
+	line, err := reader.ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, "event: sample\n", line)
+
+	line, err = reader.ReadString('\n')
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(line, "data: "))
+
+	var event Event
+	assert.Nil(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event))
+	assert.Equal(t, "monstera", event.Sample.Plant)
+	assert.Equal(t, float32(40), *event.Sample.Moisture)
+}
+
+func TestWebSocket(t *testing.T) {
+	start := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+
+	h := NewHub()
+	server := httptest.NewServer(h.Handler())
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/stream/ws?advertisements=true&device_type=b-parasite", nil)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	waitForSubscribers(t, h, 1)
+
+	h.Observe(scanner.Advertisement{Time: start, Address: "11:22:33:44:55:66"})
+	h.Observe(scanner.Advertisement{Time: start, Address: "C4:7C:8D:6A:3D:72", Driver: "b-parasite", RSSI: -70,
+		ServiceData: []scanner.ServiceData{{UUID: "0000181a-0000-1000-8000-00805f9b34fb", Data: []byte{0x20, 0x01}}}})
+	h.Process(ingester.Sample{Time: start, Plant: "monstera", DeviceType: "b-parasite", Moisture: float(40)})
+
+	var event Event
+	assert.Nil(t, conn.ReadJSON(&event))
+	assert.Equal(t, TypeAdvertisement, event.Type)
+	assert.Equal(t, "C4:7C:8D:6A:3D:72", event.Advertisement.Address)
+	assert.Equal(t, []ServiceData{{UUID: "0000181a-0000-1000-8000-00805f9b34fb", Data: "2001"}}, event.Advertisement.ServiceData)
+
+	assert.Nil(t, conn.ReadJSON(&event))
+	assert.Equal(t, TypeSample, event.Type)
+	assert.Equal(t, "monstera", event.Sample.Plant)
+
+	conn.Close()
+	waitForSubscribers(t, h, 0)
+	assert.Equal(t, 0, h.advertisements)
+}
+
+func TestInvalidFilter(t *testing.T) {
+	h := NewHub()
+
+	for _, path := range []string{"/stream/sse?metric=wetness", "/stream/ws?metric=wetness"} {
+		w := httptest.NewRecorder()
+		h.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	}
+}
+
+func waitForSubscribers(t *testing.T, h *Hub, n int) {
+	assert.Eventually(t, func() bool {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		return len(h.subscribers) == n
+	}, time.Second, 5*time.Millisecond)
+}
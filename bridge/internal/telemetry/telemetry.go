@@ -0,0 +1,393 @@
+package telemetry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ryanrolds/plant-collector/bridge/internal/collector"
+	"github.com/ryanrolds/plant-collector/bridge/internal/config"
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
+	"github.com/ryanrolds/plant-collector/bridge/internal/scanner"
+	"github.com/ryanrolds/plant-collector/bridge/internal/sink"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultHeartbeatInterval = time.Minute
+	heartbeatTimeout         = 10 * time.Second
+)
+
+// driverOther counts the advertisements of devices that aren't plant sensors
+const driverOther = "other"
+
+// Adapter reports the state of the Bluetooth adapter, see scanner.BTLEScanner
+type Adapter interface {
+	AdapterState() string
+	AdapterRestarts() int
+}
+
+// Sinks reports the state of the sinks, see sink.FanOut
+type Sinks interface {
+	Status() []sink.Status
+}
+
+// Polls counts a driver's GATT connections
+type Polls struct {
+	Successes int `json:"successes"`
+	Failures  int `json:"failures"`
+}
+
+// Sink counts a sink's delivery attempts
+type Sink struct {
+	Name   string `json:"name"`
+	Queued int    `json:"queued"`
+	Sends  int    `json:"sends"`
+	// Failures is how many of the sends failed, retries included
+	Failures int `json:"failures"`
+	// SendSeconds is the time spent sending
+	SendSeconds float64 `json:"send_seconds"`
+}
+
+// Heartbeat is the record sent to the ingester. Counters are totals since the
+// bridge started, the uptime tells when they were reset.
+type Heartbeat struct {
+	Time            time.Time `json:"time"`
+	Collector       string    `json:"collector"`
+	Site            string    `json:"site,omitempty"`
+	Version         string    `json:"version"`
+	UptimeSeconds   float64   `json:"uptime_seconds"`
+	Adapter         string    `json:"adapter"`
+	AdapterRestarts int       `json:"adapter_restarts"`
+	// Advertisements, their rates and decode errors are keyed by driver
+	Advertisements map[string]int `json:"advertisements"`
+	// AdvertisementRates are per second since the previous heartbeat
+	AdvertisementRates map[string]float64 `json:"advertisements_per_second"`
+	DecodeErrors       map[string]int     `json:"decode_errors"`
+	// Samples is keyed by device type
+	Samples map[string]int   `json:"samples"`
+	Polls   map[string]Polls `json:"gatt_connections"`
+	Sinks   []Sink           `json:"sinks"`
+}
+
+type sends struct {
+	count    int
+	failures int
+	seconds  float64
+}
+
+// Telemetry counts what the bridge does: advertisements, decode errors,
+// samples, GATT connections and deliveries. It observes the scanner and the
+// sinks, is a pipeline stage counting samples, exposes the counters as
+// Prometheus metrics and periodically sends them to the ingester as a
+// heartbeat.
+type Telemetry struct {
+	version      string
+	identity     collector.Identity
+	adapter      Adapter
+	sinks        Sinks
+	heartbeatURL string
+	interval     time.Duration
+	client       *http.Client
+	started      time.Time
+	now          func() time.Time
+
+	info            *prometheus.Desc
+	advertisements  *prometheus.Desc
+	decodeErrors    *prometheus.Desc
+	samples         *prometheus.Desc
+	polls           *prometheus.Desc
+	adapterRestarts *prometheus.Desc
+	queued          *prometheus.Desc
+	sendDuration    *prometheus.Desc
+	sendFailures    *prometheus.Desc
+
+	mu                 sync.Mutex
+	advertisementCount map[string]int
+	decodeErrorCount   map[string]int
+	sampleCount        map[string]int
+	pollCount          map[string]*Polls
+	sendCount          map[string]*sends
+	// lastBeat and lastAdvertisements are for the rates of the next heartbeat
+	lastBeat           time.Time
+	lastAdvertisements map[string]int
+}
+
+func NewTelemetry(cfg config.Telemetry, version string, identity collector.Identity, adapter Adapter, sinks Sinks) *Telemetry {
+	t := &Telemetry{
+		version:      version,
+		identity:     identity,
+		adapter:      adapter,
+		sinks:        sinks,
+		heartbeatURL: cfg.HeartbeatURL,
+		interval:     cfg.HeartbeatInterval,
+		client:       &http.Client{Timeout: heartbeatTimeout},
+		started:      time.Now(),
+		now:          time.Now,
+
+		info: prometheus.NewDesc("bridge_info",
+			"The bridge's version and collector ID.", []string{"version", "collector"}, nil),
+		advertisements: prometheus.NewDesc("bridge_advertisements_total",
+			"Advertisements received, by the driver that decoded them.", []string{"driver"}, nil),
+		decodeErrors: prometheus.NewDesc("bridge_decode_errors_total",
+			"Advertisements of plant sensors that couldn't be decoded.", []string{"driver"}, nil),
+		samples: prometheus.NewDesc("bridge_samples_total",
+			"Samples produced from advertisements and polls.", []string{"device_type"}, nil),
+		polls: prometheus.NewDesc("bridge_gatt_connections_total",
+			"GATT connections made to poll sensors, by result.", []string{"driver", "result"}, nil),
+		adapterRestarts: prometheus.NewDesc("bridge_adapter_restarts_total",
+			"Times the Bluetooth adapter was enabled again after the scan failed.", nil, nil),
+		queued: prometheus.NewDesc("bridge_sink_queued_samples",
+			"Samples waiting to be delivered by the sink.", []string{"sink"}, nil),
+		sendDuration: prometheus.NewDesc("bridge_sink_send_duration_seconds",
+			"How long the sink's delivery attempts took.", []string{"sink"}, nil),
+		sendFailures: prometheus.NewDesc("bridge_sink_send_failures_total",
+			"The sink's failed delivery attempts, retries included.", []string{"sink"}, nil),
+
+		advertisementCount: make(map[string]int),
+		decodeErrorCount:   make(map[string]int),
+		sampleCount:        make(map[string]int),
+		pollCount:          make(map[string]*Polls),
+		sendCount:          make(map[string]*sends),
+		lastAdvertisements: make(map[string]int),
+	}
+
+	if t.interval == 0 {
+		t.interval = defaultHeartbeatInterval
+	}
+	t.lastBeat = t.started
+
+	return t
+}
+
+// HeartbeatURL returns heartbeat next to the ingester's URL, the first http
+// sink's, e.g. https://example.com/api/heartbeat for
+// https://example.com/api/samples
+func HeartbeatURL(sinks []config.Sink) string {
+	for _, s := range sinks {
+		if s.Type != sink.TypeHTTP {
+			continue
+		}
+
+		u, err := url.Parse(s.HTTP.URL)
+		if err != nil {
+			return ""
+		}
+
+		return u.ResolveReference(&url.URL{Path: "heartbeat"}).String()
+	}
+
+	return ""
+}
+
+// Observe counts the advertisement and its decode error
+func (t *Telemetry) Observe(a scanner.Advertisement) {
+	driver := a.Driver
+	if driver == "" {
+		driver = driverOther
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.advertisementCount[driver]++
+	if a.Err != nil {
+		t.decodeErrorCount[driver]++
+	}
+}
+
+// ObservePoll counts the poll's GATT connection
+func (t *Telemetry) ObservePoll(p scanner.Poll) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	polls, ok := t.pollCount[p.Driver]
+	if !ok {
+		polls = &Polls{}
+		t.pollCount[p.Driver] = polls
+	}
+
+	if p.Err != nil {
+		polls.Failures++
+		return
+	}
+	polls.Successes++
+}
+
+// ObserveSend counts the sink's delivery attempt
+func (t *Telemetry) ObserveSend(name string, took time.Duration, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s, ok := t.sendCount[name]
+	if !ok {
+		s = &sends{}
+		t.sendCount[name] = s
+	}
+
+	s.count++
+	s.seconds += took.Seconds()
+	if err != nil {
+		s.failures++
+	}
+}
+
+// Process counts the sample and passes it on
+func (t *Telemetry) Process(s ingester.Sample) []ingester.Sample {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.sampleCount[s.DeviceType]++
+
+	return []ingester.Sample{s}
+}
+
+// Describe implements prometheus.Collector
+func (t *Telemetry) Describe(ch chan<- *prometheus.Desc) {
+	ch <- t.info
+	ch <- t.advertisements
+	ch <- t.decodeErrors
+	ch <- t.samples
+	ch <- t.polls
+	ch <- t.adapterRestarts
+	ch <- t.queued
+	ch <- t.sendDuration
+	ch <- t.sendFailures
+}
+
+// Collect implements prometheus.Collector
+func (t *Telemetry) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(t.info, prometheus.GaugeValue, 1, t.version, t.identity.ID)
+	ch <- prometheus.MustNewConstMetric(t.adapterRestarts, prometheus.CounterValue, float64(t.adapter.AdapterRestarts()))
+
+	for _, status := range t.sinks.Status() {
+		ch <- prometheus.MustNewConstMetric(t.queued, prometheus.GaugeValue, float64(status.Queued), status.Name)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for driver, count := range t.advertisementCount {
+		ch <- prometheus.MustNewConstMetric(t.advertisements, prometheus.CounterValue, float64(count), driver)
+	}
+	for driver, count := range t.decodeErrorCount {
+		ch <- prometheus.MustNewConstMetric(t.decodeErrors, prometheus.CounterValue, float64(count), driver)
+	}
+	for deviceType, count := range t.sampleCount {
+		ch <- prometheus.MustNewConstMetric(t.samples, prometheus.CounterValue, float64(count), deviceType)
+	}
+	for driver, polls := range t.pollCount {
+		ch <- prometheus.MustNewConstMetric(t.polls, prometheus.CounterValue, float64(polls.Successes), driver, "success")
+		ch <- prometheus.MustNewConstMetric(t.polls, prometheus.CounterValue, float64(polls.Failures), driver, "failure")
+	}
+	for name, s := range t.sendCount {
+		ch <- prometheus.MustNewConstSummary(t.sendDuration, uint64(s.count), s.seconds, nil, name)
+		ch <- prometheus.MustNewConstMetric(t.sendFailures, prometheus.CounterValue, float64(s.failures), name)
+	}
+}
+
+// Run sends a heartbeat now and then every interval until the context is
+// cancelled. A heartbeat that fails isn't retried, the next one follows soon.
+func (t *Telemetry) Run(ctx context.Context) {
+	if t.heartbeatURL == "" {
+		return
+	}
+
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+
+	for {
+		err := t.send(ctx, t.heartbeat())
+		if err != nil && ctx.Err() == nil {
+			logrus.WithError(err).WithField("url", t.heartbeatURL).Warn("failed to send heartbeat")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// heartbeat returns the current counters, the advertisement rates are since
+// the previous heartbeat
+func (t *Telemetry) heartbeat() Heartbeat {
+	now := t.now()
+
+	h := Heartbeat{
+		Time:               now,
+		Collector:          t.identity.ID,
+		Site:               t.identity.Site,
+		Version:            t.version,
+		UptimeSeconds:      now.Sub(t.started).Seconds(),
+		Adapter:            t.adapter.AdapterState(),
+		AdapterRestarts:    t.adapter.AdapterRestarts(),
+		Advertisements:     make(map[string]int),
+		AdvertisementRates: make(map[string]float64),
+		DecodeErrors:       make(map[string]int),
+		Samples:            make(map[string]int),
+		Polls:              make(map[string]Polls),
+	}
+
+	statuses := t.sinks.Status()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	elapsed := now.Sub(t.lastBeat).Seconds()
+	for driver, count := range t.advertisementCount {
+		h.Advertisements[driver] = count
+		if elapsed > 0 {
+			h.AdvertisementRates[driver] = float64(count-t.lastAdvertisements[driver]) / elapsed
+		}
+		t.lastAdvertisements[driver] = count
+	}
+	t.lastBeat = now
+
+	for driver, count := range t.decodeErrorCount {
+		h.DecodeErrors[driver] = count
+	}
+	for deviceType, count := range t.sampleCount {
+		h.Samples[deviceType] = count
+	}
+	for driver, polls := range t.pollCount {
+		h.Polls[driver] = *polls
+	}
+
+	h.Sinks = make([]Sink, 0, len(statuses))
+	for _, status := range statuses {
+		s := Sink{Name: status.Name, Queued: status.Queued}
+		if sent, ok := t.sendCount[status.Name]; ok {
+			s.Sends = sent.count
+			s.Failures = sent.failures
+			s.SendSeconds = sent.seconds
+		}
+		h.Sinks = append(h.Sinks, s)
+	}
+
+	sort.Slice(h.Sinks, func(i, j int) bool {
+		return h.Sinks[i].Name < h.Sinks[j].Name
+	})
+
+	return h
+}
+
+func (t *Telemetry) send(ctx context.Context, h Heartbeat) error {
+	body, err := json.Marshal(h)
+	if err != nil {
+		return fmt.Errorf("encoding heartbeat: %w", err)
+	}
+
+	headers := http.Header{}
+	headers.Set("Content-Type", "application/json; charset=UTF-8")
+
+	_, err = ingester.PostBody(ctx, t.client, t.heartbeatURL, body, headers)
+	return err
+}
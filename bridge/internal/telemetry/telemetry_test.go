@@ -0,0 +1,224 @@
+package telemetry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/ryanrolds/plant-collector/bridge/internal/collector"
+	"github.com/ryanrolds/plant-collector/bridge/internal/config"
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
+	"github.com/ryanrolds/plant-collector/bridge/internal/scanner"
+	"github.com/ryanrolds/plant-collector/bridge/internal/sink"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeAdapter struct {
+	state    string
+	restarts int
+}
+
+func (a fakeAdapter) AdapterState() string {
+	return a.state
+}
+
+func (a fakeAdapter) AdapterRestarts() int {
+	return a.restarts
+}
+
+type fakeSinks []sink.Status
+
+func (s fakeSinks) Status() []sink.Status {
+	return s
+}
+
+func testTelemetry(start time.Time, cfg config.Telemetry) *Telemetry {
+	t := NewTelemetry(cfg, "1.2.0", collector.Identity{ID: "greenhouse-1", Site: "home"},
+		fakeAdapter{state: scanner.AdapterScanning, restarts: 1},
+		fakeSinks{{Name: "ingester", Queued: 12}, {Name: "influx"}})
+	t.started = start
+	t.lastBeat = start
+	t.now = func() time.Time {
+		return start
+	}
+
+	// a minute of advertisements, samples, polls and deliveries
+	for i := 0; i < 60; i++ {
+		t.Observe(scanner.Advertisement{Time: start, Address: "C4:7C:8D:6A:3D:72", Driver: "b-parasite"})
+	}
+	for i := 0; i < 120; i++ {
+		t.Observe(scanner.Advertisement{Time: start, Address: "11:22:33:44:55:66"})
+	}
+	t.Observe(scanner.Advertisement{Time: start, Address: "C4:7C:8D:6A:3D:72", Driver: "b-parasite",
+		Err: errors.New("advertisement has no sensor data")})
+	t.Process(ingester.Sample{Time: start, Device: "C4:7C:8D:6A:3D:72", DeviceType: "b-parasite"})
+	t.Process(ingester.Sample{Time: start, Device: "0A:0B:0C:0D:0E:0F", DeviceType: "flower_care"})
+	t.ObservePoll(scanner.Poll{Time: start, Address: "0A:0B:0C:0D:0E:0F", Driver: "flower_care"})
+	t.ObservePoll(scanner.Poll{Time: start, Address: "0A:0B:0C:0D:0E:0F", Driver: "flower_care", Err: errors.New("connection timed out")})
+	t.ObserveSend("ingester", 200*time.Millisecond, errors.New("connection refused"))
+	t.ObserveSend("ingester", 300*time.Millisecond, nil)
+
+	return t
+}
+
+func TestHeartbeat(t *testing.T) {
+	start := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+	tel := testTelemetry(start, config.Telemetry{})
+	tel.now = func() time.Time {
+		return start.Add(time.Minute)
+	}
+
+	h := tel.heartbeat()
+	assert.Equal(t, Heartbeat{
+		Time:               start.Add(time.Minute),
+		Collector:          "greenhouse-1",
+		Site:               "home",
+		Version:            "1.2.0",
+		UptimeSeconds:      60,
+		Adapter:            scanner.AdapterScanning,
+		AdapterRestarts:    1,
+		Advertisements:     map[string]int{"b-parasite": 61, "other": 120},
+		AdvertisementRates: map[string]float64{"b-parasite": 61.0 / 60, "other": 2},
+		DecodeErrors:       map[string]int{"b-parasite": 1},
+		Samples:            map[string]int{"b-parasite": 1, "flower_care": 1},
+		Polls:              map[string]Polls{"flower_care": {Successes: 1, Failures: 1}},
+		Sinks: []Sink{
+			{Name: "influx"},
+			{Name: "ingester", Queued: 12, Sends: 2, Failures: 1, SendSeconds: 0.5},
+		},
+	}, h)
+
+	// rates are since the previous heartbeat
+	tel.now = func() time.Time {
+		return start.Add(2 * time.Minute)
+	}
+	tel.Observe(scanner.Advertisement{Time: start, Address: "11:22:33:44:55:66"})
+
+	h = tel.heartbeat()
+	assert.Equal(t, map[string]float64{"b-parasite": 0, "other": 1.0 / 60}, h.AdvertisementRates)
+	assert.Equal(t, 121, h.Advertisements["other"])
+}
+
+func TestCollect(t *testing.T) {
+	start := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+	tel := testTelemetry(start, config.Telemetry{})
+
+	expected := `
+# HELP bridge_adapter_restarts_total Times the Bluetooth adapter was enabled again after the scan failed.
+# TYPE bridge_adapter_restarts_total counter
+bridge_adapter_restarts_total 1
+# HELP bridge_advertisements_total Advertisements received, by the driver that decoded them.
+# TYPE bridge_advertisements_total counter
+bridge_advertisements_total{driver="b-parasite"} 61
+bridge_advertisements_total{driver="other"} 120
+# HELP bridge_decode_errors_total Advertisements of plant sensors that couldn't be decoded.
+# TYPE bridge_decode_errors_total counter
+bridge_decode_errors_total{driver="b-parasite"} 1
+# HELP bridge_gatt_connections_total GATT connections made to poll sensors, by result.
+# TYPE bridge_gatt_connections_total counter
+bridge_gatt_connections_total{driver="flower_care",result="failure"} 1
+bridge_gatt_connections_total{driver="flower_care",result="success"} 1
+# HELP bridge_info The bridge's version and collector ID.
+# TYPE bridge_info gauge
+bridge_info{collector="greenhouse-1",version="1.2.0"} 1
+# HELP bridge_samples_total Samples produced from advertisements and polls.
+# TYPE bridge_samples_total counter
+bridge_samples_total{device_type="b-parasite"} 1
+bridge_samples_total{device_type="flower_care"} 1
+# HELP bridge_sink_queued_samples Samples waiting to be delivered by the sink.
+# TYPE bridge_sink_queued_samples gauge
+bridge_sink_queued_samples{sink="influx"} 0
+bridge_sink_queued_samples{sink="ingester"} 12
+# HELP bridge_sink_send_duration_seconds How long the sink's delivery attempts took.
+# TYPE bridge_sink_send_duration_seconds summary
+bridge_sink_send_duration_seconds_sum{sink="ingester"} 0.5
+bridge_sink_send_duration_seconds_count{sink="ingester"} 2
+# HELP bridge_sink_send_failures_total The sink's failed delivery attempts, retries included.
+# TYPE bridge_sink_send_failures_total counter
+bridge_sink_send_failures_total{sink="ingester"} 1
+`
+	assert.Nil(t, testutil.CollectAndCompare(tel, strings.NewReader(expected)))
+}
+
+func TestRun(t *testing.T) {
+	start := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+
+	heartbeats := make(chan Heartbeat, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "/heartbeat", r.URL.Path)
+
+		var h Heartbeat
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&h))
+		heartbeats <- h
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	tel := testTelemetry(start, config.Telemetry{HeartbeatURL: server.URL + "/heartbeat", HeartbeatInterval: 10 * time.Millisecond})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tel.Run(ctx)
+	}()
+
+	// one heartbeat on start and more every interval
+	for i := 0; i < 2; i++ {
+		select {
+		case h := <-heartbeats:
+			assert.Equal(t, "greenhouse-1", h.Collector)
+			assert.Equal(t, 61, h.Advertisements["b-parasite"])
+		case <-time.After(time.Second):
+			t.Fatal("no heartbeat sent")
+		}
+	}
+
+	cancel()
+	<-done
+}
+
+func TestSendRejected(t *testing.T) {
+	start := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	tel := testTelemetry(start, config.Telemetry{HeartbeatURL: server.URL + "/heartbeat"})
+
+	err := tel.send(context.Background(), tel.heartbeat())
+	var statusErr *ingester.StatusError
+	assert.True(t, errors.As(err, &statusErr))
+	assert.Equal(t, http.StatusNotFound, statusErr.StatusCode)
+}
+
+func TestHeartbeatURL(t *testing.T) {
+	tests := []struct {
+		url      string
+		expected string
+	}{
+		{url: "http://ingester:8080", expected: "http://ingester:8080/heartbeat"},
+		{url: "http://ingester:8080/samples", expected: "http://ingester:8080/heartbeat"},
+		{url: "https://example.com/plants/api/samples?token=secret", expected: "https://example.com/plants/api/heartbeat"},
+		{url: "https://example.com/plants/api/", expected: "https://example.com/plants/api/heartbeat"},
+	}
+
+	for _, test := range tests {
+		sinks := []config.Sink{
+			{Type: sink.TypeMQTT},
+			{Type: sink.TypeHTTP, HTTP: config.Ingester{URL: test.url}},
+		}
+		assert.Equal(t, test.expected, HeartbeatURL(sinks), test.url)
+	}
+
+	assert.Equal(t, "", HeartbeatURL([]config.Sink{{Type: sink.TypeMQTT}}))
+}
@@ -2,16 +2,57 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"sync"
 	"syscall"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ryanrolds/plant-collector/bridge/internal/api"
+	"github.com/ryanrolds/plant-collector/bridge/internal/buffer"
+	"github.com/ryanrolds/plant-collector/bridge/internal/collector"
+	"github.com/ryanrolds/plant-collector/bridge/internal/config"
+	"github.com/ryanrolds/plant-collector/bridge/internal/dashboard"
+	"github.com/ryanrolds/plant-collector/bridge/internal/deadband"
+	"github.com/ryanrolds/plant-collector/bridge/internal/derive"
+	"github.com/ryanrolds/plant-collector/bridge/internal/downsample"
+	"github.com/ryanrolds/plant-collector/bridge/internal/health"
 	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
+	"github.com/ryanrolds/plant-collector/bridge/internal/metrics"
+	"github.com/ryanrolds/plant-collector/bridge/internal/pipeline"
+	"github.com/ryanrolds/plant-collector/bridge/internal/plants"
+	"github.com/ryanrolds/plant-collector/bridge/internal/quality"
+	"github.com/ryanrolds/plant-collector/bridge/internal/queue"
 	"github.com/ryanrolds/plant-collector/bridge/internal/scanner"
+	"github.com/ryanrolds/plant-collector/bridge/internal/server"
+	"github.com/ryanrolds/plant-collector/bridge/internal/sink"
+	"github.com/ryanrolds/plant-collector/bridge/internal/store"
+	"github.com/ryanrolds/plant-collector/bridge/internal/stream"
+	"github.com/ryanrolds/plant-collector/bridge/internal/telemetry"
 	"github.com/sirupsen/logrus"
 )
 
+// default paths are on balena's persistent data volume
+const (
+	defaultDataDir        = "/data"
+	defaultConfigPath     = "/data/config.yaml"
+	defaultDeadLetterPath = "/data/dead-letter.ndjson"
+	defaultQueueDir       = "/data/queue"
+	defaultSpillDir       = "/data/spill"
+	defaultStorePath      = "/data/store/samples.db"
+	defaultStoreQueueDir  = "/data/store/queue"
+)
+
+// version is set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+// defaultGracePeriod leaves time to exit before balena's stop timeout
+const defaultGracePeriod = 8 * time.Second
+
 func init() {
 	// Log as JSON instead of the default ASCII formatter.
 	//logrus.SetFormatter(&logrus.JSONFormatter{})
@@ -25,54 +66,411 @@ func init() {
 }
 
 func main() {
-	logrus.Info("starting bridge")
+	logrus.WithField("version", version).Info("starting bridge")
 
-	ingesterURL := os.Getenv("INGESTER_URL")
-	if ingesterURL == "" {
-		logrus.Fatal("INGESTER_URL must be set")
+	configPath := os.Getenv("CONFIG_PATH")
+	if configPath == "" {
+		configPath = defaultConfigPath
+	}
+
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		logrus.WithError(err).Fatal("failed to load config")
+	}
+
+	logrus.WithField("path", configPath).Info("config loaded")
+
+	identity, err := collector.Resolve(cfg.Collector)
+	if err != nil {
+		logrus.WithError(err).Fatal("failed to resolve collector id")
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"collector": identity.ID,
+		"source":    identity.Source,
+		"site":      identity.Site,
+	}).Info("collector identified")
+
+	registry, err := plants.NewRegistry(cfg.Plants)
+	if err != nil {
+		logrus.WithError(err).Fatal("failed to build plant registry")
+	}
+
+	logrus.WithField("plants", len(registry.Plants())).Info("plant registry loaded")
+
+	validator, err := quality.NewValidator(cfg.Validation)
+	if err != nil {
+		logrus.WithError(err).Fatal("failed to configure validation")
+	}
+
+	deriver, err := derive.NewDeriver(cfg.Derive)
+	if err != nil {
+		logrus.WithError(err).Fatal("failed to configure derived metrics")
+	}
+
+	reporting, err := reportStages(cfg)
+	if err != nil {
+		logrus.WithError(err).Fatal("failed to configure reporting")
+	}
+
+	srv := server.NewServer(cfg.Server)
+	serving := false
+
+	sinkConfigs, err := sinks(cfg, identity.ID)
+	if err != nil {
+		logrus.WithError(err).Fatal("failed to configure sinks")
+	}
+
+	outputs := make([]*sink.Output, 0, len(sinkConfigs))
+	for _, sinkConfig := range sinkConfigs {
+		output, err := sink.Open(sinkConfig)
+		if err != nil {
+			logrus.WithError(err).Fatal("failed to open sink")
+		}
+
+		outputs = append(outputs, output)
+		logrus.WithFields(logrus.Fields{
+			"sink": sinkConfig.Name,
+			"type": sinkConfig.Type,
+		}).Info("sink selected")
+	}
+
+	var st *store.Store
+	if cfg.Store.Enabled {
+		if cfg.Store.Path == "" {
+			cfg.Store.Path = defaultStorePath
+		}
+		if cfg.Store.Queue.Dir == "" {
+			cfg.Store.Queue.Dir = defaultStoreQueueDir
+		}
+
+		st, err = store.Open(cfg.Store)
+		if err != nil {
+			logrus.WithError(err).Fatal("failed to open sample store")
+		}
+
+		q, err := queue.Open(cfg.Store.Queue)
+		if err != nil {
+			logrus.WithError(err).Fatal("failed to open sample store queue")
+		}
+
+		// stored like any other sink so writes never hold up the pipeline, but
+		// queued before report-on-change so every sample is kept
+		outputs = append(outputs, &sink.Output{Name: "store", Sink: st, Queue: q, Raw: true})
+		logrus.WithField("path", cfg.Store.Path).Info("sample store enabled")
+
+		srv.Handle("/api/", api.New(st, registry).Handler())
+		serving = true
+	}
+
+	fanOut := sink.NewFanOut(outputs...)
+
+	btle := scanner.NewBTLEScanner(cfg)
+
+	stages := []pipeline.Stage{identity, registry}
+	if cfg.Health.Enabled {
+		// before validation so every decoded sample is counted
+		monitor := health.NewMonitor(cfg.Health, btle, fanOut)
+		stages = append(stages, monitor)
+		btle.AddObserver(monitor)
+		for _, path := range []string{"/healthz", "/readyz", "/status"} {
+			srv.Handle(path, monitor.Handler())
+		}
+		serving = true
 	}
 
-	logrus.WithField("url", ingesterURL).Info("ingester selected")
+	var tel *telemetry.Telemetry
+	if cfg.Telemetry.Enabled {
+		if cfg.Telemetry.HeartbeatURL == "" {
+			cfg.Telemetry.HeartbeatURL = telemetry.HeartbeatURL(sinkConfigs)
+		}
+		if cfg.Telemetry.HeartbeatURL == "" {
+			logrus.Warn("no http sink to send heartbeats to, set telemetry.heartbeat_url")
+		}
+
+		// counted alongside the health monitor, before anything drops samples
+		tel = telemetry.NewTelemetry(cfg.Telemetry, version, identity, btle, fanOut)
+		stages = append(stages, tel)
+		btle.AddObserver(tel)
+		fanOut.AddObserver(tel)
+		prometheus.MustRegister(tel)
+		logrus.WithField("heartbeat_url", cfg.Telemetry.HeartbeatURL).Info("telemetry enabled")
+	}
+
+	stages = append(stages, validator, deriver)
+	if cfg.Prometheus.Enabled {
+		// before report-on-change so sensors are seen whenever they advertise
+		exporter := metrics.NewExporter(cfg.Prometheus)
+		stages = append(stages, exporter)
+		srv.Handle("/metrics", exporter.Handler())
+		serving = true
+	}
+
+	if cfg.Dashboard.Enabled {
+		tracker := dashboard.NewTracker(registry)
+		stages = append(stages, tracker)
+		btle.AddObserver(tracker)
+		srv.Handle("/", tracker.Handler())
+		serving = true
+	}
+
+	if cfg.Stream.Enabled {
+		hub := stream.NewHub()
+		stages = append(stages, hub)
+		btle.AddObserver(hub)
+		srv.Handle("/stream/", hub.Handler())
+		serving = true
+	}
+
+	// queues every sample for the raw outputs, the store
+	stages = append(stages, fanOut)
+	stages = append(stages, reporting...)
+
+	if cfg.Buffer.Spill.Dir == "" {
+		cfg.Buffer.Spill.Dir = defaultSpillDir
+	}
+
+	buf, err := buffer.NewBuffer(cfg.Buffer)
+	if err != nil {
+		logrus.WithError(err).Fatal("failed to configure sample buffer")
+	}
+	prometheus.MustRegister(buf, validator)
+
+	gracePeriod := cfg.ShutdownGracePeriod
+	if gracePeriod == 0 {
+		gracePeriod = defaultGracePeriod
+	}
+
+	// Shutdown is ordered: scanning stops first, then the buffer, pipeline and
+	// queues drain as their inputs close and the sinks send what's left.
+	// Sending is cancelled when the grace period runs out, unsent samples stay
+	// queued on disk for the next start.
+	scanCtx, stopScanning := context.WithCancel(context.Background())
+	ctx, stopSending := context.WithCancel(context.Background())
+	defer stopSending()
 
-	ctx, cancel := context.WithCancel(context.Background())
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		<-sigs
-		logrus.Info("SIGINT/SIGTERM received, shutting down")
-		cancel()
+		logrus.WithField("grace_period", gracePeriod).Info("SIGINT/SIGTERM received, shutting down")
+		stopScanning()
+
+		time.AfterFunc(gracePeriod, func() {
+			logrus.Warn("shutdown grace period over, stopping")
+			stopSending()
+		})
 	}()
 
-	// channel for buffering samples
+	// channels for buffering samples before and after processing
 	samples := make(chan ingester.Sample, 100)
+	processed := make(chan ingester.Sample, 100)
 
 	wg := sync.WaitGroup{}
 	wg.Add(1)
 	go func() {
-		scanner := scanner.NewBTLEScanner()
-		err := scanner.Scan(ctx, samples)
+		err := btle.Scan(scanCtx, buf)
 		if err != nil {
 			logrus.Error(err)
 		}
 
+		buf.Seal()
 		logrus.Info("scanner finished")
 		wg.Done()
 	}()
 
 	wg.Add(1)
 	go func() {
-		i := ingester.NewIngester(ingesterURL)
-		err := i.SendAll(ctx, samples)
+		err := buf.Run(ctx, samples)
 		if err != nil {
 			logrus.Error(err)
 		}
 
-		logrus.Info("ingester finished")
+		close(samples)
+		logrus.Info("buffer finished")
 		wg.Done()
 	}()
 
+	wg.Add(1)
+	go func() {
+		p := pipeline.New(stages...)
+		err := p.Run(ctx, samples, processed)
+		if err != nil {
+			logrus.Error(err)
+		}
+
+		close(processed)
+		logrus.Info("pipeline finished")
+		wg.Done()
+	}()
+
+	wg.Add(1)
+	go func() {
+		err := fanOut.AppendAll(ctx, processed)
+		if err != nil {
+			logrus.Error(err)
+		}
+
+		fanOut.Seal()
+		logrus.Info("queue writer finished")
+		wg.Done()
+	}()
+
+	wg.Add(1)
+	go func() {
+		fanOut.SendAll(ctx)
+
+		logrus.Info("sinks finished")
+		wg.Done()
+	}()
+
+	if tel != nil {
+		wg.Add(1)
+		go func() {
+			tel.Run(scanCtx)
+
+			logrus.Info("heartbeats finished")
+			wg.Done()
+		}()
+	}
+
+	serveCtx, stopServing := context.WithCancel(context.Background())
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		if !serving {
+			return
+		}
+
+		err := srv.Run(serveCtx)
+		if err != nil {
+			logrus.WithError(err).Error("http server failed")
+		}
+	}()
+
 	logrus.Info("waiting for goroutines to finish")
 	wg.Wait()
 
+	stopServing()
+	<-served
+
+	logrus.WithFields(logrus.Fields{
+		"buffered": buf.Len(),
+		"dropped":  buf.Dropped(),
+	}).Info("closing sample buffer")
+	err = buf.Close()
+	if err != nil {
+		logrus.WithError(err).Error("failed to close sample buffer")
+	}
+
+	err = fanOut.Close()
+	if err != nil {
+		logrus.WithError(err).Error("failed to close sink queues")
+	}
+
+	if st != nil {
+		err = st.Close()
+		if err != nil {
+			logrus.WithError(err).Error("failed to close sample store")
+		}
+	}
+
 	logrus.Info("shutting down")
 }
+
+// sinks returns the configured sinks with their defaults filled in. Without
+// any the bridge sends to INGESTER_URL using the ingester and queue settings.
+func sinks(cfg *config.Config, collectorID string) ([]config.Sink, error) {
+	ingesterURL := os.Getenv("INGESTER_URL")
+
+	if len(cfg.Sinks) == 0 {
+		s := config.Sink{
+			Name:  "ingester",
+			Type:  sink.TypeHTTP,
+			HTTP:  cfg.Ingester,
+			Queue: cfg.Queue,
+		}
+
+		if s.HTTP.URL == "" {
+			s.HTTP.URL = ingesterURL
+		}
+		if s.HTTP.URL == "" {
+			return nil, errors.New("INGESTER_URL must be set")
+		}
+		if s.HTTP.DeadLetterPath == "" {
+			s.HTTP.DeadLetterPath = defaultDeadLetterPath
+		}
+		if s.Queue.Dir == "" {
+			s.Queue.Dir = defaultQueueDir
+		}
+
+		return []config.Sink{s}, nil
+	}
+
+	sinks := make([]config.Sink, len(cfg.Sinks))
+	for i, s := range cfg.Sinks {
+		if s.Type == sink.TypeHTTP {
+			if s.HTTP.URL == "" {
+				s.HTTP.URL = ingesterURL
+			}
+			if s.HTTP.DeadLetterPath == "" {
+				s.HTTP.DeadLetterPath = filepath.Join(defaultDataDir, s.Name+"-dead-letter.ndjson")
+			}
+		}
+		if s.Type == sink.TypeInflux && s.Influx.DeadLetterPath == "" {
+			s.Influx.DeadLetterPath = filepath.Join(defaultDataDir, s.Name+"-dead-letter.ndjson")
+		}
+		if s.Type == sink.TypeRemoteWrite && s.RemoteWrite.DeadLetterPath == "" {
+			s.RemoteWrite.DeadLetterPath = filepath.Join(defaultDataDir, s.Name+"-dead-letter.ndjson")
+		}
+		if s.Type == sink.TypeOTLP {
+			if s.OTLP.DeadLetterPath == "" {
+				s.OTLP.DeadLetterPath = filepath.Join(defaultDataDir, s.Name+"-dead-letter.ndjson")
+			}
+
+			resource := map[string]string{"service.instance.id": collectorID}
+			for key, value := range s.OTLP.Resource {
+				resource[key] = value
+			}
+			s.OTLP.Resource = resource
+		}
+		if s.Type == sink.TypeMQTT {
+			if s.MQTT.ClientID == "" {
+				s.MQTT.ClientID = "plant-bridge-" + collectorID
+			}
+			if s.MQTT.StatusTopic == "" {
+				s.MQTT.StatusTopic = "plants/bridge/" + collectorID + "/status"
+			}
+		}
+		if s.Queue.Dir == "" {
+			s.Queue.Dir = filepath.Join(defaultQueueDir, s.Name)
+		}
+
+		sinks[i] = s
+	}
+
+	return sinks, nil
+}
+
+// reportStages returns downsampling, when it's enabled, and report-on-change.
+// Windows are aggregated before report-on-change drops anything, so their
+// counts, means and extremes cover every reading.
+func reportStages(cfg *config.Config) ([]pipeline.Stage, error) {
+	var stages []pipeline.Stage
+	if cfg.Downsample.Window != 0 {
+		aggregator, err := downsample.NewAggregator(cfg.Downsample)
+		if err != nil {
+			return nil, fmt.Errorf("downsampling: %w", err)
+		}
+
+		stages = append(stages, aggregator)
+		logrus.WithField("window", cfg.Downsample.Window).Info("downsampling enabled")
+	}
+
+	reporter, err := deadband.NewFilter(cfg.Report)
+	if err != nil {
+		return nil, fmt.Errorf("report-on-change: %w", err)
+	}
+
+	return append(stages, reporter), nil
+}
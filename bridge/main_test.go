@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ryanrolds/plant-collector/bridge/internal/config"
+	"github.com/ryanrolds/plant-collector/bridge/internal/ingester"
+	"github.com/ryanrolds/plant-collector/bridge/internal/pipeline"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReportStages(t *testing.T) {
+	start := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+
+	stages, err := reportStages(&config.Config{
+		Report: config.Report{SensorTypes: map[string]config.ReportSensorType{
+			"b-parasite": {Heartbeat: time.Hour, Deadband: map[string]float64{ingester.MetricMoisture: 5}},
+		}},
+		Downsample: config.Downsample{Window: 5 * time.Minute},
+	})
+	assert.Nil(t, err)
+	p := pipeline.New(stages...)
+
+	// report-on-change would only let the first reading and the spike through
+	for i, moisture := range []float32{40, 41, 40, 60, 41} {
+		moisture := moisture
+		assert.Len(t, p.Process(ingester.Sample{
+			Time:       start.Add(time.Duration(i) * time.Minute),
+			Plant:      "monstera",
+			Device:     "C4:7C:8D:6A:3D:72",
+			DeviceType: "b-parasite",
+			Moisture:   &moisture,
+		}), 0)
+	}
+
+	// the window covers every reading
+	samples := p.Flush(start.Add(5 * time.Minute))
+	assert.Len(t, samples, 1)
+	assert.Equal(t, ingester.Stats{Min: 40, Max: 60, Mean: 44.4, Last: 41, Count: 5}, samples[0].Stats[ingester.MetricMoisture])
+}